@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"io"
 	"net/http"
@@ -8,6 +9,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/mozillazg/go-unidecode"
@@ -21,20 +23,50 @@ type EchoUpdateRequest struct {
 }
 
 func infoHandler(w http.ResponseWriter, r *http.Request) {
+	info := map[string]any{
+		"version":   Version,
+		"queries":   vector != nil || config.Texts.Enabled,
+		"texts":     config.Texts.Enabled,
+		"shortener": config.Shortener.Enabled,
+		"oidc":      oidc != nil,
+		"batch":     config.Server.MaxBatchFiles,
+	}
+
+	if config.Texts.Enabled {
+		info["languages"] = HighlightLanguages()
+	}
+
 	okay(w, "application/json")
 
-	json.NewEncoder(w).Encode(map[string]any{
-		"version": Version,
-		"queries": vector != nil,
-	})
+	json.NewEncoder(w).Encode(info)
 }
 
 func verifyHandler(w http.ResponseWriter, r *http.Request) {
-	if isAuthenticated(r) {
-		w.WriteHeader(http.StatusOK)
-	} else {
+	caller, err := identify(r)
+	if err != nil {
+		abort(w, http.StatusInternalServerError, "database error")
+
+		log.Warnln("verify: failed to identify caller")
+		log.Warnln(err)
+
+		return
+	}
+
+	if !checkCaller(w, r, caller) {
+		return
+	}
+
+	if caller == nil {
 		w.WriteHeader(http.StatusUnauthorized)
+
+		return
 	}
+
+	okay(w, "application/json")
+
+	json.NewEncoder(w).Encode(map[string]any{
+		"scopes": caller.Scopes,
+	})
 }
 
 func viewEchoHandler(w http.ResponseWriter, r *http.Request) {
@@ -48,7 +80,7 @@ func viewEchoHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	ext := chi.URLParam(r, "ext")
-	if !config.IsValidImageFormat(ext) && !config.IsValidVideoFormat(ext, false) {
+	if !validFileExtension(ext) {
 		abort(w, http.StatusBadRequest, "invalid extension")
 
 		log.Warnln("view: invalid extension")
@@ -56,6 +88,28 @@ func viewEchoHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	echo, err := database.Find(r.Context(), hash)
+	if err != nil {
+		abort(w, http.StatusInternalServerError, "database error")
+
+		log.Warnln("view: failed to find echo")
+		log.Warnln(err)
+
+		return
+	}
+
+	// expired echos are gone already, the reaper just hasn't caught up yet
+	if echo == nil || echo.Extension != ext || echo.IsExpired() {
+		abort(w, http.StatusNotFound, "echo not found")
+
+		return
+	}
+
+	owner, cache, ok := authorizeView(w, r, echo)
+	if !ok {
+		return
+	}
+
 	storage, err := storageAbs()
 	if err != nil {
 		abort(w, http.StatusInternalServerError, "storage configuration error")
@@ -86,11 +140,129 @@ func viewEchoHandler(w http.ResponseWriter, r *http.Request) {
 
 	defer file.Close()
 
-	w.Header().Set("Cache-Control", "public, max-age=604800, must-revalidate")
+	burn, ok := claimBurn(w, r, echo, owner)
+	if !ok {
+		return
+	}
+
+	if echo.Burn {
+		cache = "private, no-store"
+	}
+
+	if echo.IsText() {
+		// never let browsers sniff pastes into html
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+	} else if echo.IsFile() {
+		setAttachmentHeaders(w, echo)
+	}
+
+	w.Header().Set("Cache-Control", cache)
 
 	okay(w)
 
 	io.Copy(w, file)
+
+	if burn {
+		file.Close()
+
+		finishBurn(r, echo)
+	}
+}
+
+// authorizeView runs the visibility, signature and password checks of the
+// public echo views. It returns whether the caller owns the echo and the
+// Cache-Control to respond with, or writes the response and reports false if
+// the echo may not be viewed.
+func authorizeView(w http.ResponseWriter, r *http.Request, echo *Echo) (bool, string, bool) {
+	cache := "public, max-age=604800, must-revalidate"
+
+	if echo.Expires > 0 {
+		cache = "public, max-age=" + strconv.FormatInt(min(604800, echo.Expires-time.Now().Unix()), 10) + ", must-revalidate"
+	}
+
+	var owner bool
+
+	if echo.Visibility == VisibilityPrivate || echo.IsProtected() || echo.Burn {
+		caller, err := identify(r)
+		if err != nil {
+			abort(w, http.StatusInternalServerError, "database error")
+
+			log.Warnln("view: failed to identify caller")
+			log.Warnln(err)
+
+			return false, "", false
+		}
+
+		owner = caller != nil && caller.CanAccess(echo)
+	}
+
+	if echo.Visibility != VisibilityPublic {
+		signed, status := checkSignature(r, echo)
+
+		if !signed && !owner && echo.Visibility == VisibilityPrivate {
+			switch status {
+			case http.StatusGone:
+				abort(w, status, "link expired")
+			case http.StatusForbidden:
+				abort(w, status, "invalid signature")
+			default:
+				abort(w, http.StatusNotFound, "echo not found")
+			}
+
+			return false, "", false
+		}
+
+		cache = "private, no-store"
+
+		w.Header().Set("X-Robots-Tag", "noindex, nofollow")
+	}
+
+	if echo.IsProtected() {
+		if !owner && !isUnlocked(r, echo) {
+			renderUnlockPage(w, http.StatusUnauthorized, "")
+
+			return false, "", false
+		}
+
+		cache = "private, no-store"
+	}
+
+	return owner, cache, true
+}
+
+// claimBurn lets only the first viewer of a burn-after-read echo see it. It
+// reports whether the echo has to be burned once it was sent, or writes the
+// response and reports false if someone else got to it first.
+func claimBurn(w http.ResponseWriter, r *http.Request, echo *Echo, owner bool) (bool, bool) {
+	if !echo.Burn || owner {
+		return false, true
+	}
+
+	claimed, err := database.Burn(r.Context(), echo.Hash)
+	if err != nil {
+		abort(w, http.StatusInternalServerError, "database error")
+
+		log.Warnln("view: failed to burn echo")
+		log.Warnln(err)
+
+		return false, false
+	}
+
+	if !claimed {
+		abort(w, http.StatusNotFound, "echo not found")
+
+		return false, false
+	}
+
+	return true, true
+}
+
+// finishBurn removes a burned echo after it was sent to its viewer.
+func finishBurn(r *http.Request, echo *Echo) {
+	removeEchoFile(echo)
+
+	audit(r, nil, AuditBurn, echo.Hash, echo.Name)
 }
 
 func getEchoHandler(w http.ResponseWriter, r *http.Request) {
@@ -113,6 +285,14 @@ func getEchoHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !getCaller(r).CanAccess(echo) {
+		abort(w, http.StatusNotFound, "echo not found")
+
+		log.Warnf("get: echo %q not found\n", hash)
+
+		return
+	}
+
 	okay(w, "application/json")
 
 	json.NewEncoder(w).Encode(map[string]any{
@@ -132,7 +312,7 @@ func listEchosHandler(w http.ResponseWriter, r *http.Request) {
 
 	favoritesOnly := r.URL.Query().Get("favorites") == "1"
 
-	echos, err := database.FindAll(r.Context(), (page-1)*PageSize, PageSize, favoritesOnly)
+	echos, err := database.FindAll(r.Context(), (page-1)*PageSize, PageSize, getCaller(r).Filter(favoritesOnly))
 
 	if err != nil {
 		abort(w, http.StatusInternalServerError, "database error")
@@ -172,7 +352,7 @@ func deleteEchoHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if echo == nil {
+	if !getCaller(r).CanAccess(echo) {
 		abort(w, http.StatusNotFound, "echo not found")
 
 		log.Warnf("delete: echo %q not found\n", hash)
@@ -202,13 +382,15 @@ func deleteEchoHandler(w http.ResponseWriter, r *http.Request) {
 
 	count.Add(^uint64(0))
 
-	hub.BroadcastDelete(hash)
+	hub.BroadcastDelete(echo)
+
+	audit(r, getCaller(r), AuditDelete, echo.Hash, echo.Name)
 
 	okay(w)
 }
 
 func queryEchosHandler(w http.ResponseWriter, r *http.Request) {
-	if vector == nil {
+	if vector == nil && !config.Texts.Enabled {
 		abort(w, http.StatusServiceUnavailable, "querying is disabled")
 
 		return
@@ -223,10 +405,7 @@ func queryEchosHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	query := r.URL.Query().Get("q")
-
-	query = strings.TrimSpace(query)
-	query = unidecode.Unidecode(query)
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
 
 	if len(query) == 0 {
 		abort(w, http.StatusBadRequest, "missing query")
@@ -238,7 +417,9 @@ func queryEchosHandler(w http.ResponseWriter, r *http.Request) {
 
 	ctx := r.Context()
 
-	ranked, err := vector.Query(ctx, query, page*PageSize)
+	filter := getCaller(r).Filter(r.URL.Query().Get("favorites") == "1")
+
+	ranked, err := searchEchos(ctx, query, page*PageSize, filter)
 	if err != nil {
 		abort(w, http.StatusInternalServerError, "failed search")
 
@@ -265,9 +446,7 @@ func queryEchosHandler(w http.ResponseWriter, r *http.Request) {
 			scoreMap[res.Hash] = res.Similarity
 		}
 
-		favoritesOnly := r.URL.Query().Get("favorites") == "1"
-
-		results, err := database.FindByHashes(ctx, hashes, favoritesOnly)
+		results, err := database.FindByHashes(ctx, hashes, filter)
 		if err != nil {
 			abort(w, http.StatusInternalServerError, "database error")
 
@@ -295,6 +474,36 @@ func queryEchosHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// searchEchos ranks pastes matching filter and containing the query first,
+// followed by the images closest to it.
+func searchEchos(ctx context.Context, query string, limit int, filter EchoFilter) ([]VectorResult, error) {
+	var ranked []VectorResult
+
+	if config.Texts.Enabled {
+		hashes, err := database.SearchTexts(ctx, query, limit, filter)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, hash := range hashes {
+			ranked = append(ranked, VectorResult{
+				Hash: hash,
+			})
+		}
+	}
+
+	if vector != nil && len(ranked) < limit {
+		results, err := vector.Query(ctx, unidecode.Unidecode(query), limit-len(ranked))
+		if err != nil {
+			return nil, err
+		}
+
+		ranked = append(ranked, results...)
+	}
+
+	return ranked, nil
+}
+
 func parsePage(r *http.Request) int {
 	var page int
 
@@ -320,28 +529,40 @@ func toggleFavoriteHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	favorited, err := database.ToggleFavorite(r.Context(), hash)
+	echo, err := database.Find(r.Context(), hash)
 	if err != nil {
 		abort(w, http.StatusInternalServerError, "database error")
 
-		log.Warnln("favorite: failed to toggle")
+		log.Warnln("favorite: failed to find echo")
 		log.Warnln(err)
 
 		return
 	}
 
-	echo, err := database.Find(r.Context(), hash)
+	if !getCaller(r).CanAccess(echo) {
+		abort(w, http.StatusNotFound, "echo not found")
+
+		log.Warnf("favorite: echo %q not found\n", hash)
+
+		return
+	}
+
+	favorited, err := database.ToggleFavorite(r.Context(), hash)
 	if err != nil {
 		abort(w, http.StatusInternalServerError, "database error")
 
-		log.Warnln("favorite: failed to find echo after toggle")
+		log.Warnln("favorite: failed to toggle")
 		log.Warnln(err)
 
 		return
 	}
 
+	echo.Favorited = favorited
+
 	hub.BroadcastUpdate(echo)
 
+	audit(r, getCaller(r), AuditFavorite, echo.Hash, strconv.FormatBool(favorited))
+
 	okay(w, "application/json")
 
 	json.NewEncoder(w).Encode(map[string]any{
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	ProcessingQueued  = "queued"
+	ProcessingRunning = "processing"
+	ProcessingDone    = "done"
+	ProcessingFailed  = "failed"
+
+	// ProcessingRetention is how long finished background jobs can still be
+	// looked up, mostly so clients learn about failures.
+	ProcessingRetention = time.Hour
+
+	// AsyncDirectory keeps accepted uploads until they are processed, so
+	// they survive a restart.
+	AsyncDirectory = "processing"
+)
+
+type ProcessingStatus struct {
+	Hash    string `json:"hash"`
+	State   string `json:"state"`
+	Error   string `json:"error,omitempty"`
+	Updated int64  `json:"updated,omitempty"`
+	Echo    *Echo  `json:"echo,omitempty"`
+
+	Owner int64 `json:"-"`
+}
+
+var (
+	processingMx sync.Mutex
+	processing   = make(map[string]*ProcessingStatus)
+)
+
+// isAsync reports whether the upload should be processed in the background.
+// The "async" query parameter overrides server.async.
+func isAsync(r *http.Request) bool {
+	raw := r.URL.Query().Get("async")
+	if raw == "" {
+		return config.Server.Async
+	}
+
+	async, err := strconv.ParseBool(raw)
+	if err != nil {
+		return config.Server.Async
+	}
+
+	return async
+}
+
+// targetExtension returns the extension SaveUploadedFile will produce for a
+// sniffed upload, so the final url is known before encoding.
+func targetExtension(sniffed string) string {
+	switch sniffed {
+	case "jpg", "jpeg", "png", "webp":
+		return config.Images.Format
+	case "gif":
+		return config.GIFs.Format
+	}
+
+	return sniffed
+}
+
+func setProcessing(echo *Echo, state, message string) {
+	processingMx.Lock()
+	defer processingMx.Unlock()
+
+	status := &ProcessingStatus{
+		Hash:    echo.Hash,
+		State:   state,
+		Error:   message,
+		Updated: time.Now().Unix(),
+		Owner:   echo.Owner,
+	}
+
+	processing[echo.Hash] = status
+
+	if state == ProcessingDone || state == ProcessingFailed {
+		time.AfterFunc(ProcessingRetention, func() {
+			processingMx.Lock()
+			defer processingMx.Unlock()
+
+			if processing[echo.Hash] == status {
+				delete(processing, echo.Hash)
+			}
+		})
+	}
+}
+
+func findProcessing(hash string) *ProcessingStatus {
+	processingMx.Lock()
+	defer processingMx.Unlock()
+
+	status, ok := processing[hash]
+	if !ok {
+		return nil
+	}
+
+	copied := *status
+
+	return &copied
+}
+
+// storeUploadAsync creates the echo right away and leaves encoding to a
+// background worker. It returns false if the upload turned out to be a
+// duplicate, in which case echo is the existing one. Ownership of the file
+// at path moves to the worker, and the place in the upload queue is taken
+// before answering, so an accepted upload is never turned away later.
+func storeUploadAsync(r *http.Request, echo *Echo, path, uploadID string, timer *Timer) (bool, error) {
+	err := prepareText(echo, path)
+	if err != nil {
+		return false, err
+	}
+
+	timer.Start("dedupe")
+
+	duplicate, release, err := checkDuplicate(r.Context(), echo, path)
+	if err != nil {
+		return false, err
+	}
+
+	timer.Stop("dedupe")
+
+	if duplicate {
+		return false, nil
+	}
+
+	defer release()
+
+	err = uploadQueue.reserve()
+	if err != nil {
+		return false, err
+	}
+
+	timer.Start("store")
+
+	err = reserveEcho(echo)
+	if err != nil {
+		uploadQueue.release()
+
+		return false, err
+	}
+
+	// the worker encodes from the sniffed type, clients see the final one
+	job := *echo
+
+	echo.Extension = targetExtension(echo.Extension)
+
+	count.Add(1)
+
+	pending := asyncPath(echo.Hash)
+
+	err = moveFile(path, pending)
+	if err != nil {
+		uploadQueue.release()
+
+		database.Delete(echo.Hash)
+
+		count.Add(^uint64(0))
+
+		return false, &UploadError{http.StatusInternalServerError, "internal storage error", err}
+	}
+
+	timer.Stop("store")
+
+	setProcessing(echo, ProcessingQueued, "")
+
+	hub.BroadcastCreate(uploadID, echo)
+	hub.BroadcastProcessing(echo, true)
+
+	auditUpload(r, echo)
+
+	go processAsync(&job, pending)
+
+	return true, nil
+}
+
+// processAsync encodes an upload in the queue place reserved for it.
+func processAsync(echo *Echo, path string) {
+	defer os.Remove(path)
+
+	var err error
+
+	qerr := uploadQueue.work(context.Background(), func() {
+		setProcessing(echo, ProcessingRunning, "")
+
+		_, err = encodeUpload(context.Background(), echo, path)
+	})
+
+	if qerr != nil {
+		err = qerr
+	}
+
+	if err == nil {
+		err = completeEcho(echo)
+	}
+
+	if err != nil {
+		failAsync(echo, err)
+
+		return
+	}
+
+	usage.Add(uint64(echo.Size))
+
+	setProcessing(echo, ProcessingDone, "")
+
+	hub.BroadcastUpdate(echo)
+	hub.BroadcastProcessing(echo, false)
+
+	indexUpload(echo)
+
+	log.Printf("Processed %s in the background\n", echo.Hash)
+}
+
+func failAsync(echo *Echo, err error) {
+	uerr := asUploadError(err)
+
+	message := uerr.Message
+
+	// deleted while it was being processed, nothing left to clean up
+	if uerr.Status == http.StatusGone {
+		setProcessing(echo, ProcessingFailed, message)
+
+		return
+	}
+
+	log.Warnf("async: failed to process %s: %s\n", echo.Hash, message)
+	log.Warnln(err)
+
+	os.Remove(echo.Storage())
+
+	err = database.Delete(echo.Hash)
+	if err != nil {
+		log.Warnf("async: failed to delete %s: %v\n", echo.Hash, err)
+	} else {
+		count.Add(^uint64(0))
+	}
+
+	setProcessing(echo, ProcessingFailed, message)
+
+	hub.BroadcastFailure(echo, message)
+	hub.BroadcastDelete(echo)
+}
+
+func asyncPath(hash string) string {
+	return filepath.Join(AsyncDirectory, hash)
+}
+
+// isAsyncPending reports whether the echo still waits for background
+// processing, its file does not exist yet.
+func isAsyncPending(echo *Echo) bool {
+	if echo.Size != 0 {
+		return false
+	}
+
+	_, err := os.Stat(asyncPath(echo.Hash))
+
+	return err == nil
+}
+
+// RecoverAsyncUploads looks for reserved echos that never got their file
+// because of a restart. Those whose upload is still waiting in
+// AsyncDirectory are returned to be resumed, the rest can never finish and
+// are deleted. Other echos without a file are left to Verify. It has to run
+// before uploads are accepted.
+func RecoverAsyncUploads() ([]*Echo, error) {
+	ctx := context.Background()
+
+	err := os.MkdirAll(AsyncDirectory, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	unprocessed, err := database.FindUnprocessed(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		resume  []*Echo
+		waiting = make(map[string]bool)
+	)
+
+	for hash, sniffed := range unprocessed {
+		echo, err := database.Find(ctx, hash)
+		if err != nil {
+			return nil, err
+		}
+
+		if echo == nil {
+			continue
+		}
+
+		_, err = os.Stat(asyncPath(hash))
+		if err == nil {
+			// the worker encodes from the sniffed type
+			echo.Extension = sniffed
+
+			resume = append(resume, echo)
+			waiting[hash] = true
+
+			continue
+		}
+
+		log.Warnf("async: deleting %s, its processing was interrupted\n", hash)
+
+		// whatever the encoder got to write
+		os.Remove(echo.Storage())
+
+		err = database.Delete(hash)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	entries, err := os.ReadDir(AsyncDirectory)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if !waiting[entry.Name()] {
+			os.Remove(filepath.Join(AsyncDirectory, entry.Name()))
+		}
+	}
+
+	return resume, nil
+}
+
+// ResumeAsyncUploads queues the jobs found by RecoverAsyncUploads. They were
+// accepted before the restart, so they are queued even past queue_depth.
+func ResumeAsyncUploads(echos []*Echo) {
+	for _, echo := range echos {
+		uploadQueue.pending.Add(1)
+
+		setProcessing(echo, ProcessingQueued, "")
+
+		go processAsync(echo, asyncPath(echo.Hash))
+	}
+
+	if len(echos) > 0 {
+		log.Printf("Resuming %d background uploads\n", len(echos))
+	}
+}
+
+func asyncResponse(echo *Echo, sniffed string, timer *Timer) map[string]any {
+	return map[string]any{
+		"echo":         echo,
+		"sniffed":      sniffed,
+		"status":       ProcessingQueued,
+		"timing":       timer,
+		"deletion_url": echo.DeletionURL(),
+	}
+}
+
+func (d *EchoDatabase) FinishEcho(ctx context.Context, echo *Echo) (bool, error) {
+	res, err := d.ExecContext(ctx, "UPDATE echos SET extension = ?, animated = ?, size = ?, pending = '' WHERE hash = ?", echo.Extension, echo.Animated, echo.Size, echo.Hash)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected > 0, nil
+}
+
+// FindUnprocessed returns the hashes of reserved echos that never got their
+// file, along with the extension they were sniffed as.
+func (d *EchoDatabase) FindUnprocessed(ctx context.Context) (map[string]string, error) {
+	rows, err := d.QueryContext(ctx, "SELECT hash, pending FROM echos WHERE pending != ''")
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	unprocessed := make(map[string]string)
+
+	for rows.Next() {
+		var hash, sniffed string
+
+		err = rows.Scan(&hash, &sniffed)
+		if err != nil {
+			return nil, err
+		}
+
+		unprocessed[hash] = sniffed
+	}
+
+	return unprocessed, rows.Err()
+}
+
+func processingStatusHandler(w http.ResponseWriter, r *http.Request) {
+	hash := chi.URLParam(r, "hash")
+	if !validateHash(hash) {
+		abort(w, http.StatusBadRequest, "invalid hash format")
+
+		log.Warnln("status: invalid hash")
+
+		return
+	}
+
+	caller := getCaller(r)
+
+	status := findProcessing(hash)
+
+	// pending and failed jobs have no (usable) echo to look at
+	if status != nil && status.State != ProcessingDone && (caller.IsAdmin() || status.Owner == caller.Owner()) {
+		okay(w, "application/json")
+
+		json.NewEncoder(w).Encode(status)
+
+		return
+	}
+
+	echo, err := database.Find(r.Context(), hash)
+	if err != nil {
+		abort(w, http.StatusInternalServerError, "database error")
+
+		log.Warnln("status: failed to find echo")
+		log.Warnln(err)
+
+		return
+	}
+
+	if !caller.CanAccess(echo) {
+		abort(w, http.StatusNotFound, "echo not found")
+
+		log.Warnf("status: echo %q not found\n", hash)
+
+		return
+	}
+
+	status = &ProcessingStatus{
+		Hash:  echo.Hash,
+		State: ProcessingDone,
+		Echo:  echo,
+	}
+
+	// the job was lost, e.g. its echo was reserved right before a crash
+	if echo.Size == 0 && !echo.Exists() && !isAsyncPending(echo) {
+		status.State = ProcessingFailed
+		status.Error = "processing was interrupted"
+		status.Echo = nil
+	}
+
+	okay(w, "application/json")
+
+	json.NewEncoder(w).Encode(status)
+}
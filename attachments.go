@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var rgFileExtension = regexp.MustCompile(`^[a-z0-9]{1,10}$`)
+
+var (
+	zipSignatures = [][]byte{[]byte("PK\x03\x04"), []byte("PK\x05\x06")}
+
+	// fileSignatures are the magic bytes of common formats, allowlisted
+	// files claiming one of them have to start with it.
+	fileSignatures = map[string][][]byte{
+		"zip":  zipSignatures,
+		"jar":  zipSignatures,
+		"apk":  zipSignatures,
+		"docx": zipSignatures,
+		"xlsx": zipSignatures,
+		"pptx": zipSignatures,
+		"odt":  zipSignatures,
+		"ods":  zipSignatures,
+		"epub": zipSignatures,
+		"pdf":  {[]byte("%PDF-")},
+		"gz":   {{0x1f, 0x8b}},
+		"tgz":  {{0x1f, 0x8b}},
+		"bz2":  {[]byte("BZh")},
+		"xz":   {[]byte("\xfd7zXZ\x00")},
+		"zst":  {{0x28, 0xb5, 0x2f, 0xfd}},
+		"7z":   {[]byte("7z\xbc\xaf\x27\x1c")},
+		"rar":  {[]byte("Rar!\x1a\x07")},
+	}
+
+	// fileTypes fills in for system mime databases that lack these.
+	fileTypes = map[string]string{
+		"zip":  "application/zip",
+		"pdf":  "application/pdf",
+		"gz":   "application/gzip",
+		"tgz":  "application/gzip",
+		"bz2":  "application/x-bzip2",
+		"xz":   "application/x-xz",
+		"zst":  "application/zstd",
+		"7z":   "application/x-7z-compressed",
+		"rar":  "application/vnd.rar",
+		"tar":  "application/x-tar",
+		"jar":  "application/java-archive",
+		"apk":  "application/vnd.android.package-archive",
+		"epub": "application/epub+zip",
+		"log":  "text/plain; charset=utf-8",
+		"csv":  "text/csv; charset=utf-8",
+	}
+)
+
+func validFileExtension(ext string) bool {
+	return rgFileExtension.MatchString(ext)
+}
+
+// sniffUpload identifies an upload by its content, falling back to the
+// extension of its name for allowlisted files.
+func sniffUpload(buf []byte, name string) string {
+	sniffed := sniffType(buf)
+	if sniffed != "" && sniffed != "txt" {
+		return sniffed
+	}
+
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(name), "."))
+
+	if config.IsAllowedFile(ext) && matchesSignature(ext, buf) {
+		return ext
+	}
+
+	return sniffed
+}
+
+func matchesSignature(ext string, buf []byte) bool {
+	signatures, ok := fileSignatures[ext]
+	if !ok {
+		return true
+	}
+
+	for _, signature := range signatures {
+		if bytes.HasPrefix(buf, signature) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsFile reports whether the echo is a generic file that is only ever
+// offered as a download.
+func (e *Echo) IsFile() bool {
+	return !e.IsImage() && !e.IsText() && !e.IsLink() && !config.IsValidVideoFormat(e.Extension, false)
+}
+
+func fileContentType(ext string) string {
+	if typ, ok := fileTypes[ext]; ok {
+		return typ
+	}
+
+	if typ := mime.TypeByExtension("." + ext); typ != "" {
+		return typ
+	}
+
+	return "application/octet-stream"
+}
+
+// setAttachmentHeaders makes browsers download a generic file under its
+// original name instead of rendering it.
+func setAttachmentHeaders(w http.ResponseWriter, echo *Echo) {
+	name := filepath.Base(echo.Name)
+
+	if !strings.EqualFold(filepath.Ext(name), "."+echo.Extension) {
+		name += "." + echo.Extension
+	}
+
+	disposition := mime.FormatMediaType("attachment", map[string]string{
+		"filename": name,
+	})
+
+	if disposition == "" {
+		disposition = "attachment"
+	}
+
+	w.Header().Set("Content-Type", fileContentType(echo.Extension))
+	w.Header().Set("Content-Disposition", disposition)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+}
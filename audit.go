@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	AuditActorCLI = "cli"
+
+	AuditUpload      = "upload"
+	AuditDelete      = "delete"
+	AuditExpire      = "expire"
+	AuditBurn        = "burn"
+	AuditEvict       = "evict"
+	AuditFavorite    = "favorite"
+	AuditVisibility  = "visibility"
+	AuditPassword    = "password"
+	AuditShare       = "share"
+	AuditShorten     = "shorten"
+	AuditLogin       = "login"
+	AuditLogout      = "logout"
+	AuditTokenCreate = "token.create"
+	AuditTokenRevoke = "token.revoke"
+	AuditUserCreate  = "user.create"
+	AuditUserDelete  = "user.delete"
+	AuditUserQuota   = "user.quota"
+
+	AuditWebhookRetry = "webhook.retry"
+)
+
+type AuditEntry struct {
+	ID        int64  `json:"id"`
+	Timestamp int64  `json:"timestamp"`
+	Action    string `json:"action"`
+	Actor     string `json:"actor"`
+	TokenID   int64  `json:"token_id"`
+	UserID    int64  `json:"user_id"`
+	IP        string `json:"ip"`
+	UserAgent string `json:"user_agent"`
+	Hash      string `json:"hash"`
+	Detail    string `json:"detail"`
+}
+
+type AuditFilter struct {
+	Action  string
+	Actor   string
+	Hash    string
+	IP      string
+	TokenID int64
+	UserID  int64
+	Since   int64
+	Until   int64
+}
+
+// audit appends an entry for a mutation made by caller. Failing to write the
+// entry is logged but never fails the request itself.
+func audit(r *http.Request, caller *Caller, action, hash, detail string) {
+	entry := &AuditEntry{
+		Timestamp: time.Now().Unix(),
+		Action:    action,
+		IP:        clientIP(r),
+		UserAgent: r.UserAgent(),
+		Hash:      hash,
+		Detail:    detail,
+	}
+
+	if caller != nil {
+		entry.Actor = caller.Key()
+		entry.UserID = caller.Owner()
+
+		if caller.Token != nil {
+			entry.TokenID = caller.Token.ID
+		}
+	}
+
+	err := database.Audit(context.Background(), entry)
+	if err != nil {
+		log.Warnf("Failed to write audit entry (%s): %v\n", action, err)
+	}
+}
+
+// auditTask records mutations made through the command line tasks.
+func auditTask(action, detail string) {
+	err := database.Audit(context.Background(), &AuditEntry{
+		Timestamp: time.Now().Unix(),
+		Action:    action,
+		Actor:     AuditActorCLI,
+		Detail:    detail,
+	})
+	if err != nil {
+		log.Warnf("Failed to write audit entry (%s): %v\n", action, err)
+	}
+}
+
+func (d *EchoDatabase) Audit(ctx context.Context, entry *AuditEntry) error {
+	res, err := d.ExecContext(ctx, "INSERT INTO audit (timestamp, action, actor, token_id, user_id, ip, user_agent, hash, detail) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)", entry.Timestamp, entry.Action, entry.Actor, entry.TokenID, entry.UserID, entry.IP, entry.UserAgent, entry.Hash, entry.Detail)
+	if err != nil {
+		return err
+	}
+
+	entry.ID, err = res.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (f AuditFilter) Apply(b *strings.Builder) []any {
+	var args []any
+
+	add := func(clause string, value any) {
+		b.WriteString(clause)
+
+		args = append(args, value)
+	}
+
+	if f.Action != "" {
+		add(" AND action = ?", f.Action)
+	}
+
+	if f.Actor != "" {
+		add(" AND actor = ?", f.Actor)
+	}
+
+	if f.Hash != "" {
+		add(" AND hash = ?", f.Hash)
+	}
+
+	if f.IP != "" {
+		add(" AND ip = ?", f.IP)
+	}
+
+	if f.TokenID != 0 {
+		add(" AND token_id = ?", f.TokenID)
+	}
+
+	if f.UserID != 0 {
+		add(" AND user_id = ?", f.UserID)
+	}
+
+	if f.Since != 0 {
+		add(" AND timestamp >= ?", f.Since)
+	}
+
+	if f.Until != 0 {
+		add(" AND timestamp <= ?", f.Until)
+	}
+
+	return args
+}
+
+func (d *EchoDatabase) FindAudit(ctx context.Context, offset, limit int, filter AuditFilter) ([]AuditEntry, int64, error) {
+	var b strings.Builder
+
+	b.WriteString("FROM audit WHERE 1 = 1")
+
+	args := filter.Apply(&b)
+
+	var total int64
+
+	err := d.QueryRowContext(ctx, "SELECT COUNT(id) "+b.String(), args...).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := d.QueryContext(ctx, "SELECT id, timestamp, action, actor, token_id, user_id, ip, user_agent, hash, detail "+b.String()+" ORDER BY id DESC LIMIT ? OFFSET ?", append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	defer rows.Close()
+
+	entries := make([]AuditEntry, 0)
+
+	for rows.Next() {
+		var e AuditEntry
+
+		err := rows.Scan(&e.ID, &e.Timestamp, &e.Action, &e.Actor, &e.TokenID, &e.UserID, &e.IP, &e.UserAgent, &e.Hash, &e.Detail)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		entries = append(entries, e)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return entries, total, nil
+}
+
+func parseAuditFilter(r *http.Request) (AuditFilter, error) {
+	query := r.URL.Query()
+
+	filter := AuditFilter{
+		Action: query.Get("action"),
+		Actor:  query.Get("actor"),
+		Hash:   query.Get("hash"),
+		IP:     query.Get("ip"),
+	}
+
+	ints := []struct {
+		name string
+		dest *int64
+	}{
+		{"token", &filter.TokenID},
+		{"user", &filter.UserID},
+		{"since", &filter.Since},
+		{"until", &filter.Until},
+	}
+
+	for _, entry := range ints {
+		raw := query.Get(entry.name)
+		if raw == "" {
+			continue
+		}
+
+		value, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || value < 0 {
+			return filter, fmt.Errorf("invalid %s parameter", entry.name)
+		}
+
+		*entry.dest = value
+	}
+
+	return filter, nil
+}
+
+func listAuditHandler(w http.ResponseWriter, r *http.Request) {
+	page := 1
+
+	if raw := r.URL.Query().Get("page"); raw != "" {
+		num, err := strconv.Atoi(raw)
+		if err != nil || num < 1 {
+			abort(w, http.StatusBadRequest, "invalid page number")
+
+			log.Warnln("audit: invalid page number")
+
+			return
+		}
+
+		page = num
+	}
+
+	filter, err := parseAuditFilter(r)
+	if err != nil {
+		abort(w, http.StatusBadRequest, err.Error())
+
+		log.Warnln("audit: invalid filter")
+
+		return
+	}
+
+	entries, total, err := database.FindAudit(r.Context(), (page-1)*PageSize, PageSize, filter)
+	if err != nil {
+		abort(w, http.StatusInternalServerError, "database error")
+
+		log.Warnln("audit: failed to read entries")
+		log.Warnln(err)
+
+		return
+	}
+
+	okay(w, "application/json")
+
+	json.NewEncoder(w).Encode(map[string]any{
+		"entries": entries,
+		"page":    page,
+		"total":   total,
+	})
+}
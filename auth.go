@@ -1,30 +1,229 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
 	"net/http"
 	"strings"
+	"time"
 )
 
+type callerKey struct{}
+
+type Caller struct {
+	Token  *Token
+	User   *User
+	Scopes Scope
+}
+
 func authenticate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !isAuthenticated(r) {
+		caller, err := identify(r)
+		if err != nil {
+			abort(w, http.StatusInternalServerError, "database error")
+
+			log.Warnln("auth: failed to identify caller")
+			log.Warnln(err)
+
+			return
+		}
+
+		if !checkCaller(w, r, caller) {
+			return
+		}
+
+		if caller == nil {
 			abort(w, http.StatusUnauthorized, "unauthorized")
 
 			return
 		}
 
-		next.ServeHTTP(w, r)
+		ctx := context.WithValue(r.Context(), callerKey{}, caller)
+
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
-func isAuthenticated(r *http.Request) bool {
+func requireScope(scope Scope) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			caller := getCaller(r)
+
+			if caller == nil || !caller.Scopes.Has(scope) {
+				abort(w, http.StatusForbidden, "missing scope: "+scope.String())
+
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func getCaller(r *http.Request) *Caller {
+	caller, _ := r.Context().Value(callerKey{}).(*Caller)
+
+	return caller
+}
+
+func identify(r *http.Request) (*Caller, error) {
 	token := r.Header.Get("Authorization")
 
-	if !strings.HasPrefix(token, "Bearer ") {
-		return false
+	if strings.HasPrefix(token, "Bearer ") {
+		return identifyToken(r.Context(), strings.TrimPrefix(token, "Bearer "))
+	}
+
+	cookie, err := r.Cookie(SessionCookie)
+	if err != nil || cookie.Value == "" {
+		return nil, nil
+	}
+
+	return identifySession(r.Context(), cookie.Value)
+}
+
+func identifyToken(ctx context.Context, token string) (*Caller, error) {
+	if token == "" {
+		return nil, nil
+	}
+
+	if config.Server.UploadToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(config.Server.UploadToken)) == 1 {
+		return &Caller{
+			Scopes: ScopeAdmin,
+		}, nil
+	}
+
+	if !strings.HasPrefix(token, TokenPrefix) {
+		return nil, nil
+	}
+
+	entry, err := database.FindTokenBySecret(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	return callerFromToken(ctx, entry)
+}
+
+func identifySession(ctx context.Context, secret string) (*Caller, error) {
+	session, err := database.FindSession(ctx, secret)
+	if err != nil {
+		return nil, err
+	}
+
+	if session == nil {
+		return nil, nil
+	}
+
+	if session.TokenID != 0 {
+		entry, err := database.FindTokenByID(ctx, session.TokenID)
+		if err != nil {
+			return nil, err
+		}
+
+		return callerFromToken(ctx, entry)
+	}
+
+	// sessions started with the master token die with it, also when it is
+	// changed to a new value
+	if session.UserID == 0 {
+		if config.Server.UploadToken == "" || subtle.ConstantTimeCompare([]byte(session.Master), []byte(masterFingerprint())) != 1 {
+			return nil, nil
+		}
+
+		return &Caller{
+			Scopes: ScopeAdmin,
+		}, nil
+	}
+
+	user, err := database.FindUser(ctx, session.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	if user == nil {
+		return nil, nil
 	}
 
-	token = strings.TrimPrefix(token, "Bearer ")
+	scopes := session.Scopes
+
+	// admin rights of single sign-on sessions follow the user
+	if !user.Admin {
+		scopes &^= ScopeAdmin
+	}
+
+	return &Caller{
+		User:   user,
+		Scopes: scopes,
+	}, nil
+}
+
+func callerFromToken(ctx context.Context, entry *Token) (*Caller, error) {
+	if entry == nil || entry.IsRevoked() {
+		return nil, nil
+	}
+
+	var (
+		user *User
+		err  error
+	)
+
+	if entry.UserID != 0 {
+		user, err = database.FindUser(ctx, entry.UserID)
+		if err != nil {
+			return nil, err
+		}
+
+		if user == nil {
+			return nil, nil
+		}
+	}
+
+	if time.Now().Unix()-entry.LastUsed >= TokenTouchInterval {
+		go func() {
+			err := database.TouchToken(entry.ID)
+			if err != nil {
+				log.Warnf("Failed to update token usage: %v\n", err)
+			}
+		}()
+	}
+
+	return &Caller{
+		Token:  entry,
+		User:   user,
+		Scopes: entry.Scopes,
+	}, nil
+}
+
+func (c *Caller) IsAdmin() bool {
+	if c.Scopes&ScopeAdmin != 0 {
+		return true
+	}
+
+	return c.User != nil && c.User.Admin
+}
+
+// Owner returns the user id new echos are attributed to. Tokens without a
+// user share the unowned (0) pool.
+func (c *Caller) Owner() int64 {
+	if c.User == nil {
+		return 0
+	}
+
+	return c.User.ID
+}
+
+func (c *Caller) Filter(favoritesOnly bool) EchoFilter {
+	return EchoFilter{
+		Owner:         c.Owner(),
+		AnyOwner:      c.IsAdmin(),
+		FavoritesOnly: favoritesOnly,
+	}
+}
+
+func (c *Caller) CanAccess(echo *Echo) bool {
+	if echo == nil {
+		return false
+	}
 
-	return token == config.Server.UploadToken
+	return c.IsAdmin() || echo.Owner == c.Owner()
 }
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"text/template"
+)
+
+// TokenPlaceholder stands in for the token in client configs requested with
+// a dashboard session, since stored tokens can't be recovered.
+const TokenPlaceholder = "YOUR_TOKEN"
+
+type ShareXConfig struct {
+	Version         string            `json:"Version"`
+	Name            string            `json:"Name"`
+	DestinationType string            `json:"DestinationType"`
+	RequestMethod   string            `json:"RequestMethod"`
+	RequestURL      string            `json:"RequestURL"`
+	Headers         map[string]string `json:"Headers"`
+	Body            string            `json:"Body"`
+	Data            string            `json:"Data,omitempty"`
+	FileFormName    string            `json:"FileFormName,omitempty"`
+	URL             string            `json:"URL"`
+	DeletionURL     string            `json:"DeletionURL"`
+	ErrorMessage    string            `json:"ErrorMessage"`
+}
+
+var clientScripts = template.Must(template.New("scripts").Funcs(template.FuncMap{
+	"quote": shellQuote,
+}).Parse(`
+{{define "curl"}}#!/bin/sh
+# Uploads files to echo-vault and prints their urls.
+# usage: echo-vault.sh <file>...
+
+URL={{quote .URL}}
+TOKEN={{quote .Token}}
+
+[ $# -gt 0 ] || { echo "usage: $0 <file>..." >&2; exit 1; }
+
+status=0
+
+for file in "$@"; do
+	# curl appends the (encoded) file name to the url
+	curl -sS --fail-with-body -H "Authorization: Bearer $TOKEN" -H "Accept: text/plain" -T "$file" "${URL}upload/" || status=1
+done
+
+exit $status
+{{end}}
+{{define "flameshot"}}#!/bin/sh
+# Takes a screenshot with flameshot, uploads it to echo-vault and copies the
+# url to the clipboard.
+
+URL={{quote .URL}}
+TOKEN={{quote .Token}}
+
+link=$(flameshot gui --raw | curl -sS --fail-with-body -H "Authorization: Bearer $TOKEN" -H "Accept: text/plain" -H "Content-Type: image/png" --data-binary @- "${URL}upload?name=screenshot.png") || exit 1
+
+if command -v wl-copy >/dev/null; then
+	printf '%s' "$link" | wl-copy
+elif command -v xclip >/dev/null; then
+	printf '%s' "$link" | xclip -selection clipboard
+fi
+
+command -v notify-send >/dev/null && notify-send "echo-vault" "$link"
+
+echo "$link"
+{{end}}`))
+
+// shellQuote wraps s in single quotes for use in a POSIX shell script.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// callerToken returns the bearer token the request was made with.
+func callerToken(r *http.Request) string {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return TokenPlaceholder
+	}
+
+	return token
+}
+
+func writeClientConfig(w http.ResponseWriter, contentType, filename string) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	w.Header().Set("Cache-Control", "private, no-store")
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func shareXConfigHandler(w http.ResponseWriter, r *http.Request) {
+	writeClientConfig(w, "application/json", "echo-vault.sxcu")
+
+	encoder := json.NewEncoder(w)
+
+	encoder.SetIndent("", "  ")
+
+	encoder.Encode(ShareXConfig{
+		Version:         "17.0.0",
+		Name:            "echo-vault",
+		DestinationType: "ImageUploader, FileUploader",
+		RequestMethod:   "POST",
+		RequestURL:      config.Server.URL + "upload",
+		Headers: map[string]string{
+			"Authorization": "Bearer " + callerToken(r),
+		},
+		Body:         "MultipartFormData",
+		FileFormName: "upload",
+		URL:          "{json:echo.url}",
+		DeletionURL:  "{json:deletion_url}",
+		ErrorMessage: "{json:error}",
+	})
+}
+
+// shareXShortenerConfigHandler exports a second uploader for ShareX, since a
+// custom uploader can only target a single url.
+func shareXShortenerConfigHandler(w http.ResponseWriter, r *http.Request) {
+	writeClientConfig(w, "application/json", "echo-vault-shortener.sxcu")
+
+	encoder := json.NewEncoder(w)
+
+	encoder.SetIndent("", "  ")
+
+	encoder.Encode(ShareXConfig{
+		Version:         "17.0.0",
+		Name:            "echo-vault (shortener)",
+		DestinationType: "URLShortener",
+		RequestMethod:   "POST",
+		RequestURL:      config.Server.URL + "shorten",
+		Headers: map[string]string{
+			"Authorization": "Bearer " + callerToken(r),
+		},
+		Body:         "JSON",
+		Data:         `{"url":"{input}"}`,
+		URL:          "{json:echo.url}",
+		DeletionURL:  "{json:deletion_url}",
+		ErrorMessage: "{json:error}",
+	})
+}
+
+func curlConfigHandler(w http.ResponseWriter, r *http.Request) {
+	writeClientScript(w, r, "curl", "echo-vault.sh")
+}
+
+func flameshotConfigHandler(w http.ResponseWriter, r *http.Request) {
+	writeClientScript(w, r, "flameshot", "echo-vault-flameshot.sh")
+}
+
+func writeClientScript(w http.ResponseWriter, r *http.Request, name, filename string) {
+	writeClientConfig(w, "text/x-shellscript; charset=utf-8", filename)
+
+	err := clientScripts.ExecuteTemplate(w, name, map[string]string{
+		"URL":   config.Server.URL,
+		"Token": callerToken(r),
+	})
+	if err != nil {
+		log.Warnf("config: failed to render %s script\n", name)
+		log.Warnln(err)
+	}
+}
+
+// apiConfigHandler describes the upload api for clients without a dedicated
+// export.
+func apiConfigHandler(w http.ResponseWriter, r *http.Request) {
+	writeClientConfig(w, "application/json", "echo-vault.json")
+
+	encoder := json.NewEncoder(w)
+
+	encoder.SetIndent("", "  ")
+
+	encoder.Encode(map[string]any{
+		"name":    "echo-vault",
+		"version": Version,
+		"url":     config.Server.URL,
+		"headers": map[string]string{
+			"Authorization": "Bearer " + callerToken(r),
+		},
+		"upload": map[string]any{
+			"method": "POST",
+			"url":    config.Server.URL + "upload",
+			"body":   "multipart/form-data",
+			"field":  "upload",
+		},
+		"raw_upload": map[string]any{
+			"method": "PUT",
+			"url":    config.Server.URL + "upload/{filename}",
+			"body":   "file",
+		},
+		"url_upload": map[string]any{
+			"method":  "POST",
+			"url":     config.Server.URL + "upload/url",
+			"body":    "application/json",
+			"enabled": fetcher != nil,
+		},
+		"shorten": map[string]any{
+			"method":  "POST",
+			"url":     config.Server.URL + "shorten",
+			"body":    "application/json",
+			"enabled": config.Shortener.Enabled,
+		},
+		"query": []string{"visibility", "slug", "expires", "burn", "language", "async"},
+		"response": map[string]string{
+			"url":          "echo.url",
+			"deletion_url": "deletion_url",
+			"error":        "error",
+		},
+		"limits": map[string]any{
+			"max_file_size":   config.MaxFileSizeBytes(),
+			"max_batch_files": config.Server.MaxBatchFiles,
+		},
+		"vanity": config.IDs.Vanity,
+	})
+}
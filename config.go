@@ -3,9 +3,15 @@ package main
 import (
 	"errors"
 	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
 	"os"
 	"os/exec"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/goccy/go-yaml"
 )
@@ -17,7 +23,62 @@ type EchoConfigServer struct {
 	UploadToken    string `yaml:"token"`
 	MaxFileSize    int    `yaml:"max_file_size"`
 	MaxConcurrency int    `yaml:"max_concurrency"`
+	MaxBatchFiles  int    `yaml:"max_batch_files"`
+	QueueDepth     int    `yaml:"queue_depth"`
+	QueueWait      int    `yaml:"queue_wait"`
+	Async          bool   `yaml:"async"`
 	DeleteOrphans  bool   `yaml:"delete_orphans"`
+	SessionHours   int    `yaml:"session_hours"`
+	SigningKey     string `yaml:"signing_key"`
+	Duplicates     string `yaml:"duplicates"`
+
+	MaxResumableSize int `yaml:"max_resumable_size"`
+	ResumableHours   int `yaml:"resumable_hours"`
+}
+
+type EchoConfigIDs struct {
+	Length   int    `yaml:"length"`
+	Alphabet string `yaml:"alphabet"`
+	Words    int    `yaml:"words"`
+	Vanity   bool   `yaml:"vanity"`
+}
+
+type EchoConfigLimits struct {
+	Enabled                bool     `yaml:"enabled"`
+	RequestsPerMinute      int      `yaml:"requests_per_minute"`
+	Burst                  int      `yaml:"burst"`
+	TokenRequestsPerMinute int      `yaml:"token_requests_per_minute"`
+	TokenBurst             int      `yaml:"token_burst"`
+	MaxFailures            int      `yaml:"max_failures"`
+	LockoutMinutes         int      `yaml:"lockout_minutes"`
+	TrustedProxies         []string `yaml:"trusted_proxies"`
+}
+
+type EchoConfigQuotas struct {
+	UserStorage  int  `yaml:"user_storage"`
+	UserFiles    int  `yaml:"user_files"`
+	MaxStorage   int  `yaml:"max_storage"`
+	MinFreeSpace int  `yaml:"min_free_space"`
+	Evict        bool `yaml:"evict"`
+}
+
+type EchoConfigOIDC struct {
+	Enabled       bool     `yaml:"enabled"`
+	Issuer        string   `yaml:"issuer"`
+	ClientID      string   `yaml:"client_id"`
+	ClientSecret  string   `yaml:"client_secret"`
+	Scopes        []string `yaml:"scopes"`
+	GroupsClaim   string   `yaml:"groups_claim"`
+	AllowedGroups []string `yaml:"allowed_groups"`
+	AdminGroups   []string `yaml:"admin_groups"`
+}
+
+type EchoConfigRemote struct {
+	Enabled         bool     `yaml:"enabled"`
+	MaxFileSize     int      `yaml:"max_file_size"`
+	Timeout         int      `yaml:"timeout"`
+	MaxRedirects    int      `yaml:"max_redirects"`
+	AllowedNetworks []string `yaml:"allowed_networks"`
 }
 
 type EchoConfigBackup struct {
@@ -42,14 +103,54 @@ type EchoConfigGIFs struct {
 	Format  string `yaml:"format"`
 }
 
+type EchoConfigTexts struct {
+	Enabled bool `yaml:"enabled"`
+	MaxSize int  `yaml:"max_size"`
+}
+
+type EchoConfigFiles struct {
+	Extensions []string `yaml:"extensions"`
+}
+
+type EchoConfigShortener struct {
+	Enabled   bool `yaml:"enabled"`
+	Permanent bool `yaml:"permanent"`
+}
+
+type EchoConfigWebhook struct {
+	URL    string   `yaml:"url"`
+	Secret string   `yaml:"secret"`
+	Events []string `yaml:"events"`
+}
+
+type EchoConfigWebhooks struct {
+	Endpoints   []EchoConfigWebhook `yaml:"endpoints"`
+	Timeout     int                 `yaml:"timeout"`
+	MaxAttempts int                 `yaml:"max_attempts"`
+	LogDays     int                 `yaml:"log_days"`
+}
+
 type EchoConfig struct {
-	ffmpeg string
+	ffmpeg  string
+	proxies []*net.IPNet
+	files   map[string]bool
+	remotes []netip.Prefix
 
 	Server EchoConfigServer `yaml:"server"`
+	IDs    EchoConfigIDs    `yaml:"ids"`
+	Limits EchoConfigLimits `yaml:"limits"`
+	Quotas EchoConfigQuotas `yaml:"quotas"`
+	OIDC   EchoConfigOIDC   `yaml:"oidc"`
+	Remote EchoConfigRemote `yaml:"remote"`
 	Backup EchoConfigBackup `yaml:"backup"`
 	Images EchoConfigImages `yaml:"images"`
 	Videos EchoConfigVideos `yaml:"videos"`
 	GIFs   EchoConfigGIFs   `yaml:"gifs"`
+	Texts  EchoConfigTexts  `yaml:"texts"`
+	Files  EchoConfigFiles  `yaml:"files"`
+
+	Shortener EchoConfigShortener `yaml:"shortener"`
+	Webhooks  EchoConfigWebhooks  `yaml:"webhooks"`
 }
 
 func NewDefaultConfig() EchoConfig {
@@ -61,7 +162,50 @@ func NewDefaultConfig() EchoConfig {
 			UploadToken:    "p4$$w0rd",
 			MaxFileSize:    20,
 			MaxConcurrency: 4,
+			MaxBatchFiles:  50,
+			QueueDepth:     64,
+			QueueWait:      60,
+			Async:          false,
 			DeleteOrphans:  false,
+			SessionHours:   7 * 24,
+			Duplicates:     DuplicateExisting,
+
+			MaxResumableSize: 1024,
+			ResumableHours:   24,
+		},
+		IDs: EchoConfigIDs{
+			Length:   10,
+			Alphabet: "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ",
+			Words:    0,
+			Vanity:   false,
+		},
+		Limits: EchoConfigLimits{
+			Enabled:                true,
+			RequestsPerMinute:      600,
+			Burst:                  300,
+			TokenRequestsPerMinute: 1200,
+			TokenBurst:             300,
+			MaxFailures:            10,
+			LockoutMinutes:         15,
+			TrustedProxies:         []string{"127.0.0.1/32", "::1/128"},
+		},
+		Quotas: EchoConfigQuotas{
+			UserStorage:  0,
+			UserFiles:    0,
+			MaxStorage:   0,
+			MinFreeSpace: 256,
+			Evict:        false,
+		},
+		OIDC: EchoConfigOIDC{
+			Enabled:     false,
+			Scopes:      []string{"openid", "profile", "email"},
+			GroupsClaim: "groups",
+		},
+		Remote: EchoConfigRemote{
+			Enabled:      true,
+			MaxFileSize:  20,
+			Timeout:      30,
+			MaxRedirects: 5,
 		},
 		Backup: EchoConfigBackup{
 			Enabled:     true,
@@ -81,6 +225,23 @@ func NewDefaultConfig() EchoConfig {
 			Enabled: true,
 			Format:  "webp",
 		},
+		Texts: EchoConfigTexts{
+			Enabled: true,
+			MaxSize: 1024,
+		},
+		Files: EchoConfigFiles{
+			Extensions: []string{},
+		},
+		Shortener: EchoConfigShortener{
+			Enabled:   true,
+			Permanent: false,
+		},
+		Webhooks: EchoConfigWebhooks{
+			Endpoints:   []EchoConfigWebhook{},
+			Timeout:     10,
+			MaxAttempts: 10,
+			LogDays:     7,
+		},
 	}
 }
 
@@ -121,10 +282,6 @@ func (c *EchoConfig) Validate() error {
 		return fmt.Errorf("server.port must be 1-65535, got %d", c.Server.Port)
 	}
 
-	if c.Server.UploadToken == "" {
-		return fmt.Errorf("server.token is empty")
-	}
-
 	if c.Server.MaxFileSize < 1 {
 		return fmt.Errorf("server.max_file_size must be >= 1, got %d", c.Server.MaxFileSize)
 	}
@@ -133,6 +290,181 @@ func (c *EchoConfig) Validate() error {
 		return fmt.Errorf("server.max_concurrency must be >= 1, got %d", c.Server.MaxConcurrency)
 	}
 
+	if c.Server.QueueDepth < 0 {
+		return fmt.Errorf("server.queue_depth must be >= 0, got %d", c.Server.QueueDepth)
+	}
+
+	if c.Server.QueueWait < 1 {
+		return fmt.Errorf("server.queue_wait must be >= 1, got %d", c.Server.QueueWait)
+	}
+
+	if c.Server.MaxBatchFiles < 1 {
+		return fmt.Errorf("server.max_batch_files must be >= 1, got %d", c.Server.MaxBatchFiles)
+	}
+
+	if c.Server.SigningKey == "" {
+		key, err := generateSigningKey()
+		if err != nil {
+			return err
+		}
+
+		c.Server.SigningKey = key
+	}
+
+	if c.Server.SessionHours < 1 {
+		return fmt.Errorf("server.session_hours must be >= 1, got %d", c.Server.SessionHours)
+	}
+
+	switch c.Server.Duplicates {
+	case DuplicateExisting, DuplicateReject, DuplicateCreate:
+	default:
+		return fmt.Errorf("server.duplicates must be one of (existing, reject, create), got %q", c.Server.Duplicates)
+	}
+
+	if c.Server.MaxResumableSize < 1 {
+		return fmt.Errorf("server.max_resumable_size must be >= 1, got %d", c.Server.MaxResumableSize)
+	}
+
+	if c.Server.ResumableHours < 1 {
+		return fmt.Errorf("server.resumable_hours must be >= 1, got %d", c.Server.ResumableHours)
+	}
+
+	// ids
+	if c.IDs.Length < 4 || c.IDs.Length > 64 {
+		return fmt.Errorf("ids.length must be 4-64, got %d", c.IDs.Length)
+	}
+
+	if len(c.IDs.Alphabet) < 2 || !validateHash(c.IDs.Alphabet) {
+		return fmt.Errorf("ids.alphabet must have at least 2 characters out of 0-9, A-Z, a-z, _ and -, got %q", c.IDs.Alphabet)
+	}
+
+	// one or two words only make about 20000 ids, far too few to pick from
+	if c.IDs.Words != 0 && (c.IDs.Words < 3 || c.IDs.Words > 6) {
+		return fmt.Errorf("ids.words must be 0 or 3-6, got %d", c.IDs.Words)
+	}
+
+	// limits
+	if c.Limits.Enabled {
+		if c.Limits.RequestsPerMinute < 1 {
+			return fmt.Errorf("limits.requests_per_minute must be >= 1, got %d", c.Limits.RequestsPerMinute)
+		}
+
+		if c.Limits.Burst < 1 {
+			return fmt.Errorf("limits.burst must be >= 1, got %d", c.Limits.Burst)
+		}
+
+		if c.Limits.TokenRequestsPerMinute < 1 {
+			return fmt.Errorf("limits.token_requests_per_minute must be >= 1, got %d", c.Limits.TokenRequestsPerMinute)
+		}
+
+		if c.Limits.TokenBurst < 1 {
+			return fmt.Errorf("limits.token_burst must be >= 1, got %d", c.Limits.TokenBurst)
+		}
+
+		if c.Limits.MaxFailures < 1 {
+			return fmt.Errorf("limits.max_failures must be >= 1, got %d", c.Limits.MaxFailures)
+		}
+
+		if c.Limits.LockoutMinutes < 1 {
+			return fmt.Errorf("limits.lockout_minutes must be >= 1, got %d", c.Limits.LockoutMinutes)
+		}
+	}
+
+	c.proxies = c.proxies[:0]
+
+	for _, raw := range c.Limits.TrustedProxies {
+		if !strings.Contains(raw, "/") {
+			if strings.Contains(raw, ":") {
+				raw += "/128"
+			} else {
+				raw += "/32"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(raw)
+		if err != nil {
+			return fmt.Errorf("limits.trusted_proxies contains invalid entry %q", raw)
+		}
+
+		c.proxies = append(c.proxies, network)
+	}
+
+	// quotas
+	if c.Quotas.UserStorage < 0 {
+		return fmt.Errorf("quotas.user_storage must be >= 0, got %d", c.Quotas.UserStorage)
+	}
+
+	if c.Quotas.UserFiles < 0 {
+		return fmt.Errorf("quotas.user_files must be >= 0, got %d", c.Quotas.UserFiles)
+	}
+
+	if c.Quotas.MaxStorage < 0 {
+		return fmt.Errorf("quotas.max_storage must be >= 0, got %d", c.Quotas.MaxStorage)
+	}
+
+	if c.Quotas.MinFreeSpace < 0 {
+		return fmt.Errorf("quotas.min_free_space must be >= 0, got %d", c.Quotas.MinFreeSpace)
+	}
+
+	// oidc
+	if c.OIDC.Enabled {
+		if c.OIDC.Issuer == "" {
+			return fmt.Errorf("oidc.issuer is empty")
+		}
+
+		if c.OIDC.ClientID == "" {
+			return fmt.Errorf("oidc.client_id is empty")
+		}
+
+		if c.OIDC.GroupsClaim == "" {
+			return fmt.Errorf("oidc.groups_claim is empty")
+		}
+
+		if !slices.Contains(c.OIDC.Scopes, "openid") {
+			c.OIDC.Scopes = append([]string{"openid"}, c.OIDC.Scopes...)
+		}
+	}
+
+	// remote
+	if c.Remote.Enabled {
+		if c.Remote.MaxFileSize < 1 {
+			return fmt.Errorf("remote.max_file_size must be >= 1, got %d", c.Remote.MaxFileSize)
+		}
+
+		if c.Remote.Timeout < 1 {
+			return fmt.Errorf("remote.timeout must be >= 1, got %d", c.Remote.Timeout)
+		}
+
+		if c.Remote.MaxRedirects < 0 {
+			return fmt.Errorf("remote.max_redirects must be >= 0, got %d", c.Remote.MaxRedirects)
+		}
+	}
+
+	c.remotes = c.remotes[:0]
+
+	for _, raw := range c.Remote.AllowedNetworks {
+		var (
+			prefix netip.Prefix
+			err    error
+		)
+
+		if strings.Contains(raw, "/") {
+			prefix, err = netip.ParsePrefix(raw)
+		} else {
+			var addr netip.Addr
+
+			addr, err = netip.ParseAddr(raw)
+
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+
+		if err != nil {
+			return fmt.Errorf("remote.allowed_networks contains invalid entry %q", raw)
+		}
+
+		c.remotes = append(c.remotes, prefix.Masked())
+	}
+
 	// backup
 	if c.Backup.Enabled {
 		if c.Backup.Interval <= 0 {
@@ -162,6 +494,73 @@ func (c *EchoConfig) Validate() error {
 		return fmt.Errorf("gifs.format must be one of (gif, webp), got %q", c.GIFs.Format)
 	}
 
+	// texts
+	if c.Texts.MaxSize < 1 {
+		return fmt.Errorf("texts.max_size must be >= 1, got %d", c.Texts.MaxSize)
+	}
+
+	// files
+	c.files = make(map[string]bool)
+
+	for i, raw := range c.Files.Extensions {
+		ext := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(raw), "."))
+
+		if !validFileExtension(ext) {
+			return fmt.Errorf("files.extensions contains invalid entry %q", raw)
+		}
+
+		if ext == "jpg" || ext == "txt" || ext == LinkExtension || c.IsValidImageFormat(ext) || c.IsValidVideoFormat(ext, false) {
+			return fmt.Errorf("files.extensions can't contain media, text or link types, got %q", raw)
+		}
+
+		c.Files.Extensions[i] = ext
+		c.files[ext] = true
+	}
+
+	// webhooks
+	if c.Webhooks.Timeout < 1 {
+		return fmt.Errorf("webhooks.timeout must be >= 1, got %d", c.Webhooks.Timeout)
+	}
+
+	if c.Webhooks.MaxAttempts < 1 {
+		return fmt.Errorf("webhooks.max_attempts must be >= 1, got %d", c.Webhooks.MaxAttempts)
+	}
+
+	if c.Webhooks.LogDays < 1 {
+		return fmt.Errorf("webhooks.log_days must be >= 1, got %d", c.Webhooks.LogDays)
+	}
+
+	seen := make(map[string]bool)
+
+	for i := range c.Webhooks.Endpoints {
+		endpoint := &c.Webhooks.Endpoints[i]
+
+		target, err := url.Parse(endpoint.URL)
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			return fmt.Errorf("webhooks.endpoints[%d].url is not a valid http(s) url, got %q", i, endpoint.URL)
+		}
+
+		if seen[endpoint.URL] {
+			return fmt.Errorf("webhooks.endpoints contains %q twice", endpoint.URL)
+		}
+
+		seen[endpoint.URL] = true
+
+		if len(endpoint.Secret) < 16 {
+			return fmt.Errorf("webhooks.endpoints[%d].secret must be at least 16 characters", i)
+		}
+
+		for j, event := range endpoint.Events {
+			event = strings.ToLower(strings.TrimSpace(event))
+
+			if !slices.Contains(webhookEvents, event) {
+				return fmt.Errorf("webhooks.endpoints[%d].events must only contain (create, update, delete), got %q", i, endpoint.Events[j])
+			}
+
+			endpoint.Events[j] = event
+		}
+	}
+
 	// check ffmpeg dependency
 	if c.Videos.Enabled || (c.GIFs.Enabled && c.GIFs.Format == "gif") {
 		ffmpeg, err := exec.LookPath("ffmpeg")
@@ -179,6 +578,126 @@ func (c *EchoConfig) MaxFileSizeBytes() int64 {
 	return int64(c.Server.MaxFileSize * 1024 * 1024)
 }
 
+// MaxBatchSizeBytes is the largest request body a batch upload may have.
+func (c *EchoConfig) MaxBatchSizeBytes() int64 {
+	return c.MaxFileSizeBytes() * int64(c.Server.MaxBatchFiles)
+}
+
+func (c *EchoConfig) MaxTextSizeBytes() int64 {
+	return int64(c.Texts.MaxSize * 1024)
+}
+
+// RedirectStatus is the status short links redirect with.
+func (c *EchoConfig) RedirectStatus() int {
+	if c.Shortener.Permanent {
+		return http.StatusMovedPermanently
+	}
+
+	return http.StatusFound
+}
+
+// IsAllowedFile reports whether ext may be uploaded as a generic file.
+func (c *EchoConfig) IsAllowedFile(ext string) bool {
+	return c.files[ext]
+}
+
+func (c *EchoConfig) WebhookTimeout() time.Duration {
+	return time.Duration(c.Webhooks.Timeout) * time.Second
+}
+
+func (c *EchoConfig) QueueWait() time.Duration {
+	return time.Duration(c.Server.QueueWait) * time.Second
+}
+
+func (c *EchoConfig) MaxResumableSizeBytes() int64 {
+	return int64(c.Server.MaxResumableSize) * 1024 * 1024
+}
+
+func (c *EchoConfig) ResumableDuration() time.Duration {
+	return time.Duration(c.Server.ResumableHours) * time.Hour
+}
+
+func (c *EchoConfig) LockoutDuration() time.Duration {
+	return time.Duration(c.Limits.LockoutMinutes) * time.Minute
+}
+
+func (c *EchoConfig) IsTrustedProxy(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range c.proxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *EchoConfig) MaxStorageBytes() int64 {
+	return int64(c.Quotas.MaxStorage) * 1024 * 1024
+}
+
+func (c *EchoConfig) MinFreeSpaceBytes() int64 {
+	return int64(c.Quotas.MinFreeSpace) * 1024 * 1024
+}
+
+func (c *EchoConfig) MaxRemoteSizeBytes() int64 {
+	return int64(c.Remote.MaxFileSize) * 1024 * 1024
+}
+
+func (c *EchoConfig) RemoteTimeout() time.Duration {
+	return time.Duration(c.Remote.Timeout) * time.Second
+}
+
+// IsAllowedRemote reports whether remote uploads may connect to addr.
+// Internal ranges are only reachable if listed in allowed_networks.
+func (c *EchoConfig) IsAllowedRemote(addr netip.Addr) bool {
+	addr = addr.Unmap()
+
+	for _, prefix := range c.remotes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return !isBlockedAddr(addr)
+}
+
+func (c *EchoConfig) SessionDuration() time.Duration {
+	return time.Duration(c.Server.SessionHours) * time.Hour
+}
+
+func (c *EchoConfig) IsSecure() bool {
+	return strings.HasPrefix(c.Server.URL, "https://")
+}
+
+// IsAllowed reports whether a member of groups may log in via oidc. Admin
+// groups are always allowed.
+func (o *EchoConfigOIDC) IsAllowed(groups []string) bool {
+	if len(o.AllowedGroups) == 0 {
+		return true
+	}
+
+	return o.IsAdmin(groups) || containsAny(o.AllowedGroups, groups)
+}
+
+func (o *EchoConfigOIDC) IsAdmin(groups []string) bool {
+	return containsAny(o.AdminGroups, groups)
+}
+
+func containsAny(list, values []string) bool {
+	for _, value := range values {
+		if slices.Contains(list, value) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (c *EchoConfig) Addr() string {
 	return fmt.Sprintf(":%d", c.Server.Port)
 }
@@ -190,15 +709,60 @@ func (e *EchoConfig) Store() error {
 		"$.server.url":             {yaml.HeadComment(fmt.Sprintf(" base url of your instance (default: %v)", def.Server.URL))},
 		"$.server.port":            {yaml.HeadComment(fmt.Sprintf(" port to run echo-vault on (default: %v)", def.Server.Port))},
 		"$.server.direct":          {yaml.HeadComment(fmt.Sprintf(" only append the filename to the base url, no \"/i/\" (for custom endpoints; default: %v)", def.Server.Direct))},
-		"$.server.token":           {yaml.HeadComment(fmt.Sprintf(" upload token for authentication, leave empty to disable auth (default: %v)", def.Server.UploadToken))},
+		"$.server.token":           {yaml.HeadComment(fmt.Sprintf(" master token with full admin access, leave empty to only allow database tokens (default: %v)", def.Server.UploadToken))},
 		"$.server.max_file_size":   {yaml.HeadComment(fmt.Sprintf(" maximum upload file-size in MB (default: %vMB)", def.Server.MaxFileSize))},
-		"$.server.max_concurrency": {yaml.HeadComment(fmt.Sprintf(" maximum concurrent uploads (default: %v)", def.Server.MaxConcurrency))},
+		"$.server.max_concurrency": {yaml.HeadComment(fmt.Sprintf(" maximum uploads processed at the same time, more wait in the upload queue (default: %v)", def.Server.MaxConcurrency))},
+		"$.server.queue_depth":     {yaml.HeadComment(fmt.Sprintf(" how many uploads may wait for a free slot before new ones get a 503 (default: %v)", def.Server.QueueDepth))},
+		"$.server.queue_wait":      {yaml.HeadComment(fmt.Sprintf(" how long an upload may wait for a free slot (in seconds; default: %v)", def.Server.QueueWait))},
+		"$.server.async":           {yaml.HeadComment(fmt.Sprintf(" process uploads in the background and answer with 202 right away, overridable per request with ?async= (default: %v)", def.Server.Async))},
+		"$.server.max_batch_files": {yaml.HeadComment(fmt.Sprintf(" maximum number of files in a single upload request (default: %v)", def.Server.MaxBatchFiles))},
 		"$.server.delete_orphans":  {yaml.HeadComment(fmt.Sprintf(" if echos without their file should be deleted (default: %v)", def.Server.DeleteOrphans))},
+		"$.server.session_hours":   {yaml.HeadComment(fmt.Sprintf(" how long dashboard login sessions stay valid (in hours; default: %v)", def.Server.SessionHours))},
+		"$.server.signing_key":     {yaml.HeadComment(" secret used to sign share and deletion links, generated on first run (changing it invalidates all links)")},
+		"$.server.duplicates":      {yaml.HeadComment(fmt.Sprintf(" what to do when the same file is uploaded again (existing = return the existing echo, reject = respond with 409, create = always create a new echo; default: %v)", def.Server.Duplicates))},
+
+		"$.server.max_resumable_size": {yaml.HeadComment(fmt.Sprintf(" maximum size of resumable (tus) uploads in MB (default: %vMB)", def.Server.MaxResumableSize))},
+		"$.server.resumable_hours":    {yaml.HeadComment(fmt.Sprintf(" how long unfinished resumable uploads are kept after their last chunk (in hours; default: %v)", def.Server.ResumableHours))},
+
+		"$.ids.length":   {yaml.HeadComment(fmt.Sprintf(" length of generated echo ids (4-64; default: %v)", def.IDs.Length))},
+		"$.ids.alphabet": {yaml.HeadComment(fmt.Sprintf(" characters generated ids are made of (0-9, A-Z, a-z, _ and -; default: %v)", def.IDs.Alphabet))},
+		"$.ids.words":    {yaml.HeadComment(fmt.Sprintf(" build ids from this many random words instead (e.g. calm-amber-fox), 0 to disable (0 or 3-6; default: %v)", def.IDs.Words))},
+		"$.ids.vanity":   {yaml.HeadComment(fmt.Sprintf(" allow picking an id at upload time with ?slug= (default: %v)", def.IDs.Vanity))},
+
+		"$.limits.enabled":                   {yaml.HeadComment(fmt.Sprintf(" if rate limiting and brute-force protection should be enabled (default: %v)", def.Limits.Enabled))},
+		"$.limits.requests_per_minute":       {yaml.HeadComment(fmt.Sprintf(" sustained requests per minute per client ip (default: %v)", def.Limits.RequestsPerMinute))},
+		"$.limits.burst":                     {yaml.HeadComment(fmt.Sprintf(" short bursts allowed per client ip (default: %v)", def.Limits.Burst))},
+		"$.limits.token_requests_per_minute": {yaml.HeadComment(fmt.Sprintf(" sustained requests per minute per token (default: %v)", def.Limits.TokenRequestsPerMinute))},
+		"$.limits.token_burst":               {yaml.HeadComment(fmt.Sprintf(" short bursts allowed per token (default: %v)", def.Limits.TokenBurst))},
+		"$.limits.max_failures":              {yaml.HeadComment(fmt.Sprintf(" failed logins before a client ip is locked out (default: %v)", def.Limits.MaxFailures))},
+		"$.limits.lockout_minutes":           {yaml.HeadComment(fmt.Sprintf(" how long a client ip stays locked out (in minutes; default: %v)", def.Limits.LockoutMinutes))},
+		"$.limits.trusted_proxies":           {yaml.HeadComment(" reverse proxies (ips or cidrs) whose X-Forwarded-For header is trusted (default: 127.0.0.1/32, ::1/128)")},
+
+		"$.quotas.user_storage":   {yaml.HeadComment(fmt.Sprintf(" storage each user may use in MB, tokens without a user share one pool, 0 = unlimited (default: %v)", def.Quotas.UserStorage))},
+		"$.quotas.user_files":     {yaml.HeadComment(fmt.Sprintf(" number of echos each user may have, 0 = unlimited (default: %v)", def.Quotas.UserFiles))},
+		"$.quotas.max_storage":    {yaml.HeadComment(fmt.Sprintf(" storage all echos together may use in MB, 0 = unlimited (default: %v)", def.Quotas.MaxStorage))},
+		"$.quotas.min_free_space": {yaml.HeadComment(fmt.Sprintf(" free disk space in MB below which uploads are refused, 0 = disabled (default: %vMB)", def.Quotas.MinFreeSpace))},
+		"$.quotas.evict":          {yaml.HeadComment(fmt.Sprintf(" delete the oldest non-favorited echos instead of refusing uploads when max_storage or min_free_space is hit (default: %v)", def.Quotas.Evict))},
+
+		"$.oidc.enabled":        {yaml.HeadComment(fmt.Sprintf(" if dashboard login via openid connect should be enabled (default: %v)", def.OIDC.Enabled))},
+		"$.oidc.issuer":         {yaml.HeadComment(" issuer url of your identity provider (e.g. https://auth.example.com/realms/main)")},
+		"$.oidc.client_id":      {yaml.HeadComment(" client id registered with the identity provider (redirect uri: <server.url>login/oidc/callback)")},
+		"$.oidc.client_secret":  {yaml.HeadComment(" client secret, leave empty for public clients (pkce is always used)")},
+		"$.oidc.scopes":         {yaml.HeadComment(" scopes to request, some providers need an extra scope (e.g. groups) to include group claims (default: openid, profile, email)")},
+		"$.oidc.groups_claim":   {yaml.HeadComment(fmt.Sprintf(" id token claim holding the user's groups (default: %v)", def.OIDC.GroupsClaim))},
+		"$.oidc.allowed_groups": {yaml.HeadComment(" only members of these groups may log in, leave empty to allow everyone (default: empty)")},
+		"$.oidc.admin_groups":   {yaml.HeadComment(" members of these groups become admins, leave empty to manage admins manually (default: empty)")},
+
+		"$.remote.enabled":          {yaml.HeadComment(fmt.Sprintf(" if uploads from urls (POST /upload/url) should be enabled (default: %v)", def.Remote.Enabled))},
+		"$.remote.max_file_size":    {yaml.HeadComment(fmt.Sprintf(" maximum size of downloaded files in MB (default: %vMB)", def.Remote.MaxFileSize))},
+		"$.remote.timeout":          {yaml.HeadComment(fmt.Sprintf(" maximum time a download may take (in seconds; default: %v)", def.Remote.Timeout))},
+		"$.remote.max_redirects":    {yaml.HeadComment(fmt.Sprintf(" how many redirects are followed (default: %v)", def.Remote.MaxRedirects))},
+		"$.remote.allowed_networks": {yaml.HeadComment(" private/loopback ips or cidrs that may still be downloaded from, everything internal is blocked otherwise (default: empty)")},
 
 		"$.backup.enabled":      {yaml.HeadComment(fmt.Sprintf(" if backups should be created (default: %v)", def.Backup.Enabled))},
 		"$.backup.interval":     {yaml.HeadComment(fmt.Sprintf(" how often backups should be created (in hours; default: %v)", def.Backup.Interval))},
 		"$.backup.keep_amount":  {yaml.HeadComment(fmt.Sprintf(" how many backups to keep before deleting the oldest (default: %v)", def.Backup.KeepAmount))},
-		"$.backup.backup_files": {yaml.HeadComment(fmt.Sprintf(" if files (images/videos) should be included in backups (without, only the database is backed up; default: %v)", def.Backup.BackupFiles))},
+		"$.backup.backup_files": {yaml.HeadComment(fmt.Sprintf(" if stored files (images, videos, pastes and other files) should be included in backups (without, only the database is backed up; default: %v)", def.Backup.BackupFiles))},
 
 		"$.images.format":  {yaml.HeadComment(fmt.Sprintf(" target format for images (webp, png or jpeg; default: %v)", def.Images.Format))},
 		"$.images.effort":  {yaml.HeadComment(fmt.Sprintf(" quality/speed trade-off (1 = fast/big, 2 = medium, 3 = slow/small; default: %v)", def.Images.Effort))},
@@ -208,6 +772,19 @@ func (e *EchoConfig) Store() error {
 
 		"$.gifs.enabled": {yaml.HeadComment(fmt.Sprintf(" allow gif uploads (requires ffmpeg when using gif as target; default: %v)", def.GIFs.Enabled))},
 		"$.gifs.format":  {yaml.HeadComment(fmt.Sprintf(" target format for gifs (gif or webp; default: %v)", def.GIFs.Format))},
+
+		"$.texts.enabled":  {yaml.HeadComment(fmt.Sprintf(" allow text and code pastes (default: %v)", def.Texts.Enabled))},
+		"$.texts.max_size": {yaml.HeadComment(fmt.Sprintf(" max size of a text paste (in KB; default: %v)", def.Texts.MaxSize))},
+
+		"$.files.extensions": {yaml.HeadComment(" extensions of other files that are stored untouched and served as downloads (e.g. zip, pdf, log; default: none)")},
+
+		"$.shortener.enabled":   {yaml.HeadComment(fmt.Sprintf(" allow shortening urls into redirect echos (default: %v)", def.Shortener.Enabled))},
+		"$.shortener.permanent": {yaml.HeadComment(fmt.Sprintf(" redirect with 301 instead of 302 (browsers cache these, so repeat clicks are not counted; default: %v)", def.Shortener.Permanent))},
+
+		"$.webhooks.endpoints":    {yaml.HeadComment(" urls that receive create, update and delete events as signed json posts, each with a url, a secret (min. 16 characters) and optionally the events it wants (default: none)")},
+		"$.webhooks.timeout":      {yaml.HeadComment(fmt.Sprintf(" maximum time a single delivery may take (in seconds; default: %v)", def.Webhooks.Timeout))},
+		"$.webhooks.max_attempts": {yaml.HeadComment(fmt.Sprintf(" how often a delivery is tried before it is given up, retries back off exponentially (default: %v)", def.Webhooks.MaxAttempts))},
+		"$.webhooks.log_days":     {yaml.HeadComment(fmt.Sprintf(" how long finished deliveries are kept in the delivery log (in days; default: %v)", def.Webhooks.LogDays))},
 	}
 
 	file, err := OpenFileForWriting("config.yml")
@@ -20,10 +20,22 @@ const (
 	VerifyChunkSize = 1024
 )
 
+const echoColumns = "id, hash, name, extension, animated, size, upload_size, timestamp, favorited, owner, visibility, password, source, checksum, expires, burn, deletion, language, target, clicks"
+
 type EchoDatabase struct {
 	*sql.DB
 }
 
+type EchoFilter struct {
+	Owner         int64
+	AnyOwner      bool
+	FavoritesOnly bool
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
 func ConnectToDatabase() (*EchoDatabase, error) {
 	dsn := fmt.Sprintf("%s?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)", DatabasePath)
 
@@ -55,9 +67,122 @@ func ConnectToDatabase() (*EchoDatabase, error) {
 	table.Column("upload_size", "INTEGER").NotNull().Default("0")
 	table.Column("timestamp", "INTEGER").NotNull().Default("0")
 	table.Column("favorited", "INTEGER").NotNull().Default("0")
+	table.Column("owner", "INTEGER").NotNull().Default("0")
+	table.Column("visibility", "INTEGER").NotNull().Default("0")
+	table.Column("password", "TEXT").NotNull().Default("''")
+	table.Column("source", "TEXT").NotNull().Default("''")
+	table.Column("checksum", "TEXT").NotNull().Default("''")
+	table.Column("expires", "INTEGER").NotNull().Default("0")
+	table.Column("burn", "INTEGER").NotNull().Default("0")
+	table.Column("deletion", "TEXT").NotNull().Default("''")
+	table.Column("language", "TEXT").NotNull().Default("''")
+	table.Column("target", "TEXT").NotNull().Default("''")
+	table.Column("clicks", "INTEGER").NotNull().Default("0")
+	table.Column("pending", "TEXT").NotNull().Default("''")
 
 	table.Index("idx_echos_timestamp", "timestamp")
 	table.Index("idx_echos_favorited", "favorited")
+	table.Index("idx_echos_owner", "owner")
+	table.Index("idx_echos_checksum", "checksum")
+	table.Index("idx_echos_expires", "expires")
+
+	users := schema.Table("users")
+
+	users.Primary("id", "INTEGER")
+
+	users.Column("name", "TEXT").NotNull().Unique()
+	users.Column("admin", "INTEGER").NotNull().Default("0")
+	users.Column("subject", "TEXT").NotNull().Default("''")
+	users.Column("created", "INTEGER").NotNull().Default("0")
+	users.Column("quota_storage", "INTEGER").NotNull().Default("0")
+	users.Column("quota_files", "INTEGER").NotNull().Default("0")
+
+	users.Index("idx_users_subject", "subject")
+
+	tokens := schema.Table("tokens")
+
+	tokens.Primary("id", "INTEGER")
+
+	tokens.Column("name", "TEXT").NotNull()
+	tokens.Column("user_id", "INTEGER").NotNull().Default("0")
+	tokens.Column("secret", "TEXT").NotNull().Unique()
+	tokens.Column("scopes", "INTEGER").NotNull().Default("0")
+	tokens.Column("created", "INTEGER").NotNull().Default("0")
+	tokens.Column("last_used", "INTEGER").NotNull().Default("0")
+	tokens.Column("revoked", "INTEGER").NotNull().Default("0")
+
+	tokens.Index("idx_tokens_name", "name")
+	tokens.Index("idx_tokens_user_id", "user_id")
+
+	sessions := schema.Table("sessions")
+
+	sessions.Primary("id", "INTEGER")
+
+	sessions.Column("secret", "TEXT").NotNull().Unique()
+	sessions.Column("token_id", "INTEGER").NotNull().Default("0")
+	sessions.Column("user_id", "INTEGER").NotNull().Default("0")
+	sessions.Column("scopes", "INTEGER").NotNull().Default("0")
+	sessions.Column("created", "INTEGER").NotNull().Default("0")
+	sessions.Column("expires", "INTEGER").NotNull().Default("0")
+	sessions.Column("master", "TEXT").NotNull().Default("''")
+
+	sessions.Index("idx_sessions_expires", "expires")
+
+	audit := schema.Table("audit")
+
+	audit.Primary("id", "INTEGER")
+
+	audit.Column("timestamp", "INTEGER").NotNull().Default("0")
+	audit.Column("action", "TEXT").NotNull()
+	audit.Column("actor", "TEXT").NotNull().Default("''")
+	audit.Column("token_id", "INTEGER").NotNull().Default("0")
+	audit.Column("user_id", "INTEGER").NotNull().Default("0")
+	audit.Column("ip", "TEXT").NotNull().Default("''")
+	audit.Column("user_agent", "TEXT").NotNull().Default("''")
+	audit.Column("hash", "TEXT").NotNull().Default("''")
+	audit.Column("detail", "TEXT").NotNull().Default("''")
+
+	audit.Index("idx_audit_timestamp", "timestamp")
+	audit.Index("idx_audit_action", "action")
+	audit.Index("idx_audit_hash", "hash")
+	audit.Index("idx_audit_user_id", "user_id")
+
+	uploads := schema.Table("uploads")
+
+	uploads.Primary("id", "TEXT")
+
+	uploads.Column("owner", "INTEGER").NotNull().Default("0")
+	uploads.Column("upload_id", "TEXT").NotNull().Default("''")
+	uploads.Column("name", "TEXT").NotNull().Default("''")
+	uploads.Column("extension", "TEXT").NotNull().Default("''")
+	uploads.Column("visibility", "INTEGER").NotNull().Default("0")
+	uploads.Column("password", "TEXT").NotNull().Default("''")
+	uploads.Column("metadata", "TEXT").NotNull().Default("''")
+	uploads.Column("length", "INTEGER").NotNull().Default("0")
+	uploads.Column("received", "INTEGER").NotNull().Default("0")
+	uploads.Column("hash", "TEXT").NotNull().Default("''")
+	uploads.Column("created", "INTEGER").NotNull().Default("0")
+	uploads.Column("expires", "INTEGER").NotNull().Default("0")
+
+	uploads.Index("idx_uploads_expires", "expires")
+
+	deliveries := schema.Table("deliveries")
+
+	deliveries.Primary("id", "INTEGER")
+
+	deliveries.Column("endpoint", "TEXT").NotNull()
+	deliveries.Column("event", "TEXT").NotNull()
+	deliveries.Column("payload", "TEXT").NotNull().Default("''")
+	deliveries.Column("state", "TEXT").NotNull().Default("''")
+	deliveries.Column("attempts", "INTEGER").NotNull().Default("0")
+	deliveries.Column("next_attempt", "INTEGER").NotNull().Default("0")
+	deliveries.Column("status", "INTEGER").NotNull().Default("0")
+	deliveries.Column("error", "TEXT").NotNull().Default("''")
+	deliveries.Column("created", "INTEGER").NotNull().Default("0")
+	deliveries.Column("updated", "INTEGER").NotNull().Default("0")
+
+	deliveries.Index("idx_deliveries_state", "state", "next_attempt")
+	deliveries.Index("idx_deliveries_updated", "updated")
 
 	err = schema.Apply()
 	if err != nil {
@@ -66,9 +191,80 @@ func ConnectToDatabase() (*EchoDatabase, error) {
 		return nil, err
 	}
 
+	// echos from before deletion links get a key of their own
+	_, err = db.Exec("UPDATE echos SET deletion = lower(hex(randomblob(16))) WHERE deletion = ''")
+	if err != nil {
+		db.Close()
+
+		return nil, err
+	}
+
+	// full-text index of text echos, trigrams allow substring matches
+	_, err = db.Exec("CREATE VIRTUAL TABLE IF NOT EXISTS texts USING fts5(hash UNINDEXED, content, tokenize='trigram')")
+	if err != nil {
+		db.Close()
+
+		return nil, err
+	}
+
+	// ids are compared ignoring case before inserting, see Create
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS idx_echos_hash_nocase ON echos (hash COLLATE NOCASE)")
+	if err != nil {
+		db.Close()
+
+		return nil, err
+	}
+
 	return &EchoDatabase{db}, nil
 }
 
+func (f EchoFilter) Apply(b *strings.Builder) []any {
+	var args []any
+
+	if !f.AnyOwner {
+		b.WriteString(" AND owner = ?")
+
+		args = append(args, f.Owner)
+	}
+
+	if f.FavoritesOnly {
+		b.WriteString(" AND favorited = 1")
+	}
+
+	return args
+}
+
+func scanEcho(row rowScanner) (*Echo, error) {
+	var e Echo
+
+	err := row.Scan(&e.ID, &e.Hash, &e.Name, &e.Extension, &e.Animated, &e.Size, &e.UploadSize, &e.Timestamp, &e.Favorited, &e.Owner, &e.Visibility, &e.Password, &e.Source, &e.Checksum, &e.Expires, &e.Burn, &e.Deletion, &e.Language, &e.Target, &e.Clicks)
+	if err != nil {
+		return nil, err
+	}
+
+	return &e, nil
+}
+
+func scanEchos(rows *sql.Rows) ([]Echo, error) {
+	var echos []Echo
+
+	for rows.Next() {
+		e, err := scanEcho(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		echos = append(echos, *e)
+	}
+
+	err := rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return echos, nil
+}
+
 func (d *EchoDatabase) Exists(hash string) (bool, error) {
 	var exists bool
 
@@ -81,9 +277,7 @@ func (d *EchoDatabase) Exists(hash string) (bool, error) {
 }
 
 func (d *EchoDatabase) Find(ctx context.Context, hash string) (*Echo, error) {
-	var e Echo
-
-	err := d.QueryRowContext(ctx, "SELECT id, hash, name, extension, animated, size, upload_size, timestamp, favorited FROM echos WHERE hash = ? LIMIT 1", hash).Scan(&e.ID, &e.Hash, &e.Name, &e.Extension, &e.Animated, &e.Size, &e.UploadSize, &e.Timestamp, &e.Favorited)
+	e, err := scanEcho(d.QueryRowContext(ctx, "SELECT "+echoColumns+" FROM echos WHERE hash = ? LIMIT 1", hash))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
@@ -91,49 +285,31 @@ func (d *EchoDatabase) Find(ctx context.Context, hash string) (*Echo, error) {
 		return nil, err
 	}
 
-	return &e, nil
+	return e, nil
 }
 
-func (d *EchoDatabase) FindAll(ctx context.Context, offset, limit int, favoritesOnly bool) ([]Echo, error) {
+func (d *EchoDatabase) FindAll(ctx context.Context, offset, limit int, filter EchoFilter) ([]Echo, error) {
 	var b strings.Builder
 
-	b.WriteString("SELECT id, hash, name, extension, animated, size, upload_size, timestamp, favorited FROM echos")
+	b.WriteString("SELECT " + echoColumns + " FROM echos WHERE 1 = 1")
 
-	if favoritesOnly {
-		b.WriteString(" WHERE favorited = 1")
-	}
+	args := filter.Apply(&b)
 
 	b.WriteString(" ORDER BY timestamp DESC LIMIT ? OFFSET ?")
 
-	rows, err := d.QueryContext(ctx, b.String(), limit, offset)
+	args = append(args, limit, offset)
+
+	rows, err := d.QueryContext(ctx, b.String(), args...)
 	if err != nil {
 		return nil, err
 	}
 
 	defer rows.Close()
 
-	var echos []Echo
-
-	for rows.Next() {
-		var e Echo
-
-		err := rows.Scan(&e.ID, &e.Hash, &e.Name, &e.Extension, &e.Animated, &e.Size, &e.UploadSize, &e.Timestamp, &e.Favorited)
-		if err != nil {
-			return nil, err
-		}
-
-		echos = append(echos, e)
-	}
-
-	err = rows.Err()
-	if err != nil {
-		return nil, err
-	}
-
-	return echos, nil
+	return scanEchos(rows)
 }
 
-func (d *EchoDatabase) FindByHashes(ctx context.Context, hashes []string, favoritesOnly bool) ([]Echo, error) {
+func (d *EchoDatabase) FindByHashes(ctx context.Context, hashes []string, filter EchoFilter) ([]Echo, error) {
 	if len(hashes) == 0 {
 		return nil, nil
 	}
@@ -143,14 +319,18 @@ func (d *EchoDatabase) FindByHashes(ctx context.Context, hashes []string, favori
 
 	var b strings.Builder
 
-	b.WriteString("SELECT id, hash, name, extension, animated, size, upload_size, timestamp, favorited FROM echos WHERE hash IN (")
+	b.WriteString("SELECT " + echoColumns + " FROM echos WHERE hash IN (")
 	b.WriteString(placeholders)
 	b.WriteString(")")
 
-	if favoritesOnly {
-		b.WriteString(" AND favorited = 1")
+	args := make([]any, 0, len(hashes)*2+2)
+
+	for _, hash := range hashes {
+		args = append(args, hash)
 	}
 
+	args = append(args, filter.Apply(&b)...)
+
 	b.WriteString(" ORDER BY CASE hash ")
 
 	for i := range hashes {
@@ -161,12 +341,6 @@ func (d *EchoDatabase) FindByHashes(ctx context.Context, hashes []string, favori
 
 	b.WriteString("END")
 
-	args := make([]any, 0, len(hashes)*2)
-
-	for _, hash := range hashes {
-		args = append(args, hash)
-	}
-
 	for _, hash := range hashes {
 		args = append(args, hash)
 	}
@@ -178,34 +352,58 @@ func (d *EchoDatabase) FindByHashes(ctx context.Context, hashes []string, favori
 
 	defer rows.Close()
 
-	var echos []Echo
+	return scanEchos(rows)
+}
 
-	for rows.Next() {
-		var e Echo
+// Create inserts echo. Generated ids are replaced until one is free, preset
+// ones (vanity slugs, scanned files) fail with errHashTaken instead.
+// Create inserts echo, generating an id unless it asks for one. Ids that only
+// differ by case count as taken, since they would share a storage file on
+// case-insensitive file systems (macOS, Windows).
+func (d *EchoDatabase) Create(ctx context.Context, echo *Echo) error {
+	generated := echo.Hash == ""
+
+	for attempt := 1; ; attempt++ {
+		echo.Fill()
 
-		err := rows.Scan(&e.ID, &e.Hash, &e.Name, &e.Extension, &e.Animated, &e.Size, &e.UploadSize, &e.Timestamp, &e.Favorited)
+		taken, err := d.HashTaken(ctx, echo.Hash)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		echos = append(echos, e)
-	}
+		if !taken {
+			err = d.insert(ctx, echo)
+			if !isUniqueViolation(err) {
+				return err
+			}
+		}
 
-	err = rows.Err()
-	if err != nil {
-		return nil, err
-	}
+		if !generated {
+			return errHashTaken
+		}
 
-	return echos, nil
+		if attempt >= HashAttempts {
+			return fmt.Errorf("no free id after %d attempts", attempt)
+		}
+
+		echo.Hash = ""
+	}
 }
 
-func (d *EchoDatabase) Create(ctx context.Context, echo *Echo) error {
-	err := echo.Fill(ctx)
+// HashTaken reports whether an echo uses hash, ignoring case.
+func (d *EchoDatabase) HashTaken(ctx context.Context, hash string) (bool, error) {
+	var exists bool
+
+	err := d.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM echos WHERE hash = ? COLLATE NOCASE)", hash).Scan(&exists)
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	_, err = d.Exec("INSERT INTO echos (hash, name, extension, animated, size, upload_size, timestamp) VALUES (?, ?, ?, ?, ?, ?, ?)", echo.Hash, echo.Name, echo.Extension, echo.Animated, echo.Size, echo.UploadSize, echo.Timestamp)
+	return exists, nil
+}
+
+func (d *EchoDatabase) insert(ctx context.Context, echo *Echo) error {
+	_, err := d.ExecContext(ctx, "INSERT INTO echos (hash, name, extension, animated, size, upload_size, timestamp, owner, visibility, password, source, checksum, expires, burn, deletion, language, target, pending) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", echo.Hash, echo.Name, echo.Extension, echo.Animated, echo.Size, echo.UploadSize, echo.Timestamp, echo.Owner, echo.Visibility, echo.Password, echo.Source, echo.Checksum, echo.Expires, echo.Burn, echo.Deletion, echo.Language, echo.Target, echo.Pending)
 	if err != nil {
 		return err
 	}
@@ -317,12 +515,19 @@ func (d *EchoDatabase) Verify() (uint64, uint64, error) {
 	invalid := make([]any, 0)
 
 	for {
-		echos, err = d.FindAll(context.Background(), offset, VerifyChunkSize, false)
+		echos, err = d.FindAll(context.Background(), offset, VerifyChunkSize, EchoFilter{AnyOwner: true})
 		if err != nil {
 			break
 		}
 
 		for _, echo := range echos {
+			// short links have no file to check, queued uploads no file yet
+			if echo.IsLink() || isAsyncPending(&echo) {
+				completed.Add(1)
+
+				continue
+			}
+
 			path := echo.Storage()
 
 			stat, err := os.Stat(path)
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+const (
+	DuplicateExisting = "existing"
+	DuplicateReject   = "reject"
+	DuplicateCreate   = "create"
+)
+
+// inflight holds uploads that are being stored, so identical uploads arriving
+// at the same time wait for the first one instead of racing it.
+var inflight sync.Map
+
+func hashFile(path string) (string, error) {
+	file, err := OpenFileForReading(path)
+	if err != nil {
+		return "", err
+	}
+
+	defer file.Close()
+
+	hasher := sha256.New()
+
+	_, err = io.Copy(hasher, file)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// claimChecksum waits until no other upload of the same owner and checksum is
+// being stored and returns a function to release the claim.
+func claimChecksum(ctx context.Context, echo *Echo) (func(), error) {
+	key := fmt.Sprintf("%d:%s", echo.Owner, echo.Checksum)
+
+	for {
+		done := make(chan struct{})
+
+		other, loaded := inflight.LoadOrStore(key, done)
+		if !loaded {
+			return func() {
+				inflight.Delete(key)
+
+				close(done)
+			}, nil
+		}
+
+		select {
+		case <-other.(chan struct{}):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// checkDuplicate looks for an echo of the same owner with identical upload
+// bytes. On success with a duplicate, echo is replaced by the existing one.
+// The returned function has to be called once the upload is stored. Uploads
+// asking for a specific id, deleting themselves or asking for any protection
+// are never deduplicated, and only public, unprotected echos are matched, so
+// a duplicate never changes who can see the file.
+func checkDuplicate(ctx context.Context, echo *Echo, path string) (bool, func(), error) {
+	if echo.Checksum == "" {
+		checksum, err := hashFile(path)
+		if err != nil {
+			return false, nil, &UploadError{http.StatusInternalServerError, "failed to read upload", err}
+		}
+
+		echo.Checksum = checksum
+	}
+
+	if config.Server.Duplicates == DuplicateCreate || echo.Hash != "" || echo.Expires > 0 || echo.Burn || echo.Password != "" || echo.Visibility != VisibilityPublic {
+		return false, func() {}, nil
+	}
+
+	release, err := claimChecksum(ctx, echo)
+	if err != nil {
+		return false, nil, &UploadError{http.StatusServiceUnavailable, "upload cancelled", err}
+	}
+
+	existing, err := database.FindByChecksum(ctx, echo.Checksum, echo.Owner)
+	if err != nil {
+		release()
+
+		return false, nil, &UploadError{http.StatusInternalServerError, "database error", err}
+	}
+
+	if existing == nil {
+		return false, release, nil
+	}
+
+	release()
+
+	if config.Server.Duplicates == DuplicateReject {
+		return false, nil, &UploadError{http.StatusConflict, "duplicate of " + existing.Hash, nil}
+	}
+
+	existing.Duplicate = true
+
+	*echo = *existing
+
+	return true, nil, nil
+}
+
+func (d *EchoDatabase) FindByChecksum(ctx context.Context, checksum string, owner int64) (*Echo, error) {
+	e, err := scanEcho(d.QueryRowContext(ctx, "SELECT "+echoColumns+" FROM echos WHERE checksum = ? AND owner = ? AND expires = 0 AND burn = 0 AND visibility = ? AND password = '' ORDER BY id LIMIT 1", checksum, owner, VisibilityPublic))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return e, nil
+}
+
+func (d *EchoDatabase) FindMissingChecksums(ctx context.Context) ([]Echo, error) {
+	rows, err := d.QueryContext(ctx, "SELECT "+echoColumns+" FROM echos WHERE checksum = '' AND extension != ?", LinkExtension)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	return scanEchos(rows)
+}
+
+func (d *EchoDatabase) SetChecksum(ctx context.Context, hash, checksum string) error {
+	_, err := d.ExecContext(ctx, "UPDATE echos SET checksum = ? WHERE hash = ?", checksum, hash)
+
+	return err
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/rand"
+	"html/template"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type deletionPage struct {
+	Name    string
+	Message string
+	Done    bool
+}
+
+var deletionTemplate = template.Must(template.New("deletion").Parse(`<!DOCTYPE html>
+<html lang="en">
+	<head>
+		<meta charset="UTF-8" />
+		<meta name="viewport" content="width=device-width, initial-scale=1.0" />
+		<meta name="robots" content="noindex, nofollow" />
+		<title>Delete Echo</title>
+		<style>
+			body { margin: 0; min-height: 100vh; display: flex; align-items: center; justify-content: center; background: #111; color: #ddd; font-family: monospace; }
+			form { display: flex; flex-direction: column; gap: 12px; width: 280px; padding: 24px; border: 1px solid #333; background: #181818; }
+			button { padding: 10px; border: 1px solid #333; background: #111; color: #e55; font-family: inherit; cursor: pointer; }
+			.name { overflow-wrap: anywhere; color: #999; }
+			.error { color: #e55; }
+		</style>
+	</head>
+	<body>
+		<form method="POST">
+			<div>// DELETE_ECHO</div>
+			{{if .Name}}<div class="name">{{.Name}}</div>{{end}}
+			{{if .Done}}<div>This echo has been deleted.</div>{{else}}<div>This permanently deletes the echo.</div>
+			<button type="submit">DELETE</button>{{end}}
+			{{if .Message}}<div class="error">{{.Message}}</div>{{end}}
+		</form>
+	</body>
+</html>`))
+
+// generateDeletionKey returns the random per-echo key deletion secrets are
+// derived from.
+func generateDeletionKey() string {
+	return rand.Text()
+}
+
+func (e *Echo) deletionSecret() string {
+	return signPayload("delete:" + e.Hash + ":" + e.Deletion)
+}
+
+// DeletionURL returns a link anyone can use to delete the echo.
+func (e *Echo) DeletionURL() string {
+	return config.Server.URL + "d/" + e.Hash + "/" + e.deletionSecret()
+}
+
+func (e *Echo) CheckDeletionSecret(secret string) bool {
+	return e.Deletion != "" && verifyPayload("delete:"+e.Hash+":"+e.Deletion, secret)
+}
+
+func renderDeletionPage(w http.ResponseWriter, status int, page deletionPage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Header().Set("X-Robots-Tag", "noindex, nofollow")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+
+	w.WriteHeader(status)
+
+	deletionTemplate.Execute(w, page)
+}
+
+// findDeletable resolves the echo of a deletion link, rendering an error page
+// and returning nil if the link is invalid.
+func findDeletable(w http.ResponseWriter, r *http.Request) *Echo {
+	hash := chi.URLParam(r, "hash")
+	if !validateHash(hash) {
+		renderDeletionPage(w, http.StatusNotFound, deletionPage{Message: "Echo not found"})
+
+		log.Warnln("deletion: invalid hash")
+
+		return nil
+	}
+
+	ip := clientIP(r)
+
+	if limits != nil {
+		if wait := limits.Locked(ip); wait > 0 {
+			tooManyRequests(w, wait, "too many failed attempts")
+
+			return nil
+		}
+	}
+
+	echo, err := database.Find(r.Context(), hash)
+	if err != nil {
+		abort(w, http.StatusInternalServerError, "database error")
+
+		log.Warnln("deletion: failed to find echo")
+		log.Warnln(err)
+
+		return nil
+	}
+
+	if echo == nil || !echo.CheckDeletionSecret(chi.URLParam(r, "secret")) {
+		if limits != nil {
+			limits.Fail(ip)
+		}
+
+		renderDeletionPage(w, http.StatusNotFound, deletionPage{Message: "Echo not found or already deleted"})
+
+		return nil
+	}
+
+	return echo
+}
+
+// viewDeletionHandler only asks for confirmation, so link previews and
+// prefetching never delete anything.
+func viewDeletionHandler(w http.ResponseWriter, r *http.Request) {
+	echo := findDeletable(w, r)
+	if echo == nil {
+		return
+	}
+
+	renderDeletionPage(w, http.StatusOK, deletionPage{Name: echo.Name})
+}
+
+func deletionHandler(w http.ResponseWriter, r *http.Request) {
+	echo := findDeletable(w, r)
+	if echo == nil {
+		return
+	}
+
+	err := echo.Unlink()
+	if err != nil {
+		abort(w, http.StatusInternalServerError, "filesystem error")
+
+		log.Warnln("deletion: failed to unlink echo")
+		log.Warnln(err)
+
+		return
+	}
+
+	err = database.Delete(echo.Hash)
+	if err != nil {
+		abort(w, http.StatusInternalServerError, "database delete error")
+
+		log.Warnln("deletion: failed to delete echo")
+		log.Warnln(err)
+
+		return
+	}
+
+	count.Add(^uint64(0))
+
+	hub.BroadcastDelete(echo)
+
+	audit(r, nil, AuditDelete, echo.Hash, echo.Name+" (deletion link)")
+
+	renderDeletionPage(w, http.StatusOK, deletionPage{Name: echo.Name, Done: true})
+}
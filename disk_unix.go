@@ -0,0 +1,18 @@
+//go:build !windows
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// freeDiskSpace returns the bytes available to unprivileged users on the
+// filesystem holding path.
+func freeDiskSpace(path string) (int64, error) {
+	var stat unix.Statfs_t
+
+	err := unix.Statfs(path, &stat)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
@@ -0,0 +1,23 @@
+//go:build windows
+
+package main
+
+import "golang.org/x/sys/windows"
+
+// freeDiskSpace returns the bytes available to the current user on the
+// volume holding path.
+func freeDiskSpace(path string) (int64, error) {
+	name, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+
+	var available uint64
+
+	err = windows.GetDiskFreeSpaceEx(name, &available, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(available), nil
+}
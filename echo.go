@@ -9,52 +9,69 @@ import (
 )
 
 type Echo struct {
-	ID         int64  `json:"id"`
-	Hash       string `json:"hash"`
-	Name       string `json:"name"`
-	Extension  string `json:"extension"`
-	Animated   bool   `json:"animated"`
-	Size       int64  `json:"size"`
-	UploadSize int64  `json:"upload_size"`
-	Timestamp  int64  `json:"timestamp"`
-	Favorited  bool   `json:"favorited"`
+	ID         int64      `json:"id"`
+	Hash       string     `json:"hash"`
+	Name       string     `json:"name"`
+	Extension  string     `json:"extension"`
+	Animated   bool       `json:"animated"`
+	Size       int64      `json:"size"`
+	UploadSize int64      `json:"upload_size"`
+	Timestamp  int64      `json:"timestamp"`
+	Favorited  bool       `json:"favorited"`
+	Owner      int64      `json:"owner"`
+	Visibility Visibility `json:"visibility"`
+	Source     string     `json:"source,omitempty"`
+	Checksum   string     `json:"checksum,omitempty"`
+	Expires    int64      `json:"expires,omitempty"`
+	Burn       bool       `json:"burn,omitempty"`
+	Language   string     `json:"language,omitempty"`
+	Target     string     `json:"target,omitempty"`
+	Clicks     int64      `json:"clicks,omitempty"`
 
 	Safety     string  `json:"safety,omitempty"`
 	Similarity float32 `json:"similarity,omitempty"`
+	Duplicate  bool    `json:"duplicate,omitempty"`
 
 	Phrases     string `json:"-"`
 	Description string `json:"-"`
+	Password    string `json:"-"`
+	Deletion    string `json:"-"`
+
+	// Pending holds the sniffed extension while a reserved echo waits for
+	// its file, so an interrupted job can be resumed.
+	Pending string `json:"-"`
 }
 
 type echoAlias Echo
 
 type jsonEcho struct {
 	echoAlias
-	URL string `json:"url"`
+	URL       string `json:"url"`
+	ViewURL   string `json:"view_url,omitempty"`
+	Protected bool   `json:"protected"`
 }
 
 func (e Echo) MarshalJSON() ([]byte, error) {
 	return json.Marshal(&jsonEcho{
 		echoAlias: echoAlias(e),
 		URL:       e.URL(),
+		ViewURL:   e.ViewURL(),
+		Protected: e.IsProtected(),
 	})
 }
 
-func (e *Echo) Fill(ctx context.Context) error {
+func (e *Echo) Fill() {
 	if e.Hash == "" {
-		hash, err := database.Hash(ctx)
-		if err != nil {
-			return err
-		}
-
-		e.Hash = hash
+		e.Hash = generateHash()
 	}
 
 	if e.Timestamp == 0 {
 		e.Timestamp = time.Now().Unix()
 	}
 
-	return nil
+	if e.Deletion == "" {
+		e.Deletion = generateDeletionKey()
+	}
 }
 
 func (e *Echo) Storage() string {
@@ -62,6 +79,10 @@ func (e *Echo) Storage() string {
 }
 
 func (e *Echo) URL() string {
+	if e.IsLink() {
+		return config.Server.URL + "s/" + e.Hash
+	}
+
 	if config.Server.Direct {
 		return fmt.Sprintf("%s%s.%s", config.Server.URL, e.Hash, e.Extension)
 	}
@@ -92,6 +113,13 @@ func (e *Echo) Unlink() error {
 		vector.Delete(e.Hash)
 	}
 
+	if e.IsText() {
+		err = database.DeleteText(e.Hash)
+		if err != nil {
+			log.Warnf("Failed to remove text %s from index: %v\n", e.Hash, err)
+		}
+	}
+
 	usage.Add(^uint64(e.Size - 1))
 
 	return nil
@@ -103,10 +131,7 @@ func (e *Echo) SaveUploadedFile(ctx context.Context, path string) (int64, error)
 		return 0, err
 	}
 
-	err = e.Fill(ctx)
-	if err != nil {
-		return 0, err
-	}
+	e.Fill()
 
 	switch e.Extension {
 	case "jpg", "jpeg", "png", "webp":
@@ -149,6 +174,12 @@ func (e *Echo) SaveUploadedFile(ctx context.Context, path string) (int64, error)
 		return remuxVideo(ctx, path, e.Storage(), e.Extension)
 	case "mp4", "webm", "mov", "m4v", "mkv":
 		return remuxVideo(ctx, path, e.Storage(), e.Extension)
+	case "txt":
+		return copyFile(path, e.Storage())
+	}
+
+	if config.IsAllowedFile(e.Extension) {
+		return copyFile(path, e.Storage())
 	}
 
 	return 0, fmt.Errorf("unsupported extension %q", e.Extension)
@@ -20,19 +20,30 @@ type Event struct {
 	Hash       string `json:"hash,omitempty"`
 	Echo       *Echo  `json:"echo,omitempty"`
 	Processing bool   `json:"processing,omitempty"`
+	Error      string `json:"error,omitempty"`
 
 	Size  uint64 `json:"size"`
 	Count uint64 `json:"count"`
+
+	Owner int64 `json:"-"`
 }
 
 type Client struct {
 	send chan []byte
+
+	owner int64
+	admin bool
+}
+
+type HubMessage struct {
+	owner   int64
+	payload []byte
 }
 
 type Hub struct {
 	clients map[*Client]struct{}
 
-	broadcast  chan []byte
+	broadcast  chan HubMessage
 	register   chan *Client
 	unregister chan *Client
 
@@ -43,7 +54,7 @@ func NewHub(ctx context.Context) *Hub {
 	return &Hub{
 		clients: make(map[*Client]struct{}),
 
-		broadcast:  make(chan []byte),
+		broadcast:  make(chan HubMessage),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
 
@@ -67,8 +78,12 @@ func (h *Hub) Run() {
 
 		case message := <-h.broadcast:
 			for client := range h.clients {
+				if !client.admin && client.owner != message.owner {
+					continue
+				}
+
 				select {
-				case client.send <- message:
+				case client.send <- message.payload:
 				default:
 					h.removeClient(client)
 				}
@@ -104,40 +119,63 @@ func (h *Hub) Broadcast(event Event) {
 		return
 	}
 
+	if webhooks != nil {
+		webhooks.Enqueue(event, b)
+	}
+
+	message := HubMessage{
+		owner:   event.Owner,
+		payload: b,
+	}
+
 	select {
 	case <-h.ctx.Done():
 		return
-	case h.broadcast <- b:
+	case h.broadcast <- message:
 	}
 }
 
 func (h *Hub) BroadcastCreate(id string, echo *Echo) {
 	h.Broadcast(Event{
-		Type: EventCreateEcho,
-		ID:   id,
-		Echo: echo,
+		Type:  EventCreateEcho,
+		ID:    id,
+		Echo:  echo,
+		Owner: echo.Owner,
 	})
 }
 
 func (h *Hub) BroadcastUpdate(echo *Echo) {
 	h.Broadcast(Event{
-		Type: EventUpdateEcho,
-		Echo: echo,
+		Type:  EventUpdateEcho,
+		Echo:  echo,
+		Owner: echo.Owner,
 	})
 }
 
-func (h *Hub) BroadcastDelete(hash string) {
+func (h *Hub) BroadcastDelete(echo *Echo) {
 	h.Broadcast(Event{
-		Type: EventDeleteEcho,
-		Hash: hash,
+		Type:  EventDeleteEcho,
+		Hash:  echo.Hash,
+		Owner: echo.Owner,
 	})
 }
 
-func (h *Hub) BroadcastProcessing(hash string, processing bool) {
+func (h *Hub) BroadcastProcessing(echo *Echo, processing bool) {
 	h.Broadcast(Event{
 		Type:       EventProcessingEcho,
-		Hash:       hash,
+		Hash:       echo.Hash,
 		Processing: processing,
+		Owner:      echo.Owner,
+	})
+}
+
+// BroadcastFailure announces that background processing of echo failed.
+func (h *Hub) BroadcastFailure(echo *Echo, message string) {
+	h.Broadcast(Event{
+		Type:  EventProcessingEcho,
+		Hash:  echo.Hash,
+		Error: message,
+		Owner: echo.Owner,
 	})
 }
 
@@ -156,8 +194,13 @@ func (h *Hub) Handle(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Connection", "keep-alive")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 
+	caller := getCaller(r)
+
 	client := &Client{
 		send: make(chan []byte, 8),
+
+		owner: caller.Owner(),
+		admin: caller.IsAdmin(),
 	}
 
 	select {
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ExpiryReaperInterval = time.Minute
+
+	AuditActorReaper = "reaper"
+)
+
+// uploadExpiry reads the "expires" and "burn" query parameters of an upload.
+// expires is either a duration ("90m", "12h", "7d") or a point in time (unix
+// seconds or RFC 3339).
+func uploadExpiry(r *http.Request) (int64, bool, error) {
+	query := r.URL.Query()
+
+	var burn bool
+
+	if raw := query.Get("burn"); raw != "" {
+		var err error
+
+		burn, err = strconv.ParseBool(raw)
+		if err != nil {
+			return 0, false, errors.New("invalid burn flag")
+		}
+	}
+
+	raw := strings.TrimSpace(query.Get("expires"))
+	if raw == "" {
+		return 0, burn, nil
+	}
+
+	expires, err := parseExpiry(raw, time.Now())
+	if err != nil {
+		return 0, false, err
+	}
+
+	return expires, burn, nil
+}
+
+func parseExpiry(raw string, now time.Time) (int64, error) {
+	var at time.Time
+
+	if unix, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		at = time.Unix(unix, 0)
+	} else if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		at = t
+	} else {
+		duration, err := parseDuration(raw)
+		if err != nil || duration <= 0 {
+			return 0, errors.New("invalid expires, use a duration like 12h or 7d or a timestamp")
+		}
+
+		at = now.Add(duration)
+	}
+
+	if !at.After(now) {
+		return 0, errors.New("expires must be in the future")
+	}
+
+	return at.Unix(), nil
+}
+
+// IsExpired reports whether the echo is past its expiry and only waiting
+// for the reaper.
+func (e *Echo) IsExpired() bool {
+	return e.Expires > 0 && e.Expires <= time.Now().Unix()
+}
+
+// StartExpiryReaper periodically deletes echos past their expiry.
+func StartExpiryReaper() {
+	go func() {
+		ticker := time.NewTicker(ExpiryReaperInterval)
+		defer ticker.Stop()
+
+		for {
+			reapExpired(context.Background())
+
+			<-ticker.C
+		}
+	}()
+}
+
+func reapExpired(ctx context.Context) {
+	echos, err := database.FindExpired(ctx, time.Now().Unix())
+	if err != nil {
+		log.Warnf("Failed to find expired echos: %v\n", err)
+
+		return
+	}
+
+	var removed int
+
+	for _, echo := range echos {
+		ok, err := database.DeleteExpired(ctx, echo.Hash)
+		if err != nil {
+			log.Warnf("Failed to delete expired echo %s: %v\n", echo.Hash, err)
+
+			continue
+		}
+
+		// deleted some other way in the meantime
+		if !ok {
+			continue
+		}
+
+		removeEchoFile(&echo)
+
+		err = database.Audit(ctx, &AuditEntry{
+			Timestamp: time.Now().Unix(),
+			Action:    AuditExpire,
+			Actor:     AuditActorReaper,
+			UserID:    echo.Owner,
+			Hash:      echo.Hash,
+			Detail:    echo.Name,
+		})
+		if err != nil {
+			log.Warnf("Failed to write audit entry (%s): %v\n", AuditExpire, err)
+		}
+
+		removed++
+	}
+
+	if removed > 0 {
+		log.Printf("Removed %d expired echo(s)\n", removed)
+	}
+}
+
+// removeEchoFile cleans up after an echo whose row is already gone.
+func removeEchoFile(echo *Echo) {
+	err := echo.Unlink()
+	if err != nil {
+		log.Warnf("Failed to unlink echo %s: %v\n", echo.Hash, err)
+	}
+
+	count.Add(^uint64(0))
+
+	hub.BroadcastDelete(echo)
+}
+
+func (d *EchoDatabase) FindExpired(ctx context.Context, now int64) ([]Echo, error) {
+	rows, err := d.QueryContext(ctx, "SELECT "+echoColumns+" FROM echos WHERE expires > 0 AND expires <= ?", now)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	return scanEchos(rows)
+}
+
+// DeleteExpired removes an echo if it is still expired and reports whether
+// it did.
+func (d *EchoDatabase) DeleteExpired(ctx context.Context, hash string) (bool, error) {
+	res, err := d.ExecContext(ctx, "DELETE FROM echos WHERE hash = ? AND expires > 0 AND expires <= ?", hash, time.Now().Unix())
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected > 0, nil
+}
+
+// Burn removes a burn-after-read echo and reports whether this call did, so
+// only a single viewer ever gets to see it.
+func (d *EchoDatabase) Burn(ctx context.Context, hash string) (bool, error) {
+	res, err := d.ExecContext(ctx, "DELETE FROM echos WHERE hash = ? AND burn = 1", hash)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected > 0, nil
+}
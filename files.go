@@ -1,6 +1,7 @@
 package main
 
 import (
+	"io"
 	"os"
 )
 
@@ -22,3 +23,40 @@ func OpenTempFileForWriting() (*CountWriter, string, error) {
 		File: file,
 	}, file.Name(), nil
 }
+
+// copyFile stores the file at input as is.
+func copyFile(input, output string) (int64, error) {
+	in, err := OpenFileForReading(input)
+	if err != nil {
+		return 0, err
+	}
+
+	defer in.Close()
+
+	out, err := OpenFileForWriting(output)
+	if err != nil {
+		return 0, err
+	}
+
+	defer out.Close()
+
+	return io.Copy(out, in)
+}
+
+// moveFile renames input to output, copying it where a rename can't cross
+// file systems.
+func moveFile(input, output string) error {
+	err := os.Rename(input, output)
+	if err == nil {
+		return nil
+	}
+
+	_, err = copyFile(input, output)
+	if err != nil {
+		os.Remove(output)
+
+		return err
+	}
+
+	return os.Remove(input)
+}
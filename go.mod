@@ -29,6 +29,6 @@ require (
 
 require (
 	github.com/mattn/go-isatty v0.0.20 // indirect
-	golang.org/x/sys v0.40.0 // indirect
+	golang.org/x/sys v0.40.0
 	modernc.org/sqlite v1.44.3
 )
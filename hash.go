@@ -1,48 +1,87 @@
 package main
 
 import (
-	"context"
-	"math/rand"
+	"crypto/rand"
+	"errors"
+	"math/big"
 	"regexp"
+	"slices"
+	"strings"
 )
 
-var hashRgx = regexp.MustCompile(`^[0-9A-Za-z]{10}$`)
+// HashAttempts is how often a generated id is replaced after colliding with
+// an existing one before giving up.
+const HashAttempts = 16
 
-func (d *EchoDatabase) Hash(ctx context.Context) (string, error) {
-	for {
-		hash := generateHash()
+// Ids of any scheme (generated, word based, vanity and the original 10
+// character ones) only ever use these characters, so ids stay valid when
+// the configured scheme changes.
+var (
+	hashRgx   = regexp.MustCompile(`^[0-9A-Za-z_-]{1,64}$`)
+	vanityRgx = regexp.MustCompile(`^[0-9A-Za-z][0-9A-Za-z_-]{2,63}$`)
+)
 
-		echo, err := d.Find(ctx, hash)
-		if err != nil {
-			return "", err
-		}
+var errHashTaken = errors.New("id is already taken")
 
-		if echo == nil {
-			return hash, nil
-		}
-	}
+// reservedSlugs are the top-level routes. Short links are served directly
+// below the root, so a vanity slug must not shadow one of them.
+var reservedSlugs = []string{
+	"audit", "config", "echo", "echos", "info", "login", "logout", "query",
+	"shorten", "tokens", "tus", "upload", "usage", "users", "verify", "webhooks",
 }
 
 func generateHash() string {
-	var hash string
+	if config.IDs.Words > 0 {
+		return generateSlug(config.IDs.Words)
+	}
 
-	for range 10 {
-		char := rand.Intn(36) + 48
+	alphabet := []rune(config.IDs.Alphabet)
 
-		if char > 57 {
-			char += 7
-		}
+	var hash strings.Builder
 
-		hash += string(rune(char))
+	for range config.IDs.Length {
+		hash.WriteRune(alphabet[randomIndex(len(alphabet))])
 	}
 
-	return hash
+	return hash.String()
 }
 
-func validateHash(hash string) bool {
-	if len(hash) != 10 {
-		return false
+// generateSlug builds a human friendly id like "calm-amber-fox" from n
+// random words, the last of which is a noun.
+func generateSlug(n int) string {
+	words := make([]string, n)
+
+	for i := range n - 1 {
+		words[i] = slugAdjectives[randomIndex(len(slugAdjectives))]
+	}
+
+	words[n-1] = slugNouns[randomIndex(len(slugNouns))]
+
+	return strings.Join(words, "-")
+}
+
+func randomIndex(n int) int {
+	index, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		// crypto/rand never fails on supported platforms
+		panic(err)
 	}
 
+	return int(index.Int64())
+}
+
+func validateHash(hash string) bool {
 	return hashRgx.MatchString(hash)
 }
+
+func validateVanity(slug string) bool {
+	return vanityRgx.MatchString(slug)
+}
+
+func isReservedSlug(slug string) bool {
+	return slices.Contains(reservedSlugs, strings.ToLower(slug))
+}
+
+func isUniqueViolation(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed")
+}
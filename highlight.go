@@ -0,0 +1,423 @@
+package main
+
+import (
+	"html"
+	"html/template"
+	"slices"
+	"strings"
+)
+
+// syntax describes just enough of a language to color keywords, strings,
+// numbers and comments. It is a tokenizer, not a parser, so exotic constructs
+// are left uncolored rather than being guessed at.
+type syntax struct {
+	keywords      map[string]bool
+	ignoreCase    bool
+	lineComments  []string
+	blockComments [][2]string
+	quotes        string
+	rawQuotes     string
+	tripleQuotes  bool
+	markup        bool
+	lineClass     func(line string) string
+}
+
+const (
+	cKeywords      = "auto break case char const continue default do double else enum extern float for goto if inline int long register return short signed sizeof static struct switch typedef union unsigned void volatile while NULL true false"
+	cppKeywords    = cKeywords + " bool catch class constexpr delete explicit friend namespace new noexcept nullptr operator override private protected public template this throw try typename using virtual"
+	csharpKeywords = "abstract as async await base bool break byte case catch char class const continue decimal default delegate do double else enum event explicit false finally float for foreach get if implicit in int interface internal is lock long namespace new null object out override params private protected public readonly ref return sealed set short static string struct switch this throw true try typeof uint ulong using var virtual void while"
+	goKeywords     = "break case chan const continue default defer else fallthrough for func go goto if import interface map package range return select struct switch type var true false nil iota any bool byte error float32 float64 int int8 int16 int32 int64 rune string uint uint8 uint16 uint32 uint64 uintptr"
+	javaKeywords   = "abstract assert boolean break byte case catch char class const continue default do double else enum extends final finally float for if implements import instanceof int interface long native new null package private protected public return short static super switch synchronized this throw throws transient true false try var void volatile while record"
+	jsKeywords     = "async await break case catch class const continue debugger default delete do else export extends false finally for from function if import in instanceof let new null of return static super switch this throw true try typeof undefined var void while with yield"
+	tsKeywords     = jsKeywords + " abstract any as boolean declare enum implements interface keyof namespace never number private protected public readonly string type unknown"
+	kotlinKeywords = "as break class continue do else false for fun if in interface is null object package return super this throw true try typealias val var when while by catch constructor data enum finally import init internal open override private protected public sealed suspend"
+	swiftKeywords  = "as associatedtype break case catch class continue default defer do else enum extension fallthrough false for func guard if import in init inout internal is let nil operator private protocol public repeat rethrows return self static struct subscript super switch throw throws true try var where while async await"
+	rustKeywords   = "as async await break const continue crate dyn else enum extern false fn for if impl in let loop match mod move mut pub ref return self Self static struct super trait true type unsafe use where while bool char f32 f64 i8 i16 i32 i64 i128 isize str u8 u16 u32 u64 u128 usize Some None Ok Err"
+	phpKeywords    = "abstract and array as break callable case catch class clone const continue declare default do echo else elseif empty enddeclare endfor endforeach endif endswitch endwhile extends false final finally fn for foreach function global if implements include instanceof interface isset list match namespace new null or print private protected public require return static switch throw trait true try unset use var while yield"
+	pyKeywords     = "and as assert async await break class continue def del elif else except False finally for from global if import in is lambda None nonlocal not or pass raise return True try while with yield self"
+	rubyKeywords   = "alias and begin break case class def defined do else elsif end ensure false for if in module next nil not or redo rescue retry return self super then true undef unless until when while yield require attr_accessor attr_reader"
+	bashKeywords   = "case do done elif else esac fi for function if in local return select then until while export readonly declare unset echo exit set shift source true false"
+	luaKeywords    = "and break do else elseif end false for function goto if in local nil not or repeat return then true until while"
+	sqlKeywords    = "add all alter and as asc between by case check column constraint create database default delete desc distinct drop else end exists foreign from full group having if in index inner insert into is join key left like limit not null offset on or order outer primary references returning right select set table then union unique update values view when where with integer text real blob varchar boolean"
+	cssKeywords    = "important inherit initial unset none auto"
+)
+
+var (
+	cSyntax = syntax{
+		lineComments:  []string{"//"},
+		blockComments: [][2]string{{"/*", "*/"}},
+		quotes:        `"'`,
+	}
+	hashSyntax = syntax{
+		lineComments: []string{"#"},
+		quotes:       `"'`,
+	}
+
+	syntaxes = map[string]*syntax{
+		"c":          cSyntax.with(cKeywords),
+		"cpp":        cSyntax.with(cppKeywords),
+		"csharp":     cSyntax.with(csharpKeywords),
+		"java":       cSyntax.with(javaKeywords),
+		"kotlin":     cSyntax.with(kotlinKeywords),
+		"swift":      cSyntax.with(swiftKeywords),
+		"rust":       {keywords: words(rustKeywords), lineComments: []string{"//"}, blockComments: [][2]string{{"/*", "*/"}}, quotes: `"`},
+		"go":         {keywords: words(goKeywords), lineComments: []string{"//"}, blockComments: [][2]string{{"/*", "*/"}}, quotes: "\"'`", rawQuotes: "`"},
+		"javascript": {keywords: words(jsKeywords), lineComments: []string{"//"}, blockComments: [][2]string{{"/*", "*/"}}, quotes: "\"'`"},
+		"typescript": {keywords: words(tsKeywords), lineComments: []string{"//"}, blockComments: [][2]string{{"/*", "*/"}}, quotes: "\"'`"},
+		"php":        {keywords: words(phpKeywords), lineComments: []string{"//", "#"}, blockComments: [][2]string{{"/*", "*/"}}, quotes: `"'`},
+		"css":        {keywords: words(cssKeywords), blockComments: [][2]string{{"/*", "*/"}}, quotes: `"'`},
+		"json":       {keywords: words("true false null"), quotes: `"`},
+		"python":     {keywords: words(pyKeywords), lineComments: []string{"#"}, quotes: `"'`, tripleQuotes: true},
+		"ruby":       hashSyntax.with(rubyKeywords),
+		"bash":       hashSyntax.with(bashKeywords),
+		"yaml":       hashSyntax.with("true false null yes no on off"),
+		"toml":       hashSyntax.with("true false"),
+		"dockerfile": hashSyntax.with("FROM AS RUN CMD LABEL EXPOSE ENV ADD COPY ENTRYPOINT VOLUME USER WORKDIR ARG ONBUILD STOPSIGNAL HEALTHCHECK SHELL"),
+		"makefile":   hashSyntax.with("ifeq ifneq ifdef ifndef else endif include define endef export"),
+		"ini":        {lineComments: []string{"#", ";"}, quotes: `"`},
+		"lua":        {keywords: words(luaKeywords), lineComments: []string{"--"}, blockComments: [][2]string{{"--[[", "]]"}}, quotes: `"'`},
+		"sql":        {keywords: words(sqlKeywords), ignoreCase: true, lineComments: []string{"--"}, blockComments: [][2]string{{"/*", "*/"}}, quotes: `"'`},
+		"html":       {blockComments: [][2]string{{"<!--", "-->"}}, quotes: `"'`, markup: true},
+		"xml":        {blockComments: [][2]string{{"<!--", "-->"}, {"<![CDATA[", "]]>"}}, quotes: `"'`, markup: true},
+		"diff":       {lineClass: diffLineClass},
+		"markdown":   {lineClass: markdownLineClass},
+		"plaintext":  {},
+	}
+)
+
+func (s syntax) with(keywords string) *syntax {
+	s.keywords = words(keywords)
+
+	return &s
+}
+
+func words(list string) map[string]bool {
+	set := make(map[string]bool)
+
+	for word := range strings.FieldsSeq(list) {
+		set[word] = true
+	}
+
+	return set
+}
+
+// HighlightLanguages lists the languages the highlighter knows, any other
+// language is shown as plain text.
+func HighlightLanguages() []string {
+	languages := make([]string, 0, len(syntaxes))
+
+	for name := range syntaxes {
+		languages = append(languages, name)
+	}
+
+	slices.Sort(languages)
+
+	return languages
+}
+
+func diffLineClass(line string) string {
+	switch {
+	case strings.HasPrefix(line, "+++"), strings.HasPrefix(line, "---"), strings.HasPrefix(line, "@@"), strings.HasPrefix(line, "diff "):
+		return "k"
+	case strings.HasPrefix(line, "+"):
+		return "a"
+	case strings.HasPrefix(line, "-"):
+		return "d"
+	}
+
+	return ""
+}
+
+func markdownLineClass(line string) string {
+	switch {
+	case strings.HasPrefix(line, "#"):
+		return "k"
+	case strings.HasPrefix(line, ">"):
+		return "c"
+	case strings.HasPrefix(line, "```"), strings.HasPrefix(line, "    "):
+		return "s"
+	}
+
+	return ""
+}
+
+type highlighter struct {
+	lines []template.HTML
+	line  strings.Builder
+	plain strings.Builder
+}
+
+// highlight renders text as html lines with spans for the recognized tokens
+// of language.
+func highlight(text, language string) []template.HTML {
+	text = strings.TrimSuffix(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+
+	h := &highlighter{}
+
+	s := syntaxes[language]
+
+	switch {
+	case s == nil:
+		h.emit("", text)
+	case s.lineClass != nil:
+		for i, line := range strings.Split(text, "\n") {
+			if i > 0 {
+				h.emit("", "\n")
+			}
+
+			h.emit(s.lineClass(line), line)
+		}
+	default:
+		s.tokenize(h, text)
+	}
+
+	h.flush()
+
+	h.lines = append(h.lines, template.HTML(h.line.String()))
+
+	return h.lines
+}
+
+// emit appends a token, splitting it at line breaks so every line stays
+// self-contained html.
+func (h *highlighter) emit(class, text string) {
+	if class == "" {
+		h.plain.WriteString(text)
+
+		return
+	}
+
+	h.flush()
+
+	h.write(class, text)
+}
+
+func (h *highlighter) flush() {
+	if h.plain.Len() == 0 {
+		return
+	}
+
+	h.write("", h.plain.String())
+
+	h.plain.Reset()
+}
+
+func (h *highlighter) write(class, text string) {
+	for i, part := range strings.Split(text, "\n") {
+		if i > 0 {
+			h.lines = append(h.lines, template.HTML(h.line.String()))
+
+			h.line.Reset()
+		}
+
+		if part == "" {
+			continue
+		}
+
+		if class == "" {
+			h.line.WriteString(html.EscapeString(part))
+
+			continue
+		}
+
+		h.line.WriteString(`<span class="` + class + `">`)
+		h.line.WriteString(html.EscapeString(part))
+		h.line.WriteString("</span>")
+	}
+}
+
+func (s *syntax) tokenize(h *highlighter, text string) {
+	var inTag bool
+
+	for i := 0; i < len(text); {
+		rest := text[i:]
+
+		if end := s.commentEnd(text, i); end > 0 {
+			h.emit("c", rest[:end])
+
+			i += end
+
+			continue
+		}
+
+		c := text[i]
+
+		if s.markup {
+			switch c {
+			case '<':
+				end := 1 + tagNameEnd(rest[1:])
+
+				h.emit("", "<")
+
+				if end > 1 {
+					h.emit("k", rest[1:end])
+				}
+
+				inTag = true
+
+				i += end
+
+				continue
+			case '>':
+				inTag = false
+			}
+		}
+
+		if strings.IndexByte(s.quotes, c) >= 0 && (!s.markup || inTag) {
+			end := s.stringEnd(rest)
+
+			h.emit("s", rest[:end])
+
+			i += end
+
+			continue
+		}
+
+		if isDigit(c) && (i == 0 || !isIdentByte(text[i-1])) {
+			end := identEnd(rest)
+
+			h.emit("n", rest[:end])
+
+			i += end
+
+			continue
+		}
+
+		if isIdentByte(c) {
+			end := identEnd(rest)
+			word := rest[:end]
+
+			if s.isKeyword(word) {
+				h.emit("k", word)
+			} else {
+				h.emit("", word)
+			}
+
+			i += end
+
+			continue
+		}
+
+		h.emit("", text[i:i+1])
+
+		i++
+	}
+}
+
+// commentEnd returns the length of the comment starting at text[i], or 0.
+func (s *syntax) commentEnd(text string, i int) int {
+	rest := text[i:]
+
+	for _, pair := range s.blockComments {
+		if !strings.HasPrefix(rest, pair[0]) {
+			continue
+		}
+
+		end := strings.Index(rest[len(pair[0]):], pair[1])
+		if end < 0 {
+			return len(rest)
+		}
+
+		return len(pair[0]) + end + len(pair[1])
+	}
+
+	for _, prefix := range s.lineComments {
+		if !strings.HasPrefix(rest, prefix) {
+			continue
+		}
+
+		// "$#" or "${#var}" in shells, "a#b" in urls
+		if prefix == "#" && i > 0 && (isIdentByte(text[i-1]) || text[i-1] == '$' || text[i-1] == '{') {
+			continue
+		}
+
+		end := strings.IndexByte(rest, '\n')
+		if end < 0 {
+			return len(rest)
+		}
+
+		return end
+	}
+
+	return 0
+}
+
+// stringEnd returns the length of the string literal at the start of rest.
+// Unterminated strings end at the line break, except for raw ones.
+func (s *syntax) stringEnd(rest string) int {
+	quote := rest[0]
+
+	if s.tripleQuotes {
+		triple := strings.Repeat(rest[:1], 3)
+
+		if strings.HasPrefix(rest, triple) {
+			end := strings.Index(rest[3:], triple)
+			if end < 0 {
+				return len(rest)
+			}
+
+			return end + 6
+		}
+	}
+
+	raw := strings.IndexByte(s.rawQuotes, quote) >= 0
+
+	for j := 1; j < len(rest); j++ {
+		switch rest[j] {
+		case '\\':
+			if !raw {
+				j++
+			}
+		case quote:
+			return j + 1
+		case '\n':
+			if !raw {
+				return j
+			}
+		}
+	}
+
+	return len(rest)
+}
+
+func (s *syntax) isKeyword(word string) bool {
+	if s.ignoreCase {
+		word = strings.ToLower(word)
+	}
+
+	return s.keywords[word]
+}
+
+func tagNameEnd(rest string) int {
+	var end int
+
+	for end < len(rest) {
+		c := rest[end]
+
+		if !isIdentByte(c) && c != '/' && c != '!' && c != '?' && c != '-' && c != ':' {
+			break
+		}
+
+		end++
+	}
+
+	return end
+}
+
+func identEnd(rest string) int {
+	end := 1
+
+	for end < len(rest) && isIdentByte(rest[end]) {
+		end++
+	}
+
+	return end
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || c == '$' || isDigit(c) || (c|0x20 >= 'a' && c|0x20 <= 'z') || c >= 0x80
+}
@@ -66,12 +66,18 @@ func main() {
 		return
 	}
 
+	resume, err := RecoverAsyncUploads()
+	log.MustFail(err)
+
 	size, total, err := database.Verify()
 	log.MustFail(err)
 
 	err = StartBackupLoop()
 	log.MustFail(err)
 
+	err = StartResumableReaper()
+	log.MustFail(err)
+
 	usage.Add(size)
 	count.Add(total)
 
@@ -84,34 +90,140 @@ func main() {
 
 	hub = NewHub(ctx)
 
+	if len(config.Webhooks.Endpoints) > 0 {
+		webhooks = NewWebhooks(ctx)
+
+		go webhooks.Run()
+	}
+
 	go hub.Run()
 
+	StartExpiryReaper()
+
+	uploadQueue = NewUploadQueue()
+
+	ResumeAsyncUploads(resume)
+
+	if config.Limits.Enabled {
+		limits = NewLimits()
+	}
+
+	if config.OIDC.Enabled {
+		oidc = NewOIDCProvider()
+	}
+
+	if config.Remote.Enabled {
+		fetcher = NewRemoteFetcher()
+	}
+
 	r := chi.NewRouter()
 
 	r.Use(middleware.Recoverer)
 	r.Use(log.Middleware())
+	r.Use(rateLimit)
 
 	fs := http.FileServer(http.FS(public))
 	r.Handle("/*", fs)
 
 	r.Get("/info", infoHandler)
 	r.Get("/verify", verifyHandler)
+	r.Post("/login", loginHandler)
+	r.Post("/logout", logoutHandler)
+
+	if oidc != nil {
+		r.Get("/login/oidc", oidcLoginHandler)
+		r.Get("/login/oidc/callback", oidcCallbackHandler)
+	}
 
 	r.Group(func(gr chi.Router) {
 		gr.Use(authenticate)
 
-		gr.Get("/echo", hub.Handle)
+		gr.Group(func(gr chi.Router) {
+			gr.Use(requireScope(ScopeRead))
+
+			gr.Get("/echo", hub.Handle)
 
-		gr.Get("/echo/{hash}", getEchoHandler)
-		gr.Get("/echos/{page}", listEchosHandler)
-		gr.Get("/query/{page}", queryEchosHandler)
+			gr.Get("/echo/{hash}", getEchoHandler)
+			gr.Get("/echos/{page}", listEchosHandler)
+			gr.Get("/query/{page}", queryEchosHandler)
 
-		gr.Post("/upload", uploadHandler)
-		gr.Patch("/echos/{hash}/favorite", toggleFavoriteHandler)
-		gr.Delete("/echos/{hash}", deleteEchoHandler)
+			gr.Post("/echos/{hash}/share", shareEchoHandler)
+			gr.Get("/echos/{hash}/status", processingStatusHandler)
+			gr.Get("/usage", usageHandler)
+		})
+
+		gr.Group(func(gr chi.Router) {
+			gr.Use(requireScope(ScopeUpload))
+
+			gr.Post("/upload", uploadHandler)
+			gr.Put("/upload/{filename}", rawUploadHandler)
+			gr.Post("/upload/url", remoteUploadHandler)
+			gr.Post("/shorten", shortenHandler)
+
+			gr.Get("/config/sharex.sxcu", shareXConfigHandler)
+			gr.Get("/config/sharex-shortener.sxcu", shareXShortenerConfigHandler)
+			gr.Get("/config/curl.sh", curlConfigHandler)
+			gr.Get("/config/flameshot.sh", flameshotConfigHandler)
+			gr.Get("/config/api.json", apiConfigHandler)
+
+			gr.Patch("/echos/{hash}/visibility", setVisibilityHandler)
+			gr.Put("/echos/{hash}/password", setPasswordHandler)
+		})
+		gr.With(requireScope(ScopeFavorite)).Patch("/echos/{hash}/favorite", toggleFavoriteHandler)
+		gr.With(requireScope(ScopeDelete)).Delete("/echos/{hash}", deleteEchoHandler)
+
+		gr.Group(func(gr chi.Router) {
+			gr.Use(requireScope(ScopeAdmin))
+
+			gr.Get("/tokens", listTokensHandler)
+			gr.Post("/tokens", createTokenHandler)
+			gr.Delete("/tokens/{id}", revokeTokenHandler)
+
+			gr.Get("/users", listUsersHandler)
+			gr.Post("/users", createUserHandler)
+			gr.Delete("/users/{id}", deleteUserHandler)
+			gr.Put("/users/{id}/quota", setUserQuotaHandler)
+
+			gr.Get("/audit", listAuditHandler)
+
+			gr.Get("/webhooks/deliveries", listDeliveriesHandler)
+			gr.Post("/webhooks/deliveries/{id}/retry", retryDeliveryHandler)
+		})
+	})
+
+	r.Route("/tus", func(gr chi.Router) {
+		gr.Use(tusResumable)
+
+		gr.Options("/", tusOptionsHandler)
+		gr.Options("/{id}", tusOptionsHandler)
+
+		gr.Group(func(gr chi.Router) {
+			gr.Use(authenticate)
+			gr.Use(requireScope(ScopeUpload))
+
+			gr.Post("/", tusCreateHandler)
+			gr.Head("/{id}", tusHeadHandler)
+			gr.Patch("/{id}", tusPatchHandler)
+			gr.Delete("/{id}", tusDeleteHandler)
+		})
 	})
 
 	r.Get("/i/{hash}.{ext}", viewEchoHandler)
+	r.Post("/i/{hash}.{ext}", unlockEchoHandler)
+
+	r.Get("/p/{hash}", pasteViewHandler)
+	r.Post("/p/{hash}", unlockEchoHandler)
+
+	r.Get("/d/{hash}/{secret}", viewDeletionHandler)
+	r.Post("/d/{hash}/{secret}", deletionHandler)
+
+	r.Get("/s/{hash}", redirectHandler)
+	r.Post("/s/{hash}", unlockEchoHandler)
+
+	// short links also resolve below the root, anything else falls through to
+	// the static files
+	r.Get("/{hash}", rootRedirectHandler(fs))
+	r.Post("/{hash}", unlockEchoHandler)
 
 	addr := config.Addr()
 
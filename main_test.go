@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+)
+
+// setupTest points the globals at a fresh config and database inside a
+// temporary working directory. configure may adjust the defaults before
+// they are validated.
+func setupTest(t *testing.T, configure func(cfg *EchoConfig)) {
+	t.Helper()
+
+	t.Chdir(t.TempDir())
+
+	cfg := NewDefaultConfig()
+
+	if configure != nil {
+		configure(&cfg)
+	}
+
+	err := cfg.Validate()
+	if err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+
+	config = &cfg
+
+	database, err = ConnectToDatabase()
+	if err != nil {
+		t.Fatalf("failed to connect to database: %v", err)
+	}
+
+	t.Cleanup(func() {
+		database.Close()
+	})
+}
@@ -0,0 +1,838 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	OIDCStateCookie     = "echo_vault_oidc"
+	OIDCStateDuration   = 10 * time.Minute
+	OIDCClockSkew       = time.Minute
+	OIDCRefreshInterval = time.Minute
+
+	// dashboard logins get every scope but admin, which is granted by group
+	OIDCScopes = ScopeUpload | ScopeRead | ScopeFavorite | ScopeDelete
+)
+
+type OIDCDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type OIDCKey struct {
+	ID  string
+	Key crypto.PublicKey
+}
+
+type OIDCProvider struct {
+	mx sync.Mutex
+
+	client    *http.Client
+	discovery *OIDCDiscovery
+	keys      []OIDCKey
+	fetched   time.Time
+}
+
+type OIDCState struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Expires  int64  `json:"expires"`
+}
+
+type OIDCIdentity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Username      string
+	Groups        []string
+}
+
+var oidc *OIDCProvider
+
+func NewOIDCProvider() *OIDCProvider {
+	return &OIDCProvider{
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+	}
+}
+
+func (p *OIDCProvider) getJSON(ctx context.Context, target string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: unexpected status %d", target, resp.StatusCode)
+	}
+
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// Discover loads the provider metadata on first use, so an unreachable
+// identity provider does not keep echo-vault from starting.
+func (p *OIDCProvider) Discover(ctx context.Context) (*OIDCDiscovery, error) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	var discovery OIDCDiscovery
+
+	err := p.getJSON(ctx, strings.TrimSuffix(config.OIDC.Issuer, "/")+"/.well-known/openid-configuration", &discovery)
+	if err != nil {
+		return nil, err
+	}
+
+	if discovery.Issuer != config.OIDC.Issuer {
+		return nil, fmt.Errorf("issuer mismatch: configured %q, provider reports %q", config.OIDC.Issuer, discovery.Issuer)
+	}
+
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, errors.New("incomplete provider metadata")
+	}
+
+	p.discovery = &discovery
+
+	return p.discovery, nil
+}
+
+// Keys returns the signing keys matching kid. The key set is refetched (at
+// most once per OIDCRefreshInterval) when no key matches or refresh is set,
+// so rotated keys are picked up.
+func (p *OIDCProvider) Keys(ctx context.Context, discovery *OIDCDiscovery, kid string, refresh bool) ([]crypto.PublicKey, error) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	keys := p.matchKeys(kid)
+
+	if (refresh || len(keys) == 0) && time.Since(p.fetched) >= OIDCRefreshInterval {
+		var set struct {
+			Keys []json.RawMessage `json:"keys"`
+		}
+
+		err := p.getJSON(ctx, discovery.JWKSURI, &set)
+		if err != nil {
+			return nil, err
+		}
+
+		p.keys = p.keys[:0]
+		p.fetched = time.Now()
+
+		for _, raw := range set.Keys {
+			key, err := parseJWK(raw)
+			if err != nil {
+				log.Warnf("oidc: skipping signing key: %v\n", err)
+
+				continue
+			}
+
+			p.keys = append(p.keys, *key)
+		}
+
+		keys = p.matchKeys(kid)
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no signing key matching %q", kid)
+	}
+
+	return keys, nil
+}
+
+func (p *OIDCProvider) matchKeys(kid string) []crypto.PublicKey {
+	var keys []crypto.PublicKey
+
+	for _, key := range p.keys {
+		if kid == "" || key.ID == "" || key.ID == kid {
+			keys = append(keys, key.Key)
+		}
+	}
+
+	return keys
+}
+
+func parseJWK(raw json.RawMessage) (*OIDCKey, error) {
+	var jwk struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Use string `json:"use"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+		Crv string `json:"crv"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	}
+
+	err := json.Unmarshal(raw, &jwk)
+	if err != nil {
+		return nil, err
+	}
+
+	if jwk.Use != "" && jwk.Use != "sig" {
+		return nil, fmt.Errorf("key %q is not a signing key", jwk.Kid)
+	}
+
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+
+		if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("key %q has an invalid exponent", jwk.Kid)
+		}
+
+		return &OIDCKey{
+			ID: jwk.Kid,
+			Key: &rsa.PublicKey{
+				N: n,
+				E: int(e.Int64()),
+			},
+		}, nil
+	case "EC":
+		var curve elliptic.Curve
+
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("key %q uses unsupported curve %q", jwk.Kid, jwk.Crv)
+		}
+
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		return &OIDCKey{
+			ID: jwk.Kid,
+			Key: &ecdsa.PublicKey{
+				Curve: curve,
+				X:     x,
+				Y:     y,
+			},
+		}, nil
+	}
+
+	return nil, fmt.Errorf("key %q has unsupported type %q", jwk.Kid, jwk.Kty)
+}
+
+func decodeBigInt(raw string) (*big.Int, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	return new(big.Int).SetBytes(buf), nil
+}
+
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed, sig []byte) bool {
+	var hash crypto.Hash
+
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return false
+	}
+
+	h := hash.New()
+
+	h.Write(signed)
+
+	digest := h.Sum(nil)
+
+	switch alg[:2] {
+	case "RS":
+		pub, ok := key.(*rsa.PublicKey)
+
+		return ok && rsa.VerifyPKCS1v15(pub, hash, digest, sig) == nil
+	case "PS":
+		pub, ok := key.(*rsa.PublicKey)
+
+		return ok && rsa.VerifyPSS(pub, hash, digest, sig, nil) == nil
+	case "ES":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return false
+		}
+
+		size := (pub.Curve.Params().BitSize + 7) / 8
+
+		if len(sig) != 2*size {
+			return false
+		}
+
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+
+		return ecdsa.Verify(pub, digest, r, s)
+	}
+
+	return false
+}
+
+// VerifyIDToken checks the signature and standard claims of an ID token
+// and returns the identity it describes.
+func (p *OIDCProvider) VerifyIDToken(ctx context.Context, discovery *OIDCDiscovery, raw, nonce string) (*OIDCIdentity, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed id token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+
+	buf, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(buf, &header)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(header.Alg) != 5 {
+		return nil, fmt.Errorf("unsupported signing algorithm %q", header.Alg)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+
+	var valid bool
+
+	for _, refresh := range []bool{false, true} {
+		keys, err := p.Keys(ctx, discovery, header.Kid, refresh)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key := range keys {
+			if verifyJWTSignature(header.Alg, key, signed, sig) {
+				valid = true
+
+				break
+			}
+		}
+
+		if valid {
+			break
+		}
+	}
+
+	if !valid {
+		return nil, errors.New("invalid id token signature")
+	}
+
+	buf, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+
+	var claims map[string]any
+
+	err = json.Unmarshal(buf, &claims)
+	if err != nil {
+		return nil, err
+	}
+
+	if iss, _ := claims["iss"].(string); iss != discovery.Issuer {
+		return nil, fmt.Errorf("unexpected issuer %q", iss)
+	}
+
+	audience := claimStrings(claims["aud"])
+
+	if !slices.Contains(audience, config.OIDC.ClientID) {
+		return nil, errors.New("id token was not issued for this client")
+	}
+
+	if azp, ok := claims["azp"].(string); ok && azp != config.OIDC.ClientID {
+		return nil, fmt.Errorf("unexpected authorized party %q", azp)
+	}
+
+	now := time.Now()
+
+	exp, _ := claims["exp"].(float64)
+	if now.Add(-OIDCClockSkew).Unix() > int64(exp) {
+		return nil, errors.New("id token expired")
+	}
+
+	if iat, ok := claims["iat"].(float64); ok && now.Add(OIDCClockSkew).Unix() < int64(iat) {
+		return nil, errors.New("id token issued in the future")
+	}
+
+	if got, _ := claims["nonce"].(string); subtle.ConstantTimeCompare([]byte(got), []byte(nonce)) != 1 {
+		return nil, errors.New("nonce mismatch")
+	}
+
+	identity := &OIDCIdentity{
+		Groups: claimStrings(claims[config.OIDC.GroupsClaim]),
+	}
+
+	identity.Subject, _ = claims["sub"].(string)
+	identity.Email, _ = claims["email"].(string)
+	identity.Username, _ = claims["preferred_username"].(string)
+
+	switch verified := claims["email_verified"].(type) {
+	case bool:
+		identity.EmailVerified = verified
+	case string:
+		identity.EmailVerified, _ = strconv.ParseBool(verified)
+	}
+
+	if identity.Subject == "" {
+		return nil, errors.New("id token has no subject")
+	}
+
+	return identity, nil
+}
+
+// claimStrings accepts both a single string and an array of strings, since
+// providers disagree on how to encode aud and group claims.
+func claimStrings(value any) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []any:
+		list := make([]string, 0, len(v))
+
+		for _, entry := range v {
+			if str, ok := entry.(string); ok {
+				list = append(list, str)
+			}
+		}
+
+		return list
+	}
+
+	return nil
+}
+
+func (p *OIDCProvider) Exchange(ctx context.Context, discovery *OIDCDiscovery, code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {oidcRedirectURL()},
+		"code_verifier": {verifier},
+		"client_id":     {config.OIDC.ClientID},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	if config.OIDC.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(config.OIDC.ClientID), url.QueryEscape(config.OIDC.ClientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+
+	defer resp.Body.Close()
+
+	var result struct {
+		IDToken     string `json:"id_token"`
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+
+	err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&result)
+	if err != nil {
+		return "", fmt.Errorf("token endpoint: status %d: %v", resp.StatusCode, err)
+	}
+
+	if result.Error != "" {
+		return "", fmt.Errorf("token endpoint: %s: %s", result.Error, result.Description)
+	}
+
+	if result.IDToken == "" {
+		return "", errors.New("token endpoint returned no id token")
+	}
+
+	return result.IDToken, nil
+}
+
+func oidcRedirectURL() string {
+	return config.Server.URL + "login/oidc/callback"
+}
+
+func randomString(n int) (string, error) {
+	buf := make([]byte, n)
+
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func setOIDCState(w http.ResponseWriter, state *OIDCState) error {
+	buf, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(buf)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     OIDCStateCookie,
+		Value:    payload + "." + signPayload("oidc:"+payload),
+		Path:     "/login/oidc",
+		MaxAge:   int(OIDCStateDuration.Seconds()),
+		HttpOnly: true,
+		Secure:   config.IsSecure(),
+		// Lax, the callback is a top-level navigation from the provider
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return nil
+}
+
+func readOIDCState(w http.ResponseWriter, r *http.Request) (*OIDCState, error) {
+	cookie, err := r.Cookie(OIDCStateCookie)
+	if err != nil {
+		return nil, errors.New("missing state cookie")
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     OIDCStateCookie,
+		Path:     "/login/oidc",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   config.IsSecure(),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	payload, sig, ok := strings.Cut(cookie.Value, ".")
+	if !ok || !verifyPayload("oidc:"+payload, sig) {
+		return nil, errors.New("invalid state cookie")
+	}
+
+	buf, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var state OIDCState
+
+	err = json.Unmarshal(buf, &state)
+	if err != nil {
+		return nil, err
+	}
+
+	if time.Now().Unix() > state.Expires {
+		return nil, errors.New("login attempt expired")
+	}
+
+	return &state, nil
+}
+
+func (d *EchoDatabase) FindUserBySubject(ctx context.Context, subject string) (*User, error) {
+	return scanUser(d.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE subject = ? LIMIT 1", subject))
+}
+
+func (d *EchoDatabase) LinkUser(ctx context.Context, id int64, subject string) error {
+	_, err := d.ExecContext(ctx, "UPDATE users SET subject = ? WHERE id = ?", subject, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (d *EchoDatabase) SetUserAdmin(ctx context.Context, id int64, admin bool) error {
+	_, err := d.ExecContext(ctx, "UPDATE users SET admin = ? WHERE id = ?", admin, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// resolveOIDCUser maps an identity to a user. Known subjects are matched
+// directly, otherwise the user is created (or an existing, unlinked user
+// with the same verified email is linked).
+func resolveOIDCUser(ctx context.Context, identity *OIDCIdentity) (*User, error) {
+	user, err := database.FindUserBySubject(ctx, identity.Subject)
+	if err != nil {
+		return nil, err
+	}
+
+	if user == nil {
+		name := identity.Email
+
+		if name == "" {
+			name = identity.Username
+		}
+
+		if name == "" {
+			name = identity.Subject
+		}
+
+		user, err = database.FindUserByName(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+
+		if user != nil {
+			if user.Subject != "" || name != identity.Email || !identity.EmailVerified {
+				return nil, fmt.Errorf("user %q already exists and cannot be linked", name)
+			}
+		} else {
+			user, err = database.CreateUser(ctx, name, false)
+			if err != nil {
+				return nil, err
+			}
+
+			log.Printf("oidc: created user #%d %q\n", user.ID, user.Name)
+		}
+
+		err = database.LinkUser(ctx, user.ID, identity.Subject)
+		if err != nil {
+			return nil, err
+		}
+
+		user.Subject = identity.Subject
+	}
+
+	if len(config.OIDC.AdminGroups) > 0 {
+		admin := config.OIDC.IsAdmin(identity.Groups)
+
+		if admin != user.Admin {
+			err = database.SetUserAdmin(ctx, user.ID, admin)
+			if err != nil {
+				return nil, err
+			}
+
+			user.Admin = admin
+		}
+	}
+
+	return user, nil
+}
+
+func oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	discovery, err := oidc.Discover(r.Context())
+	if err != nil {
+		abort(w, http.StatusBadGateway, "identity provider unavailable")
+
+		log.Warnln("oidc: discovery failed")
+		log.Warnln(err)
+
+		return
+	}
+
+	state := &OIDCState{
+		Expires: time.Now().Add(OIDCStateDuration).Unix(),
+	}
+
+	for _, dest := range []*string{&state.State, &state.Nonce, &state.Verifier} {
+		*dest, err = randomString(32)
+		if err != nil {
+			abort(w, http.StatusInternalServerError, "failed to start login")
+
+			log.Warnln("oidc: failed to generate state")
+			log.Warnln(err)
+
+			return
+		}
+	}
+
+	err = setOIDCState(w, state)
+	if err != nil {
+		abort(w, http.StatusInternalServerError, "failed to start login")
+
+		log.Warnln("oidc: failed to store state")
+		log.Warnln(err)
+
+		return
+	}
+
+	challenge := sha256.Sum256([]byte(state.Verifier))
+
+	target, err := url.Parse(discovery.AuthorizationEndpoint)
+	if err != nil {
+		abort(w, http.StatusBadGateway, "identity provider unavailable")
+
+		log.Warnln("oidc: invalid authorization endpoint")
+		log.Warnln(err)
+
+		return
+	}
+
+	query := target.Query()
+
+	query.Set("response_type", "code")
+	query.Set("client_id", config.OIDC.ClientID)
+	query.Set("redirect_uri", oidcRedirectURL())
+	query.Set("scope", strings.Join(config.OIDC.Scopes, " "))
+	query.Set("state", state.State)
+	query.Set("nonce", state.Nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+
+	target.RawQuery = query.Encode()
+
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+func oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	fail := func(message string, err error) {
+		log.Warnf("oidc: %s\n", message)
+
+		if err != nil {
+			log.Warnln(err)
+		}
+
+		http.Redirect(w, r, "/?sso=failed", http.StatusSeeOther)
+	}
+
+	query := r.URL.Query()
+
+	state, err := readOIDCState(w, r)
+	if err != nil {
+		fail("invalid login state", err)
+
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(state.State)) != 1 {
+		fail("state mismatch", nil)
+
+		return
+	}
+
+	if reason := query.Get("error"); reason != "" {
+		fail("provider returned "+reason+": "+query.Get("error_description"), nil)
+
+		return
+	}
+
+	code := query.Get("code")
+	if code == "" {
+		fail("missing authorization code", nil)
+
+		return
+	}
+
+	discovery, err := oidc.Discover(r.Context())
+	if err != nil {
+		fail("discovery failed", err)
+
+		return
+	}
+
+	raw, err := oidc.Exchange(r.Context(), discovery, code, state.Verifier)
+	if err != nil {
+		fail("code exchange failed", err)
+
+		return
+	}
+
+	identity, err := oidc.VerifyIDToken(r.Context(), discovery, raw, state.Nonce)
+	if err != nil {
+		fail("invalid id token", err)
+
+		return
+	}
+
+	if !config.OIDC.IsAllowed(identity.Groups) {
+		fail(fmt.Sprintf("subject %q is not in an allowed group", identity.Subject), nil)
+
+		return
+	}
+
+	user, err := resolveOIDCUser(r.Context(), identity)
+	if err != nil {
+		fail("failed to resolve user", err)
+
+		return
+	}
+
+	scopes := OIDCScopes
+
+	if user.Admin {
+		scopes |= ScopeAdmin
+	}
+
+	err = startSession(w, r, 0, user.ID, scopes)
+	if err != nil {
+		fail("failed to create session", err)
+
+		return
+	}
+
+	audit(r, &Caller{User: user, Scopes: scopes}, AuditLogin, "", "oidc")
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
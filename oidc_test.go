@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testClientID = "echo-vault"
+
+// mockIdP is a minimal identity provider serving discovery, a key set and a
+// token endpoint that hands out whatever token is set.
+type mockIdP struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	token  string
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	t.Helper()
+
+	idp := &mockIdP{
+		key: generateTestKey(t),
+	}
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(OIDCDiscovery{
+			Issuer:                idp.server.URL,
+			AuthorizationEndpoint: idp.server.URL + "/authorize",
+			TokenEndpoint:         idp.server.URL + "/token",
+			JWKSURI:               idp.server.URL + "/jwks",
+		})
+	})
+
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		pub := idp.key.PublicKey
+
+		json.NewEncoder(w).Encode(map[string]any{
+			"keys": []map[string]string{
+				{
+					"kty": "RSA",
+					"kid": "test",
+					"use": "sig",
+					"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+					"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+				},
+			},
+		})
+	})
+
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"id_token": idp.token,
+		})
+	})
+
+	idp.server = httptest.NewServer(mux)
+
+	t.Cleanup(idp.server.Close)
+
+	return idp
+}
+
+func generateTestKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	return key
+}
+
+// claims returns valid id token claims for subject, modify them to break
+// a single check.
+func (m *mockIdP) claims(subject, nonce string) map[string]any {
+	now := time.Now()
+
+	return map[string]any{
+		"iss":            m.server.URL,
+		"aud":            testClientID,
+		"sub":            subject,
+		"iat":            now.Unix(),
+		"exp":            now.Add(5 * time.Minute).Unix(),
+		"nonce":          nonce,
+		"email":          subject + "@example.com",
+		"email_verified": true,
+	}
+}
+
+func signTestToken(t *testing.T, key *rsa.PrivateKey, claims map[string]any) string {
+	t.Helper()
+
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","kid":"test","typ":"JWT"}`))
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("failed to encode claims: %v", err)
+	}
+
+	signed := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	digest := sha256.Sum256([]byte(signed))
+
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func setupOIDC(t *testing.T) *mockIdP {
+	t.Helper()
+
+	idp := newMockIdP(t)
+
+	setupTest(t, func(cfg *EchoConfig) {
+		cfg.OIDC.Enabled = true
+		cfg.OIDC.Issuer = idp.server.URL
+		cfg.OIDC.ClientID = testClientID
+	})
+
+	oidc = NewOIDCProvider()
+
+	return idp
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	idp := setupOIDC(t)
+
+	discovery, err := oidc.Discover(context.Background())
+	if err != nil {
+		t.Fatalf("discovery failed: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		key   *rsa.PrivateKey
+		nonce string
+		claim func(claims map[string]any)
+		valid bool
+	}{
+		{name: "valid", valid: true},
+		{name: "bad signature", key: generateTestKey(t)},
+		{name: "wrong audience", claim: func(claims map[string]any) { claims["aud"] = "someone-else" }},
+		{name: "wrong issuer", claim: func(claims map[string]any) { claims["iss"] = "https://evil.example.com" }},
+		{name: "wrong authorized party", claim: func(claims map[string]any) { claims["azp"] = "someone-else" }},
+		{name: "nonce mismatch", nonce: "other-nonce"},
+		{name: "expired", claim: func(claims map[string]any) { claims["exp"] = time.Now().Add(-time.Hour).Unix() }},
+		{name: "missing subject", claim: func(claims map[string]any) { delete(claims, "sub") }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims := idp.claims("alice", "nonce")
+
+			if test.claim != nil {
+				test.claim(claims)
+			}
+
+			key := idp.key
+
+			if test.key != nil {
+				key = test.key
+			}
+
+			nonce := "nonce"
+
+			if test.nonce != "" {
+				nonce = test.nonce
+			}
+
+			identity, err := oidc.VerifyIDToken(context.Background(), discovery, signTestToken(t, key, claims), nonce)
+
+			if test.valid {
+				if err != nil {
+					t.Fatalf("expected a valid token, got %v", err)
+				}
+
+				if identity.Subject != "alice" || identity.Email != "alice@example.com" || !identity.EmailVerified {
+					t.Fatalf("unexpected identity %+v", identity)
+				}
+
+				return
+			}
+
+			if err == nil {
+				t.Fatal("expected the token to be rejected")
+			}
+		})
+	}
+}
+
+// runCallback completes a login attempt with nonce "nonce", the token
+// endpoint answering with token.
+func runCallback(t *testing.T, idp *mockIdP, token string) *http.Response {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+
+	err := setOIDCState(rec, &OIDCState{
+		State:    "state",
+		Nonce:    "nonce",
+		Verifier: "verifier",
+		Expires:  time.Now().Add(OIDCStateDuration).Unix(),
+	})
+	if err != nil {
+		t.Fatalf("failed to set state: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/login/oidc/callback?state=state&code=code", nil)
+
+	for _, cookie := range rec.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+
+	idp.token = token
+
+	rec = httptest.NewRecorder()
+
+	oidcCallbackHandler(rec, req)
+
+	return rec.Result()
+}
+
+func hasSessionCookie(resp *http.Response) bool {
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == SessionCookie && cookie.Value != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestOIDCCallback(t *testing.T) {
+	idp := setupOIDC(t)
+
+	tests := []struct {
+		name  string
+		key   *rsa.PrivateKey
+		claim func(claims map[string]any)
+		valid bool
+	}{
+		{name: "valid", valid: true},
+		{name: "bad signature", key: generateTestKey(t)},
+		{name: "wrong audience", claim: func(claims map[string]any) { claims["aud"] = []string{"someone-else"} }},
+		{name: "wrong issuer", claim: func(claims map[string]any) { claims["iss"] = "https://evil.example.com" }},
+		{name: "nonce mismatch", claim: func(claims map[string]any) { claims["nonce"] = "replayed" }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims := idp.claims("bob", "nonce")
+
+			if test.claim != nil {
+				test.claim(claims)
+			}
+
+			key := idp.key
+
+			if test.key != nil {
+				key = test.key
+			}
+
+			resp := runCallback(t, idp, signTestToken(t, key, claims))
+
+			location := resp.Header.Get("Location")
+
+			if test.valid {
+				if location != "/" || !hasSessionCookie(resp) {
+					t.Fatalf("expected a session and a redirect to /, got %q", location)
+				}
+
+				return
+			}
+
+			if location != "/?sso=failed" || hasSessionCookie(resp) {
+				t.Fatalf("expected a failed login, got %q", location)
+			}
+		})
+	}
+}
+
+func TestOIDCStateMismatch(t *testing.T) {
+	idp := setupOIDC(t)
+
+	rec := httptest.NewRecorder()
+
+	err := setOIDCState(rec, &OIDCState{
+		State:   "state",
+		Nonce:   "nonce",
+		Expires: time.Now().Add(OIDCStateDuration).Unix(),
+	})
+	if err != nil {
+		t.Fatalf("failed to set state: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/login/oidc/callback?state=forged&code=code", nil)
+
+	for _, cookie := range rec.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+
+	idp.token = signTestToken(t, idp.key, idp.claims("carol", "nonce"))
+
+	rec = httptest.NewRecorder()
+
+	oidcCallbackHandler(rec, req)
+
+	if location := rec.Result().Header.Get("Location"); !strings.HasSuffix(location, "sso=failed") {
+		t.Fatalf("expected a failed login, got %q", location)
+	}
+}
+
+func TestResolveOIDCUserLinking(t *testing.T) {
+	idp := setupOIDC(t)
+
+	ctx := context.Background()
+
+	existing, err := database.CreateUser(ctx, "dave@example.com", false)
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+
+	// an unverified email must not take over the existing account
+	claims := idp.claims("dave", "nonce")
+
+	claims["email_verified"] = false
+
+	resp := runCallback(t, idp, signTestToken(t, idp.key, claims))
+
+	if location := resp.Header.Get("Location"); location != "/?sso=failed" || hasSessionCookie(resp) {
+		t.Fatalf("expected unverified email to be refused, got %q", location)
+	}
+
+	_, err = resolveOIDCUser(ctx, &OIDCIdentity{
+		Subject:       "dave",
+		Email:         "dave@example.com",
+		EmailVerified: false,
+	})
+	if err == nil {
+		t.Fatal("expected unverified email to be refused")
+	}
+
+	user, err := database.FindUserByName(ctx, "dave@example.com")
+	if err != nil {
+		t.Fatalf("failed to find user: %v", err)
+	}
+
+	if user.Subject != "" {
+		t.Fatalf("user was linked to %q", user.Subject)
+	}
+
+	// a verified email links the account once
+	user, err = resolveOIDCUser(ctx, &OIDCIdentity{
+		Subject:       "dave",
+		Email:         "dave@example.com",
+		EmailVerified: true,
+	})
+	if err != nil {
+		t.Fatalf("expected verified email to link, got %v", err)
+	}
+
+	if user.ID != existing.ID || user.Subject != "dave" {
+		t.Fatalf("expected user #%d linked to dave, got #%d %q", existing.ID, user.ID, user.Subject)
+	}
+
+	// a different subject can't claim the linked account
+	_, err = resolveOIDCUser(ctx, &OIDCIdentity{
+		Subject:       "mallory",
+		Email:         "dave@example.com",
+		EmailVerified: true,
+	})
+	if err == nil {
+		t.Fatal("expected a linked user to be refused for another subject")
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	PasswordIterations = 600_000
+	PasswordMaxLength  = 256
+	UnlockDuration     = time.Hour
+	UnlockCookiePrefix = "echo_unlock_"
+)
+
+type PasswordRequest struct {
+	Password string `json:"password"`
+}
+
+var unlockTemplate = template.Must(template.New("unlock").Parse(`<!DOCTYPE html>
+<html lang="en">
+	<head>
+		<meta charset="UTF-8" />
+		<meta name="viewport" content="width=device-width, initial-scale=1.0" />
+		<meta name="robots" content="noindex, nofollow" />
+		<title>Protected Echo</title>
+		<style>
+			body { margin: 0; min-height: 100vh; display: flex; align-items: center; justify-content: center; background: #111; color: #ddd; font-family: monospace; }
+			form { display: flex; flex-direction: column; gap: 12px; width: 280px; padding: 24px; border: 1px solid #333; background: #181818; }
+			input, button { padding: 10px; border: 1px solid #333; background: #111; color: #ddd; font-family: inherit; }
+			button { cursor: pointer; }
+			.error { color: #e55; }
+		</style>
+	</head>
+	<body>
+		<form method="POST">
+			<div>// PROTECTED_ECHO</div>
+			<input type="password" name="password" placeholder="Enter Password" required autofocus autocomplete="off" />
+			<button type="submit">UNLOCK</button>
+			{{if .}}<div class="error">{{.}}</div>{{end}}
+		</form>
+	</body>
+</html>`))
+
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+
+	key, err := pbkdf2.Key(sha256.New, password, salt, PasswordIterations, 32)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", PasswordIterations, base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func verifyPassword(encoded, password string) bool {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return false
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+
+	expected, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+
+	key, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(expected))
+	if err != nil {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare(key, expected) == 1
+}
+
+func (e *Echo) IsProtected() bool {
+	return e.Password != ""
+}
+
+func unlockCookieName(hash string) string {
+	return UnlockCookiePrefix + hash
+}
+
+func isUnlocked(r *http.Request, echo *Echo) bool {
+	cookie, err := r.Cookie(unlockCookieName(echo.Hash))
+	if err != nil {
+		return false
+	}
+
+	rawExp, sig, ok := strings.Cut(cookie.Value, ".")
+	if !ok {
+		return false
+	}
+
+	exp, err := strconv.ParseInt(rawExp, 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return false
+	}
+
+	return verifyPayload(fmt.Sprintf("unlock:%s:%s:%d", echo.Hash, echo.Password, exp), sig)
+}
+
+func setUnlockCookie(w http.ResponseWriter, echo *Echo) {
+	expires := time.Now().Add(UnlockDuration)
+	exp := expires.Unix()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     unlockCookieName(echo.Hash),
+		Value:    fmt.Sprintf("%d.%s", exp, signPayload(fmt.Sprintf("unlock:%s:%s:%d", echo.Hash, echo.Password, exp))),
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   config.IsSecure(),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func renderUnlockPage(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Header().Set("X-Robots-Tag", "noindex, nofollow")
+
+	w.WriteHeader(status)
+
+	unlockTemplate.Execute(w, message)
+}
+
+// readPasswordPart reads a small multipart form value.
+func readPasswordPart(r io.Reader) (string, error) {
+	buf, err := io.ReadAll(io.LimitReader(r, PasswordMaxLength+1))
+	if err != nil {
+		return "", err
+	}
+
+	if len(buf) > PasswordMaxLength {
+		return "", fmt.Errorf("password exceeds %d bytes", PasswordMaxLength)
+	}
+
+	return string(buf), nil
+}
+
+func (d *EchoDatabase) SetPassword(hash, password string) error {
+	_, err := d.Exec("UPDATE echos SET password = ? WHERE hash = ?", password, hash)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func unlockEchoHandler(w http.ResponseWriter, r *http.Request) {
+	hash := chi.URLParam(r, "hash")
+	if !validateHash(hash) {
+		abort(w, http.StatusBadRequest, "invalid hash format")
+
+		log.Warnln("unlock: invalid hash")
+
+		return
+	}
+
+	echo, err := database.Find(r.Context(), hash)
+	if err != nil {
+		abort(w, http.StatusInternalServerError, "database error")
+
+		log.Warnln("unlock: failed to find echo")
+		log.Warnln(err)
+
+		return
+	}
+
+	// the highlighted view of pastes has no extension in its path
+	ext := chi.URLParam(r, "ext")
+
+	if echo == nil || (ext != "" && echo.Extension != ext) || !echo.IsProtected() {
+		abort(w, http.StatusNotFound, "echo not found")
+
+		return
+	}
+
+	ip := clientIP(r)
+
+	if limits != nil {
+		if wait := limits.Locked(ip); wait > 0 {
+			tooManyRequests(w, wait, "too many failed attempts")
+
+			return
+		}
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, 4096)
+
+	if !verifyPassword(echo.Password, r.PostFormValue("password")) {
+		if limits != nil {
+			limits.Fail(ip)
+		}
+
+		renderUnlockPage(w, http.StatusUnauthorized, "Wrong password")
+
+		return
+	}
+
+	setUnlockCookie(w, echo)
+
+	http.Redirect(w, r, r.URL.RequestURI(), http.StatusSeeOther)
+}
+
+func setPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	hash := chi.URLParam(r, "hash")
+	if !validateHash(hash) {
+		abort(w, http.StatusBadRequest, "invalid hash format")
+
+		log.Warnln("password: invalid hash")
+
+		return
+	}
+
+	var request PasswordRequest
+
+	err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&request)
+	if err != nil {
+		abort(w, http.StatusBadRequest, "invalid request body")
+
+		log.Warnln("password: invalid request body")
+		log.Warnln(err)
+
+		return
+	}
+
+	if len(request.Password) > PasswordMaxLength {
+		abort(w, http.StatusBadRequest, "password too long")
+
+		log.Warnln("password: password too long")
+
+		return
+	}
+
+	echo, err := database.Find(r.Context(), hash)
+	if err != nil {
+		abort(w, http.StatusInternalServerError, "database error")
+
+		log.Warnln("password: failed to find echo")
+		log.Warnln(err)
+
+		return
+	}
+
+	if !getCaller(r).CanAccess(echo) {
+		abort(w, http.StatusNotFound, "echo not found")
+
+		log.Warnf("password: echo %q not found\n", hash)
+
+		return
+	}
+
+	var encoded string
+
+	if request.Password != "" {
+		encoded, err = hashPassword(request.Password)
+		if err != nil {
+			abort(w, http.StatusInternalServerError, "failed to hash password")
+
+			log.Warnln("password: failed to hash password")
+			log.Warnln(err)
+
+			return
+		}
+	}
+
+	err = database.SetPassword(hash, encoded)
+	if err != nil {
+		abort(w, http.StatusInternalServerError, "database error")
+
+		log.Warnln("password: failed to update echo")
+		log.Warnln(err)
+
+		return
+	}
+
+	echo.Password = encoded
+
+	hub.BroadcastUpdate(echo)
+
+	detail := "cleared"
+
+	if echo.IsProtected() {
+		detail = "set"
+	}
+
+	audit(r, getCaller(r), AuditPassword, echo.Hash, detail)
+
+	okay(w, "application/json")
+
+	json.NewEncoder(w).Encode(map[string]any{
+		"protected": echo.IsProtected(),
+	})
+}
@@ -1,7 +1,10 @@
 (() => {
-	const StorageKey = "echo_vault_token",
+	const LegacyTokenKey = "echo_vault_token",
 		VolumeKey = "echo_vault_volume",
+		ImageExtensions = ["webp", "png", "jpeg", "gif"],
+		LinkExtension = "url",
 		VideoExtensions = ["mp4", "webm", "mov", "m4v", "mkv"],
+		TextPreviewLines = 40,
 		Resolutions = [
 			[4320, "8K"],
 			[2880, "5K"],
@@ -29,6 +32,7 @@
 		$loginForm = document.getElementById("login-form"),
 		$apiToken = document.getElementById("api-token"),
 		$loginError = document.getElementById("login-error"),
+		$ssoLogin = document.getElementById("sso-login"),
 		$gallery = document.getElementById("gallery"),
 		$emptyState = document.getElementById("empty-state"),
 		$loader = document.getElementById("loader"),
@@ -43,19 +47,35 @@
 		$totalCount = document.getElementById("total-count"),
 		$versionTags = document.querySelectorAll(".version-tag"),
 		$modalViewContent = $modalView.querySelector(".modal-content"),
-		$modalViewBackdrop = $modalView.querySelector(".modal-backdrop");
+		$modalViewBackdrop = $modalView.querySelector(".modal-backdrop"),
+		$pasteBtn = document.getElementById("paste-btn"),
+		$pasteModal = document.getElementById("modal-paste"),
+		$pasteModalBackdrop = $pasteModal.querySelector(".modal-backdrop"),
+		$pasteForm = document.getElementById("paste-form"),
+		$pasteContent = document.getElementById("paste-content"),
+		$pasteName = document.getElementById("paste-name"),
+		$pasteLanguage = document.getElementById("paste-language"),
+		$pasteLanguages = document.getElementById("paste-languages"),
+		$linkBtn = document.getElementById("link-btn"),
+		$linkModal = document.getElementById("modal-link"),
+		$linkModalBackdrop = $linkModal.querySelector(".modal-backdrop"),
+		$linkForm = document.getElementById("link-form"),
+		$linkUrl = document.getElementById("link-url");
 
 	let $notifyArea;
 
 	const State = {
 		alive: true,
-		token: localStorage.getItem(StorageKey),
+		authenticated: false,
 		volume: parseFloat(localStorage.getItem(VolumeKey)),
 		page: 1,
 		busy: 0,
 		hasMore: true,
 		query: "",
 		favorites: false,
+		texts: false,
+		shortener: false,
+		batch: 1,
 		cache: new Map(),
 		processing: new Map(),
 		stats: {
@@ -85,13 +105,14 @@
 
 		document.body.appendChild($notifyArea);
 
+		// tokens used to be kept in localStorage, sessions are cookie based now
+		localStorage.removeItem(LegacyTokenKey);
+
 		await fetchServerInfo();
 
-		if (State.token) {
-			verifyToken(State.token);
-		} else {
-			switchView("login");
-		}
+		await verifySession();
+
+		checkSsoResult();
 
 		setupEvents();
 	}
@@ -195,6 +216,9 @@
 
 	function createEchoNode(item) {
 		const isVideo = VideoExtensions.includes(item.extension),
+			isText = item.extension === "txt",
+			isLink = item.extension === LinkExtension,
+			isFile = isGenericFile(item),
 			isAnim = item.animated;
 
 		const card = document.createElement("div");
@@ -208,7 +232,7 @@
 
 		const link = document.createElement("a");
 
-		link.href = item.url;
+		link.href = item.target || item.view_url || item.url;
 		link.target = "_blank";
 		link.className = "echo-link";
 
@@ -238,7 +262,68 @@
 			link.appendChild(err);
 		};
 
-		if (isVideo) {
+		if (isLink) {
+			media = document.createElement("div");
+
+			media.className = "echo-media echo-url";
+
+			const clicks = document.createElement("div");
+
+			clicks.className = "link-clicks";
+
+			const target = document.createElement("div");
+
+			target.className = "link-target";
+			target.textContent = item.target;
+
+			media.append(clicks, target);
+
+			const badge = document.createElement("div");
+
+			badge.className = "type-badge";
+			badge.textContent = "LINK";
+
+			card.appendChild(badge);
+
+			onLoad();
+		} else if (isFile) {
+			media = document.createElement("div");
+
+			media.className = "echo-media echo-file";
+
+			const icon = document.createElement("div");
+
+			icon.className = "file-icon";
+			icon.textContent = item.extension.toUpperCase();
+
+			const name = document.createElement("div");
+
+			name.className = "file-name";
+			name.textContent = item.name;
+
+			media.append(icon, name);
+
+			onLoad();
+		} else if (isText) {
+			media = document.createElement("pre");
+
+			media.className = "echo-media echo-text";
+
+			const badge = document.createElement("div");
+
+			badge.className = "type-badge";
+			badge.textContent = (item.language || "text").toUpperCase();
+
+			card.appendChild(badge);
+
+			loadTextPreview(item.url)
+				.then(text => {
+					media.textContent = text;
+
+					onLoad();
+				})
+				.catch(onError);
+		} else if (isVideo) {
 			media = document.createElement("video");
 
 			media.className = "echo-media";
@@ -343,6 +428,7 @@
 		actions.append(
 			makeActionButton(item.hash, "FAVORITE", "favorite", "favorite"),
 			makeActionButton(item.hash, "COPY", "copy"),
+			makeActionButton(item.hash, "SHARE", "share"),
 			makeActionButton(item.hash, "DEL", "delete", "delete"),
 		);
 
@@ -365,6 +451,22 @@
 		return card;
 	}
 
+	function isGenericFile(item) {
+		return !ImageExtensions.includes(item.extension) && !VideoExtensions.includes(item.extension) && item.extension !== "txt" && item.extension !== LinkExtension;
+	}
+
+	async function loadTextPreview(url) {
+		const response = await fetch(url);
+
+		if (!response.ok) {
+			throw new Error(await parseResponseError(response));
+		}
+
+		const text = await response.text();
+
+		return text.split("\n").slice(0, TextPreviewLines).join("\n");
+	}
+
 	function createUploadingNode(file, uploadId) {
 		const isImage = file.type.startsWith("image/"),
 			isVideo = file.type.startsWith("video/");
@@ -562,7 +664,15 @@
 		const sizeSpan = node.querySelector(".meta-size");
 
 		if (sizeSpan) {
-			sizeSpan.textContent = `${formatBytes(item.upload_size)} 🡒 ${formatBytes(item.size)}`;
+			sizeSpan.textContent = item.extension === LinkExtension ? "SHORT_LINK" : `${formatBytes(item.upload_size)} 🡒 ${formatBytes(item.size)}`;
+		}
+
+		const clicks = node.querySelector(".link-clicks");
+
+		if (clicks) {
+			const count = item.clicks || 0;
+
+			clicks.textContent = `${count} ${count === 1 ? "CLICK" : "CLICKS"}`;
 		}
 	}
 
@@ -573,6 +683,32 @@
 			return;
 		}
 
+		// short links open their target, without counting a click
+		if (item.target) {
+			window.open(item.target, "_blank", "noopener");
+
+			return;
+		}
+
+		// pastes have a view of their own
+		if (item.view_url) {
+			window.open(item.view_url, "_blank", "noopener");
+
+			return;
+		}
+
+		// other files can only be downloaded
+		if (isGenericFile(item)) {
+			const link = document.createElement("a");
+
+			link.href = item.url;
+			link.download = item.name;
+
+			link.click();
+
+			return;
+		}
+
 		const isVideo = VideoExtensions.includes(item.extension);
 
 		$modalViewContent.innerHTML = "";
@@ -628,8 +764,94 @@
 		$modalView.classList.remove("hidden");
 	}
 
+	function openPasteModal(text = "") {
+		if (text) {
+			$pasteContent.value = text;
+		}
+
+		$pasteModal.classList.remove("hidden");
+
+		$pasteContent.focus();
+	}
+
+	function submitPaste() {
+		const content = $pasteContent.value;
+
+		if (!content.trim()) {
+			return;
+		}
+
+		const file = new File([content], $pasteName.value.trim() || "paste.txt", {
+			type: "text/plain",
+		});
+
+		uploadBatch([file], $pasteLanguage.value.trim());
+
+		$pasteForm.reset();
+
+		closeModals();
+	}
+
+	function openLinkModal(url = "") {
+		if (url) {
+			$linkUrl.value = url;
+		}
+
+		$linkModal.classList.remove("hidden");
+
+		$linkUrl.focus();
+	}
+
+	async function submitLink() {
+		const url = $linkUrl.value.trim();
+
+		if (!url) {
+			return;
+		}
+
+		$linkForm.reset();
+
+		closeModals();
+
+		try {
+			const response = await fetchWithAuth("/shorten", {
+				method: "POST",
+				headers: {
+					"Content-Type": "application/json",
+				},
+				body: JSON.stringify({
+					url: url,
+				}),
+			});
+
+			if (!response.ok) {
+				throw new Error(await parseResponseError(response));
+			}
+
+			const data = await response.json();
+
+			if (!data?.echo) {
+				throw new Error("invalid response");
+			}
+
+			if (!State.query && !State.favorites) {
+				$emptyState.classList.add("hidden");
+
+				renderBatch(data.echo, "prepend");
+			}
+
+			await navigator.clipboard.writeText(data.echo.url).catch(() => {});
+
+			showNotification("Short link copied", "success");
+		} catch (err) {
+			showNotification(err.message, "error");
+		}
+	}
+
 	function closeModals() {
 		$modalView.classList.add("hidden");
+		$pasteModal.classList.add("hidden");
+		$linkModal.classList.add("hidden");
 
 		$modalViewContent.innerHTML = "";
 	}
@@ -650,35 +872,125 @@
 			if (data.queries) {
 				$searchWrapper.classList.remove("hidden");
 			}
+
+			if (data.texts) {
+				State.texts = true;
+
+				$pasteBtn.classList.remove("hidden");
+
+				$pasteLanguages.replaceChildren(
+					...(data.languages || []).map(language => {
+						const option = document.createElement("option");
+
+						option.value = language;
+
+						return option;
+					}),
+				);
+			}
+
+			if (data.shortener) {
+				State.shortener = true;
+
+				$linkBtn.classList.remove("hidden");
+			}
+
+			if (data.oidc) {
+				$ssoLogin.classList.remove("hidden");
+			}
+
+			if (data.batch > 0) {
+				State.batch = data.batch;
+			}
 		} catch (err) {
 			console.error(`Failed to fetch info: ${err}`);
 		}
 	}
 
-	async function verifyToken(token) {
+	async function verifySession() {
 		try {
-			const response = await fetchWithAuth("/verify", token);
+			const response = await fetchWithAuth("/verify");
 
 			if (response.status !== 200) {
 				throw new Error("Unauthorized");
 			}
 
-			State.token = token;
+			startDashboard();
+		} catch {
+			resetState(false);
+		}
+	}
+
+	function checkSsoResult() {
+		const params = new URLSearchParams(location.search);
+
+		if (!params.has("sso")) {
+			return;
+		}
+
+		history.replaceState(null, "", location.pathname);
+
+		if (params.get("sso") === "failed" && !State.authenticated) {
+			$loginError.textContent = "Single Sign-On Failed";
+			$loginError.classList.remove("hidden");
+		}
+	}
 
-			localStorage.setItem(StorageKey, token);
+	async function login(token) {
+		try {
+			const response = await fetchWithAuth("/login", {
+				method: "POST",
+				headers: {
+					"Content-Type": "application/json",
+				},
+				body: JSON.stringify({
+					token: token,
+				}),
+			});
 
-			switchView("dashboard");
+			if (response.status !== 200) {
+				throw new Error("Unauthorized");
+			}
 
-			loadEchos().then(setupSSE);
+			$apiToken.value = "";
+
+			startDashboard();
 		} catch {
-			logout(false);
+			resetState(false);
 
+			$loginError.textContent = "Invalid Token";
 			$loginError.classList.remove("hidden");
 		}
 	}
 
-	function logout(clearUi) {
-		State.token = null;
+	function startDashboard() {
+		State.authenticated = true;
+
+		$loginError.classList.add("hidden");
+
+		switchView("dashboard");
+
+		loadEchos().then(setupSSE);
+	}
+
+	async function logout() {
+		try {
+			await fetchWithAuth("/logout", {
+				method: "POST",
+			});
+		} catch (err) {
+			console.warn(`Logout failed: ${err}`);
+		}
+
+		resetState(true);
+	}
+
+	function resetState(clearUi) {
+		State.authenticated = false;
+
+		State.controllers.sse?.abort();
+		State.controllers.sse = null;
+
 		State.page = 1;
 		State.hasMore = true;
 		State.query = "";
@@ -688,8 +1000,6 @@
 		$searchInput.value = "";
 		$favoritesBtn.classList.remove("active");
 
-		localStorage.removeItem(StorageKey);
-
 		if (clearUi) {
 			$gallery.innerHTML = "";
 
@@ -727,7 +1037,7 @@
 				endpoint += `${endpoint.includes("?") ? "&" : "?"}favorites=1`;
 			}
 
-			const response = await fetchWithAuth(endpoint, null, {
+			const response = await fetchWithAuth(endpoint, {
 				signal: controller.signal,
 			});
 
@@ -770,21 +1080,35 @@
 		}
 	}
 
-	async function handleUpload(file) {
-		const uploadId = generateId();
+	function handleUploads(files) {
+		for (let i = 0; i < files.length; i += State.batch) {
+			uploadBatch(files.slice(i, i + State.batch));
+		}
+	}
 
-		const uploadingNode = createUploadingNode(file, uploadId);
+	async function uploadBatch(files, language = "") {
+		const uploads = files.map(file => ({
+			file: file,
+			id: generateId(),
+		}));
 
 		$emptyState.classList.add("hidden");
 
-		$gallery.prepend(uploadingNode);
-
 		const formData = new FormData();
 
-		formData.append("upload", file);
+		if (language) {
+			formData.append("language", language);
+		}
+
+		for (const { file, id } of uploads) {
+			$gallery.prepend(createUploadingNode(file, id));
+
+			formData.append("id", id);
+			formData.append("upload", file);
+		}
 
 		try {
-			const response = await fetchWithAuth(`/upload?id=${uploadId}`, null, {
+			const response = await fetchWithAuth("/upload", {
 				method: "POST",
 				body: formData,
 			});
@@ -799,29 +1123,39 @@
 				throw new Error("invalid response");
 			}
 
-			// Handle potentially multiple uploads in response, though typically one
-			const items = Array.isArray(data.echo) ? data.echo : [data.echo];
+			// single uploads respond with the result itself
+			const results = data.results || [data];
+
+			let uploaded = 0;
+
+			results.forEach((result, index) => {
+				const { id } = uploads[index];
 
-			if (items.length > 0) {
-				replaceUploadingNode(uploadId, items[0]);
+				if (result.error || !result.echo) {
+					removeUploadingNode(id);
 
-				if (items.length > 1) {
-					renderBatch(items.slice(1), "prepend");
+					showNotification(`${result.file}: ${result.error || "invalid response"}`, "error");
+
+					return;
 				}
-			} else {
-				removeUploadingNode(uploadId);
-			}
 
-			showNotification("Upload complete", "success");
-		} catch (err) {
-			removeUploadingNode(uploadId);
+				replaceUploadingNode(id, result.echo);
+
+				uploaded++;
+			});
 
-			if ($gallery.children.length === 0) {
-				$emptyState.classList.remove("hidden");
+			if (uploaded > 0) {
+				showNotification(uploaded > 1 ? `Uploaded ${uploaded} files` : "Upload complete", "success");
 			}
+		} catch (err) {
+			uploads.forEach(({ id }) => removeUploadingNode(id));
 
 			showNotification(err.message, "error");
 		}
+
+		if ($gallery.children.length === 0) {
+			$emptyState.classList.remove("hidden");
+		}
 	}
 
 	async function deleteEcho(hash, noConfirm) {
@@ -840,7 +1174,7 @@
 		node.classList.add("processing");
 
 		try {
-			const response = await fetchWithAuth(`/echos/${hash}`, null, {
+			const response = await fetchWithAuth(`/echos/${hash}`, {
 				method: "DELETE",
 			});
 
@@ -874,7 +1208,7 @@
 		}
 
 		try {
-			const response = await fetchWithAuth(`/echos/${hash}/favorite`, null, {
+			const response = await fetchWithAuth(`/echos/${hash}/favorite`, {
 				method: "PATCH",
 			});
 
@@ -927,7 +1261,7 @@
 			return;
 		}
 
-		const { type, echo, hash, size, count, id, processing } = data,
+		const { type, echo, hash, size, count, id, processing, error } = data,
 			targetHash = hash || echo?.hash;
 
 		if (typeof size === "number" && typeof count === "number") {
@@ -1002,9 +1336,26 @@
 					State.processing.set(hash, true);
 
 					node?.classList?.add("bg-processing");
-				} else {
-					State.processing.delete(hash);
 
+					break;
+				}
+
+				State.processing.delete(hash);
+
+				if (error) {
+					showNotification(`Processing failed: ${error}`, "error");
+				}
+
+				const item = State.cache.get(hash);
+
+				// re-render so the finished file gets loaded
+				if (node && item && !error) {
+					const fresh = createEchoNode(item);
+
+					updateEchoNode(fresh, item);
+
+					node.replaceWith(fresh);
+				} else {
 					node?.classList?.remove("bg-processing");
 				}
 
@@ -1021,7 +1372,7 @@
 		State.controllers.sse = controller;
 
 		try {
-			const response = await fetchWithAuth("/echo", null, {
+			const response = await fetchWithAuth("/echo", {
 				signal: controller.signal,
 			});
 
@@ -1063,7 +1414,7 @@
 				State.controllers.sse = null;
 			}
 
-			if (!State.alive) {
+			if (!State.alive || !State.authenticated) {
 				return;
 			}
 
@@ -1073,15 +1424,16 @@
 		}
 	}
 
-	async function fetchWithAuth(url, tokenOverride, options = {}) {
-		const token = tokenOverride || State.token,
-			headers = options.headers || {};
+	async function fetchWithAuth(url, options = {}) {
+		options.credentials = "same-origin";
 
-		headers["Authorization"] = `Bearer ${token}`;
+		const response = await fetch(url, options);
 
-		options.headers = headers;
+		if (response.status === 401 && State.authenticated) {
+			resetState(true);
+		}
 
-		return fetch(url, options);
+		return response;
 	}
 
 	async function parseResponseError(res) {
@@ -1202,15 +1554,45 @@
 		}
 	}
 
+	async function copyShareLink(hash, btn) {
+		try {
+			const response = await fetchWithAuth(`/echos/${hash}/share`, {
+				method: "POST",
+			});
+
+			if (!response.ok) {
+				throw new Error(await parseResponseError(response));
+			}
+
+			const data = await response.json();
+
+			await navigator.clipboard.writeText(data.url);
+
+			if (btn) {
+				const txt = btn.textContent;
+
+				btn.textContent = "COPIED";
+
+				setTimeout(() => {
+					btn.textContent = txt;
+				}, 1000);
+			}
+
+			showNotification("Share link valid for 24 hours copied", "success");
+		} catch (err) {
+			showNotification(err.message || "Failed to copy", "error");
+		}
+	}
+
 	function setupEvents() {
 		// Auth
 		$loginForm.addEventListener("submit", event => {
 			event.preventDefault();
 
-			verifyToken($apiToken.value);
+			login($apiToken.value);
 		});
 
-		$logoutBtn.addEventListener("click", () => logout(true));
+		$logoutBtn.addEventListener("click", () => logout());
 
 		$favoritesBtn.addEventListener("click", () => {
 			State.favorites = !State.favorites;
@@ -1287,6 +1669,8 @@
 
 				if (action === "copy") {
 					copyLink(hash, btn);
+				} else if (action === "share") {
+					copyShareLink(hash, btn);
 				} else if (action === "favorite") {
 					toggleFavorite(hash);
 				} else if (action === "delete") {
@@ -1315,7 +1699,7 @@
 
 		// Scroll (Infinite Load)
 		window.addEventListener("scroll", () => {
-			if (!State.token || !$dashboardView.classList.contains("hidden") === false) {
+			if (!State.authenticated || !$dashboardView.classList.contains("hidden") === false) {
 				return;
 			}
 
@@ -1334,13 +1718,13 @@
 				return;
 			}
 
-			Array.from(event.target.files).forEach(handleUpload);
+			handleUploads(Array.from(event.target.files));
 
 			$fileInput.value = "";
 		});
 
 		document.addEventListener("paste", event => {
-			if (event.target.tagName === "INPUT") {
+			if (event.target.tagName === "INPUT" || event.target.tagName === "TEXTAREA") {
 				return;
 			}
 
@@ -1350,25 +1734,70 @@
 				return;
 			}
 
-			let hasFile = false;
+			const files = [];
 
 			for (const item of items) {
 				if (item.kind === "file") {
 					const file = item.getAsFile();
 
 					if (file) {
-						hasFile = true;
-
-						handleUpload(file);
+						files.push(file);
 					}
 				}
 			}
 
-			if (hasFile) {
+			if (files.length) {
+				event.preventDefault();
+
+				handleUploads(files);
+
+				return;
+			}
+
+			const text = event.clipboardData.getData("text/plain");
+
+			// a lone url is more likely meant to be shortened than pasted
+			if (State.shortener && /^https?:\/\/\S+$/i.test(text.trim())) {
+				event.preventDefault();
+
+				openLinkModal(text.trim());
+
+				return;
+			}
+
+			if (State.texts && text.trim()) {
 				event.preventDefault();
+
+				openPasteModal(text);
 			}
 		});
 
+		// Pastes
+		$pasteBtn.addEventListener("click", () => openPasteModal());
+
+		$pasteForm.addEventListener("submit", event => {
+			event.preventDefault();
+
+			submitPaste();
+		});
+
+		$pasteContent.addEventListener("keydown", event => {
+			if (event.key === "Enter" && (event.ctrlKey || event.metaKey)) {
+				event.preventDefault();
+
+				submitPaste();
+			}
+		});
+
+		// Short links
+		$linkBtn.addEventListener("click", () => openLinkModal());
+
+		$linkForm.addEventListener("submit", event => {
+			event.preventDefault();
+
+			submitLink();
+		});
+
 		// Drag & Drop
 		let dragCounter = 0;
 
@@ -1404,12 +1833,14 @@
 			$dropOverlay.classList.add("hidden");
 
 			if (event.dataTransfer.files.length) {
-				Array.from(event.dataTransfer.files).forEach(handleUpload);
+				handleUploads(Array.from(event.dataTransfer.files));
 			}
 		});
 
 		// Modals
 		$modalViewBackdrop.addEventListener("click", closeModals);
+		$pasteModalBackdrop.addEventListener("click", closeModals);
+		$linkModalBackdrop.addEventListener("click", closeModals);
 
 		document.addEventListener("keydown", event => {
 			if (event.key !== "Escape") {
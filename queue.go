@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"sync"
 )
 
@@ -48,6 +49,19 @@ func (q *Queue) Work(job QueueJob) error {
 	}
 }
 
+// WorkContext is like Work but gives up once ctx is done. Blocked callers
+// are handed to the workers in the order they arrived.
+func (q *Queue) WorkContext(ctx context.Context, job QueueJob) error {
+	select {
+	case err := <-q.errs:
+		return err
+	case q.jobs <- job:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (q *Queue) Wait() error {
 	q.once.Do(func() {
 		close(q.jobs)
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	// QuotaDefault and QuotaUnlimited are special per-user quota values.
+	QuotaDefault   = 0
+	QuotaUnlimited = -1
+
+	EvictBatchSize = 20
+)
+
+type StorageUsage struct {
+	Size  int64 `json:"size"`
+	Files int64 `json:"files"`
+}
+
+// Quota holds the effective limits of an owner, 0 means unlimited.
+type Quota struct {
+	Storage int64 `json:"storage"`
+	Files   int64 `json:"files"`
+}
+
+type QuotaRequest struct {
+	Storage int `json:"storage"`
+	Files   int `json:"files"`
+}
+
+// storageMx serializes capacity checks with reserving the echo, so
+// concurrent uploads can't overrun a limit together.
+var storageMx sync.Mutex
+
+// quotaFor returns the effective quota of owner. Users can override the
+// configured defaults, the unowned pool always uses them.
+func quotaFor(ctx context.Context, owner int64) (Quota, error) {
+	quota := Quota{
+		Storage: int64(config.Quotas.UserStorage) * 1024 * 1024,
+		Files:   int64(config.Quotas.UserFiles),
+	}
+
+	if owner == 0 {
+		return quota, nil
+	}
+
+	user, err := database.FindUser(ctx, owner)
+	if err != nil {
+		return quota, err
+	}
+
+	if user == nil {
+		return quota, nil
+	}
+
+	switch user.QuotaStorage {
+	case QuotaDefault:
+	case QuotaUnlimited:
+		quota.Storage = 0
+	default:
+		quota.Storage = int64(user.QuotaStorage) * 1024 * 1024
+	}
+
+	switch user.QuotaFiles {
+	case QuotaDefault:
+	case QuotaUnlimited:
+		quota.Files = 0
+	default:
+		quota.Files = int64(user.QuotaFiles)
+	}
+
+	return quota, nil
+}
+
+// checkStorage makes sure an upload of echo.UploadSize bytes fits the quota
+// of its owner, the global storage cap and the free disk space. It has to be
+// called with storageMx held.
+func checkStorage(ctx context.Context, echo *Echo) error {
+	quota, err := quotaFor(ctx, echo.Owner)
+	if err != nil {
+		return &UploadError{http.StatusInternalServerError, "database error", err}
+	}
+
+	if quota.Storage > 0 || quota.Files > 0 {
+		used, err := database.OwnerUsage(ctx, echo.Owner)
+		if err != nil {
+			return &UploadError{http.StatusInternalServerError, "database error", err}
+		}
+
+		if quota.Files > 0 && used.Files >= quota.Files {
+			return &UploadError{http.StatusInsufficientStorage, fmt.Sprintf("file quota exceeded (%d echos)", quota.Files), nil}
+		}
+
+		if quota.Storage > 0 && used.Size+echo.UploadSize > quota.Storage {
+			return &UploadError{http.StatusInsufficientStorage, fmt.Sprintf("storage quota exceeded (%s of %s used)", byteCountSI(used.Size), byteCountSI(quota.Storage)), nil}
+		}
+	}
+
+	return ensureCapacity(ctx, echo.UploadSize)
+}
+
+// precheckStorage refuses uploads of owner early, before their body is
+// read, if nothing would fit anymore.
+func precheckStorage(r *http.Request) error {
+	storageMx.Lock()
+	defer storageMx.Unlock()
+
+	return checkStorage(r.Context(), &Echo{
+		Owner: getCaller(r).Owner(),
+	})
+}
+
+// ensureCapacity checks the global storage cap and free disk space for size
+// more bytes, evicting old echos to make room if enabled.
+func ensureCapacity(ctx context.Context, size int64) error {
+	needed, reason := capacityShortfall(size)
+	if needed <= 0 {
+		return nil
+	}
+
+	if config.Quotas.Evict {
+		freed := evictEchos(ctx, needed)
+
+		if freed >= needed {
+			return nil
+		}
+
+		needed, reason = capacityShortfall(size)
+		if needed <= 0 {
+			return nil
+		}
+	}
+
+	log.Warnf("storage: refusing upload of %s: %s\n", byteCountSI(size), reason)
+
+	return &UploadError{http.StatusInsufficientStorage, reason, nil}
+}
+
+// capacityShortfall returns how many bytes are missing to store size more
+// bytes and why.
+func capacityShortfall(size int64) (int64, string) {
+	var (
+		needed int64
+		reason string
+	)
+
+	if limit := config.MaxStorageBytes(); limit > 0 {
+		if over := int64(usage.Load()) + size - limit; over > 0 {
+			needed = over
+			reason = "server storage is full"
+		}
+	}
+
+	if watermark := config.MinFreeSpaceBytes(); watermark > 0 {
+		free, err := freeDiskSpace(StorageDirectory)
+		if err != nil {
+			log.Warnf("storage: failed to read free disk space: %v\n", err)
+		} else if over := watermark + size - free; over > needed {
+			needed = over
+			reason = "not enough free disk space"
+		}
+	}
+
+	return needed, reason
+}
+
+// evictEchos deletes the oldest non-favorited echos until at least needed
+// bytes are freed or nothing is left to evict. It returns the bytes freed.
+func evictEchos(ctx context.Context, needed int64) int64 {
+	var freed int64
+
+	for freed < needed {
+		echos, err := database.FindEvictable(ctx, EvictBatchSize)
+		if err != nil {
+			log.Warnf("storage: failed to find echos to evict: %v\n", err)
+
+			break
+		}
+
+		if len(echos) == 0 {
+			break
+		}
+
+		for _, echo := range echos {
+			if freed >= needed {
+				break
+			}
+
+			err := database.Delete(echo.Hash)
+			if err != nil {
+				log.Warnf("storage: failed to evict %s: %v\n", echo.Hash, err)
+
+				return freed
+			}
+
+			removeEchoFile(&echo)
+
+			err = database.Audit(ctx, &AuditEntry{
+				Timestamp: time.Now().Unix(),
+				Action:    AuditEvict,
+				Actor:     AuditActorReaper,
+				UserID:    echo.Owner,
+				Hash:      echo.Hash,
+				Detail:    echo.Name,
+			})
+			if err != nil {
+				log.Warnf("Failed to write audit entry (%s): %v\n", AuditEvict, err)
+			}
+
+			freed += echo.Size
+		}
+	}
+
+	if freed > 0 {
+		log.Warnf("storage: evicted old echos to free %s\n", byteCountSI(freed))
+	}
+
+	return freed
+}
+
+// OwnerUsage sums up the echos of owner. Echos that are still being
+// processed count with their upload size.
+func (d *EchoDatabase) OwnerUsage(ctx context.Context, owner int64) (StorageUsage, error) {
+	var used StorageUsage
+
+	err := d.QueryRowContext(ctx, "SELECT COALESCE(SUM(CASE WHEN size > 0 THEN size ELSE upload_size END), 0), COUNT(*) FROM echos WHERE owner = ?", owner).Scan(&used.Size, &used.Files)
+
+	return used, err
+}
+
+func (d *EchoDatabase) FindEvictable(ctx context.Context, limit int) ([]Echo, error) {
+	rows, err := d.QueryContext(ctx, "SELECT "+echoColumns+" FROM echos WHERE favorited = 0 AND size > 0 ORDER BY timestamp ASC, id ASC LIMIT ?", limit)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	return scanEchos(rows)
+}
+
+func (d *EchoDatabase) SetUserQuota(ctx context.Context, id int64, storage, files int) (bool, error) {
+	res, err := d.ExecContext(ctx, "UPDATE users SET quota_storage = ?, quota_files = ? WHERE id = ?", storage, files, id)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected > 0, nil
+}
+
+func usageHandler(w http.ResponseWriter, r *http.Request) {
+	owner := getCaller(r).Owner()
+
+	used, err := database.OwnerUsage(r.Context(), owner)
+	if err != nil {
+		abort(w, http.StatusInternalServerError, "database error")
+
+		log.Warnln("usage: failed to read usage")
+		log.Warnln(err)
+
+		return
+	}
+
+	quota, err := quotaFor(r.Context(), owner)
+	if err != nil {
+		abort(w, http.StatusInternalServerError, "database error")
+
+		log.Warnln("usage: failed to read quota")
+		log.Warnln(err)
+
+		return
+	}
+
+	okay(w, "application/json")
+
+	json.NewEncoder(w).Encode(map[string]any{
+		"usage": used,
+		"quota": quota,
+	})
+}
+
+func setUserQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil || id < 1 {
+		abort(w, http.StatusBadRequest, "invalid user id")
+
+		log.Warnln("users: invalid id")
+
+		return
+	}
+
+	var request QuotaRequest
+
+	err = json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		abort(w, http.StatusBadRequest, "invalid request body")
+
+		log.Warnln("users: invalid quota body")
+		log.Warnln(err)
+
+		return
+	}
+
+	if request.Storage < QuotaUnlimited || request.Files < QuotaUnlimited {
+		abort(w, http.StatusBadRequest, "quotas must be >= -1")
+
+		log.Warnln("users: invalid quota")
+
+		return
+	}
+
+	updated, err := database.SetUserQuota(r.Context(), id, request.Storage, request.Files)
+	if err != nil {
+		abort(w, http.StatusInternalServerError, "database error")
+
+		log.Warnln("users: failed to set quota")
+		log.Warnln(err)
+
+		return
+	}
+
+	if !updated {
+		abort(w, http.StatusNotFound, "user not found")
+
+		log.Warnf("users: user %d not found\n", id)
+
+		return
+	}
+
+	audit(r, getCaller(r), AuditUserQuota, "", fmt.Sprintf("#%d (storage: %d, files: %d)", id, request.Storage, request.Files))
+
+	okay(w)
+}
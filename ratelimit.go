@@ -0,0 +1,299 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const RateLimitCleanupInterval = 5 * time.Minute
+
+type RateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type RateLimiter struct {
+	mx sync.Mutex
+
+	rate    float64
+	burst   float64
+	buckets map[string]*RateBucket
+}
+
+type AuthFailure struct {
+	count int
+	first time.Time
+	until time.Time
+}
+
+type Limits struct {
+	clients *RateLimiter
+	tokens  *RateLimiter
+
+	mx       sync.Mutex
+	failures map[string]*AuthFailure
+}
+
+var limits *Limits
+
+func NewRateLimiter(perMinute, burst int) *RateLimiter {
+	return &RateLimiter{
+		rate:    float64(perMinute) / 60,
+		burst:   float64(burst),
+		buckets: make(map[string]*RateBucket),
+	}
+}
+
+// Allow takes a token from the bucket for key. If the bucket is empty it
+// returns false and how long until the next token is available.
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	now := time.Now()
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &RateBucket{
+			tokens: l.burst,
+			last:   now,
+		}
+
+		l.buckets[key] = bucket
+	}
+
+	bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate)
+	bucket.last = now
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+
+		return true, 0
+	}
+
+	wait := time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+
+	return false, wait
+}
+
+func (l *RateLimiter) Cleanup() {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	now := time.Now()
+
+	for key, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func NewLimits() *Limits {
+	l := &Limits{
+		clients:  NewRateLimiter(config.Limits.RequestsPerMinute, config.Limits.Burst),
+		tokens:   NewRateLimiter(config.Limits.TokenRequestsPerMinute, config.Limits.TokenBurst),
+		failures: make(map[string]*AuthFailure),
+	}
+
+	go func() {
+		ticker := time.NewTicker(RateLimitCleanupInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			l.clients.Cleanup()
+			l.tokens.Cleanup()
+
+			l.cleanupFailures()
+		}
+	}()
+
+	return l
+}
+
+// Locked returns how long the client is still locked out after too many
+// failed authentication attempts.
+func (l *Limits) Locked(ip string) time.Duration {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	failure, ok := l.failures[ip]
+	if !ok {
+		return 0
+	}
+
+	return time.Until(failure.until)
+}
+
+// Fail counts a failed authentication attempt of ip. Failures only ever
+// expire with their window, a valid credential doesn't reset them, or any
+// token would allow unlimited guessing of the others.
+func (l *Limits) Fail(ip string) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	now := time.Now()
+	window := config.LockoutDuration()
+
+	failure, ok := l.failures[ip]
+	if !ok || now.Sub(failure.first) > window {
+		failure = &AuthFailure{
+			first: now,
+		}
+
+		l.failures[ip] = failure
+	}
+
+	failure.count++
+
+	if failure.count >= config.Limits.MaxFailures {
+		failure.until = now.Add(window)
+
+		log.Warnf("Locking out %s after %d failed authentication attempts\n", ip, failure.count)
+	}
+}
+
+func (l *Limits) cleanupFailures() {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	now := time.Now()
+	window := config.LockoutDuration()
+
+	for ip, failure := range l.failures {
+		if now.After(failure.until) && now.Sub(failure.first) > window {
+			delete(l.failures, ip)
+		}
+	}
+}
+
+func rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if limits == nil {
+			next.ServeHTTP(w, r)
+
+			return
+		}
+
+		ok, wait := limits.clients.Allow(clientIP(r))
+		if !ok {
+			tooManyRequests(w, wait, "rate limit exceeded")
+
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkCaller applies the lockout and per-token limits after authentication.
+// It writes the error response itself and returns false if the request
+// should not continue. Only a rejected Authorization header counts as a
+// failure, a session cookie that ran out is cleared instead.
+func checkCaller(w http.ResponseWriter, r *http.Request, caller *Caller) bool {
+	bearer := r.Header.Get("Authorization") != ""
+
+	if caller == nil && !bearer {
+		if _, err := r.Cookie(SessionCookie); err == nil {
+			setSessionCookie(w, "", time.Time{})
+		}
+	}
+
+	if limits == nil {
+		return true
+	}
+
+	ip := clientIP(r)
+
+	if wait := limits.Locked(ip); wait > 0 {
+		tooManyRequests(w, wait, "too many failed attempts")
+
+		return false
+	}
+
+	if caller == nil {
+		if bearer {
+			limits.Fail(ip)
+		}
+
+		return true
+	}
+
+	ok, wait := limits.tokens.Allow(caller.Key())
+	if !ok {
+		tooManyRequests(w, wait, "rate limit exceeded")
+
+		return false
+	}
+
+	return true
+}
+
+func tooManyRequests(w http.ResponseWriter, wait time.Duration, message string) {
+	seconds := max(1, int(math.Ceil(wait.Seconds())))
+
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+
+	abort(w, http.StatusTooManyRequests, message)
+}
+
+// clientIP returns the address of the client. X-Forwarded-For is only
+// trusted when the request comes from a configured proxy, and is walked from
+// the right so clients cannot spoof their address by prepending entries.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	if !config.IsTrustedProxy(host) {
+		return host
+	}
+
+	forwarded := r.Header.Values("X-Forwarded-For")
+
+	var hops []string
+
+	for _, header := range forwarded {
+		for _, hop := range strings.Split(header, ",") {
+			hop = strings.TrimSpace(hop)
+
+			if hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(hops[i])
+		if ip == nil {
+			break
+		}
+
+		host = ip.String()
+
+		if !config.IsTrustedProxy(host) {
+			break
+		}
+	}
+
+	return host
+}
+
+func (c *Caller) Key() string {
+	if c.Token != nil {
+		return fmt.Sprintf("token:%d", c.Token.ID)
+	}
+
+	if c.User != nil {
+		return fmt.Sprintf("user:%d", c.User.ID)
+	}
+
+	return "master"
+}
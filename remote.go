@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+type RemoteUploadRequest struct {
+	URL        string `json:"url"`
+	Name       string `json:"name"`
+	Visibility string `json:"visibility"`
+	Password   string `json:"password"`
+}
+
+type RemoteFetcher struct {
+	client *http.Client
+}
+
+var fetcher *RemoteFetcher
+
+// blockedPrefixes are ranges that are not covered by the netip helpers but
+// must not be reachable from remote uploads either.
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("2001:db8::/32"),
+}
+
+var errRemoteTooLarge = errors.New("remote file too large")
+
+func NewRemoteFetcher() *RemoteFetcher {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		// checked after name resolution, so dns rebinding cannot sneak
+		// an internal address past the filter
+		Control: func(_, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+
+			addr, err := netip.ParseAddr(host)
+			if err != nil {
+				return err
+			}
+
+			if !config.IsAllowedRemote(addr) {
+				return fmt.Errorf("address %s is not allowed", addr)
+			}
+
+			return nil
+		},
+	}
+
+	transport := &http.Transport{
+		Proxy:                 nil,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 15 * time.Second,
+		MaxIdleConns:          4,
+		IdleConnTimeout:       30 * time.Second,
+	}
+
+	return &RemoteFetcher{
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   config.RemoteTimeout(),
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) > config.Remote.MaxRedirects {
+					return fmt.Errorf("stopped after %d redirects", config.Remote.MaxRedirects)
+				}
+
+				if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+					return fmt.Errorf("redirect to unsupported scheme %q", req.URL.Scheme)
+				}
+
+				return nil
+			},
+		},
+	}
+}
+
+func isBlockedAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return true
+	}
+
+	for _, prefix := range blockedPrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseRemoteURL(raw string) (*url.URL, error) {
+	target, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return nil, err
+	}
+
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme %q", target.Scheme)
+	}
+
+	if target.Hostname() == "" {
+		return nil, errors.New("missing host")
+	}
+
+	if target.User != nil {
+		return nil, errors.New("credentials in urls are not supported")
+	}
+
+	return target, nil
+}
+
+// Fetch downloads target into w and returns the first MaxSniffBytes of it
+// along with the final url after redirects.
+func (f *RemoteFetcher) Fetch(ctx context.Context, target *url.URL, w io.Writer) ([]byte, *url.URL, int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	req.Header.Set("User-Agent", "Echo-Vault/"+Version)
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, 0, fmt.Errorf("remote responded with status %d", resp.StatusCode)
+	}
+
+	limit := config.MaxRemoteSizeBytes()
+
+	if resp.ContentLength > limit {
+		return nil, nil, 0, errRemoteTooLarge
+	}
+
+	var sniff bytes.Buffer
+
+	n, err := io.Copy(io.MultiWriter(w, &limitedBuffer{buf: &sniff, n: MaxSniffBytes}), io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	if n > limit {
+		return nil, nil, 0, errRemoteTooLarge
+	}
+
+	return sniff.Bytes(), resp.Request.URL, n, nil
+}
+
+// limitedBuffer keeps the first n bytes written to it and discards the rest.
+type limitedBuffer struct {
+	buf *bytes.Buffer
+	n   int
+}
+
+func (l *limitedBuffer) Write(p []byte) (int, error) {
+	if rest := l.n - l.buf.Len(); rest > 0 {
+		l.buf.Write(p[:min(rest, len(p))])
+	}
+
+	return len(p), nil
+}
+
+func remoteFileName(target *url.URL) string {
+	name := path.Base(target.Path)
+
+	if name == "." || name == "/" {
+		return target.Hostname()
+	}
+
+	return name
+}
+
+func remoteUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if fetcher == nil {
+		abort(w, http.StatusServiceUnavailable, "remote uploads are disabled")
+
+		return
+	}
+
+	var request RemoteUploadRequest
+
+	err := json.NewDecoder(io.LimitReader(r.Body, 16*1024)).Decode(&request)
+	if err != nil {
+		abort(w, http.StatusBadRequest, "invalid request body")
+
+		log.Warnln("remote: invalid request body")
+		log.Warnln(err)
+
+		return
+	}
+
+	target, err := parseRemoteURL(request.URL)
+	if err != nil {
+		abort(w, http.StatusBadRequest, "invalid url")
+
+		log.Warnln("remote: invalid url")
+		log.Warnln(err)
+
+		return
+	}
+
+	options, err := parseUploadOptions(r)
+	if err != nil {
+		abort(w, http.StatusBadRequest, err.Error())
+
+		log.Warnln("remote: invalid options")
+		log.Warnln(err)
+
+		return
+	}
+
+	if request.Visibility != "" {
+		options.Visibility, err = ParseVisibility(request.Visibility)
+		if err != nil {
+			abort(w, http.StatusBadRequest, err.Error())
+
+			log.Warnln("remote: invalid visibility")
+
+			return
+		}
+	}
+
+	if len(request.Password) > PasswordMaxLength {
+		abort(w, http.StatusBadRequest, "password too long")
+
+		log.Warnln("remote: password too long")
+
+		return
+	}
+
+	err = precheckStorage(r)
+	if err != nil {
+		uploadFailed(w, "remote", err)
+
+		return
+	}
+
+	timer := NewTimer().Start("read")
+
+	file, path, err := OpenTempFileForWriting()
+	if err != nil {
+		abort(w, http.StatusInternalServerError, "internal storage error")
+
+		log.Warnln("remote: failed to open temporary file")
+		log.Warnln(err)
+
+		return
+	}
+
+	defer file.Close()
+	defer os.Remove(path)
+
+	hasher := sha256.New()
+
+	sniff, final, n, err := fetcher.Fetch(r.Context(), target, io.MultiWriter(file, hasher))
+	if err != nil {
+		if errors.Is(err, errRemoteTooLarge) {
+			abort(w, http.StatusRequestEntityTooLarge, "remote file too large")
+		} else {
+			abort(w, http.StatusBadGateway, "failed to download remote file")
+		}
+
+		log.Warnf("remote: failed to download %q\n", target.Redacted())
+		log.Warnln(err)
+
+		return
+	}
+
+	file.Close()
+
+	name := strings.TrimSpace(request.Name)
+	if name == "" {
+		name = remoteFileName(final)
+	}
+
+	sniffed := sniffUpload(sniff, name)
+
+	if !isSupportedUpload(sniffed) {
+		abort(w, http.StatusBadRequest, "unsupported file type")
+
+		log.Warnln("remote: invalid/unrecognized filetype")
+
+		return
+	}
+
+	echo := &Echo{
+		Name:       name,
+		Extension:  sniffed,
+		Owner:      getCaller(r).Owner(),
+		Source:     target.String(),
+		UploadSize: n,
+		Checksum:   hex.EncodeToString(hasher.Sum(nil)),
+	}
+
+	options.Apply(echo)
+
+	if request.Password != "" {
+		echo.Password, err = hashPassword(request.Password)
+		if err != nil {
+			abort(w, http.StatusInternalServerError, "failed to hash password")
+
+			log.Warnln("remote: failed to hash password")
+			log.Warnln(err)
+
+			return
+		}
+	}
+
+	timer.Stop("read")
+
+	status, response, err := finishUpload(r, echo, path, getUploadId(r), sniffed, timer)
+	if err != nil {
+		uploadFailed(w, "remote", err)
+
+		return
+	}
+
+	writeUpload(w, status, response)
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const SessionCookie = "echo_vault_session"
+
+type Session struct {
+	ID      int64
+	TokenID int64
+	UserID  int64
+	Scopes  Scope
+	Created int64
+	Expires int64
+	Master  string
+}
+
+type LoginRequest struct {
+	Token string `json:"token"`
+}
+
+func (d *EchoDatabase) CreateSession(ctx context.Context, tokenID, userID int64, scopes Scope, duration time.Duration) (*Session, string, error) {
+	secret, err := generateTokenSecret()
+	if err != nil {
+		return nil, "", err
+	}
+
+	now := time.Now()
+
+	session := &Session{
+		TokenID: tokenID,
+		UserID:  userID,
+		Scopes:  scopes,
+		Created: now.Unix(),
+		Expires: now.Add(duration).Unix(),
+	}
+
+	if tokenID == 0 && userID == 0 {
+		session.Master = masterFingerprint()
+	}
+
+	res, err := d.ExecContext(ctx, "INSERT INTO sessions (secret, token_id, user_id, scopes, created, expires, master) VALUES (?, ?, ?, ?, ?, ?, ?)", hashTokenSecret(secret), session.TokenID, session.UserID, session.Scopes, session.Created, session.Expires, session.Master)
+	if err != nil {
+		return nil, "", err
+	}
+
+	session.ID, err = res.LastInsertId()
+	if err != nil {
+		return nil, "", err
+	}
+
+	return session, secret, nil
+}
+
+// masterFingerprint identifies the current master token without storing it,
+// so master sessions end when the token is changed.
+func masterFingerprint() string {
+	return signPayload("master:" + config.Server.UploadToken)
+}
+
+func (d *EchoDatabase) FindSession(ctx context.Context, secret string) (*Session, error) {
+	var s Session
+
+	err := d.QueryRowContext(ctx, "SELECT id, token_id, user_id, scopes, created, expires, master FROM sessions WHERE secret = ? AND expires > ? LIMIT 1", hashTokenSecret(secret), time.Now().Unix()).Scan(&s.ID, &s.TokenID, &s.UserID, &s.Scopes, &s.Created, &s.Expires, &s.Master)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+func (d *EchoDatabase) DeleteSession(ctx context.Context, secret string) error {
+	_, err := d.ExecContext(ctx, "DELETE FROM sessions WHERE secret = ?", hashTokenSecret(secret))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (d *EchoDatabase) DeleteExpiredSessions(ctx context.Context) error {
+	_, err := d.ExecContext(ctx, "DELETE FROM sessions WHERE expires <= ?", time.Now().Unix())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (d *EchoDatabase) FindTokenByID(ctx context.Context, id int64) (*Token, error) {
+	var t Token
+
+	err := d.QueryRowContext(ctx, "SELECT id, name, user_id, scopes, created, last_used, revoked FROM tokens WHERE id = ? LIMIT 1", id).Scan(&t.ID, &t.Name, &t.UserID, &t.Scopes, &t.Created, &t.LastUsed, &t.Revoked)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	var request LoginRequest
+
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		abort(w, http.StatusBadRequest, "invalid request body")
+
+		log.Warnln("login: invalid request body")
+		log.Warnln(err)
+
+		return
+	}
+
+	ip := clientIP(r)
+
+	if limits != nil {
+		if wait := limits.Locked(ip); wait > 0 {
+			tooManyRequests(w, wait, "too many failed attempts")
+
+			return
+		}
+	}
+
+	caller, err := identifyToken(r.Context(), strings.TrimSpace(request.Token))
+	if err != nil {
+		abort(w, http.StatusInternalServerError, "database error")
+
+		log.Warnln("login: failed to identify caller")
+		log.Warnln(err)
+
+		return
+	}
+
+	if limits != nil && caller == nil {
+		limits.Fail(ip)
+	}
+
+	if caller == nil {
+		abort(w, http.StatusUnauthorized, "unauthorized")
+
+		return
+	}
+
+	err = database.DeleteExpiredSessions(r.Context())
+	if err != nil {
+		log.Warnf("login: failed to delete expired sessions: %v\n", err)
+	}
+
+	var tokenID int64
+
+	if caller.Token != nil {
+		tokenID = caller.Token.ID
+	}
+
+	err = startSession(w, r, tokenID, caller.Owner(), caller.Scopes)
+	if err != nil {
+		abort(w, http.StatusInternalServerError, "database error")
+
+		log.Warnln("login: failed to create session")
+		log.Warnln(err)
+
+		return
+	}
+
+	audit(r, caller, AuditLogin, "", "")
+
+	okay(w, "application/json")
+
+	json.NewEncoder(w).Encode(map[string]any{
+		"scopes": caller.Scopes,
+	})
+}
+
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(SessionCookie)
+	if err == nil && cookie.Value != "" {
+		caller, err := identifySession(r.Context(), cookie.Value)
+		if err != nil {
+			log.Warnf("logout: failed to identify caller: %v\n", err)
+		}
+
+		err = database.DeleteSession(r.Context(), cookie.Value)
+		if err != nil {
+			abort(w, http.StatusInternalServerError, "database error")
+
+			log.Warnln("logout: failed to delete session")
+			log.Warnln(err)
+
+			return
+		}
+
+		if caller != nil {
+			audit(r, caller, AuditLogout, "", "")
+		}
+	}
+
+	setSessionCookie(w, "", time.Unix(0, 0))
+
+	okay(w)
+}
+
+func startSession(w http.ResponseWriter, r *http.Request, tokenID, userID int64, scopes Scope) error {
+	session, secret, err := database.CreateSession(r.Context(), tokenID, userID, scopes, config.SessionDuration())
+	if err != nil {
+		return err
+	}
+
+	setSessionCookie(w, secret, time.Unix(session.Expires, 0))
+
+	return nil
+}
+
+func setSessionCookie(w http.ResponseWriter, value string, expires time.Time) {
+	cookie := &http.Cookie{
+		Name:     SessionCookie,
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   config.IsSecure(),
+		SameSite: http.SameSiteStrictMode,
+	}
+
+	if value == "" {
+		cookie.MaxAge = -1
+	}
+
+	http.SetCookie(w, cookie)
+}
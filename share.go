@@ -0,0 +1,292 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	DefaultShareDuration = 24 * time.Hour
+	MaxShareDuration     = 365 * 24 * time.Hour
+)
+
+type Visibility int
+
+const (
+	VisibilityPublic Visibility = iota
+	VisibilityUnlisted
+	VisibilityPrivate
+)
+
+var visibilityNames = []string{"public", "unlisted", "private"}
+
+type ShareRequest struct {
+	Expires string `json:"expires"`
+}
+
+type VisibilityRequest struct {
+	Visibility string `json:"visibility"`
+}
+
+func ParseVisibility(name string) (Visibility, error) {
+	for i, v := range visibilityNames {
+		if v == name {
+			return Visibility(i), nil
+		}
+	}
+
+	return 0, fmt.Errorf("visibility must be one of (public, unlisted, private), got %q", name)
+}
+
+func (v Visibility) String() string {
+	if v < 0 || int(v) >= len(visibilityNames) {
+		return "public"
+	}
+
+	return visibilityNames[v]
+}
+
+func (v Visibility) MarshalJSON() ([]byte, error) {
+	return json.Marshal(v.String())
+}
+
+func generateSigningKey() (string, error) {
+	buf := make([]byte, 32)
+
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buf), nil
+}
+
+func signPayload(payload string) string {
+	mac := hmac.New(sha256.New, []byte(config.Server.SigningKey))
+
+	mac.Write([]byte(payload))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func verifyPayload(payload, signature string) bool {
+	return hmac.Equal([]byte(signPayload(payload)), []byte(signature))
+}
+
+func signEcho(hash, ext string, expires int64) string {
+	return signPayload(fmt.Sprintf("view:%s.%s:%d", hash, ext, expires))
+}
+
+func (e *Echo) SignedURL(expires time.Time) string {
+	return e.URL() + "?" + e.signedQuery(expires)
+}
+
+func (e *Echo) signedQuery(expires time.Time) string {
+	exp := expires.Unix()
+
+	return fmt.Sprintf("exp=%d&sig=%s", exp, signEcho(e.Hash, e.Extension, exp))
+}
+
+// checkSignature validates the exp/sig query parameters of a share link. It
+// returns false with no status if the request carries no signature at all.
+func checkSignature(r *http.Request, echo *Echo) (bool, int) {
+	query := r.URL.Query()
+
+	rawExp := query.Get("exp")
+	sig := query.Get("sig")
+
+	if rawExp == "" && sig == "" {
+		return false, 0
+	}
+
+	exp, err := strconv.ParseInt(rawExp, 10, 64)
+	if err != nil || sig == "" || !verifyPayload(fmt.Sprintf("view:%s.%s:%d", echo.Hash, echo.Extension, exp), sig) {
+		return false, http.StatusForbidden
+	}
+
+	if time.Now().Unix() > exp {
+		return false, http.StatusGone
+	}
+
+	return true, 0
+}
+
+func (d *EchoDatabase) SetVisibility(hash string, visibility Visibility) error {
+	_, err := d.Exec("UPDATE echos SET visibility = ? WHERE hash = ?", visibility, hash)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func shareEchoHandler(w http.ResponseWriter, r *http.Request) {
+	hash := chi.URLParam(r, "hash")
+	if !validateHash(hash) {
+		abort(w, http.StatusBadRequest, "invalid hash format")
+
+		log.Warnln("share: invalid hash")
+
+		return
+	}
+
+	var request ShareRequest
+
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			abort(w, http.StatusBadRequest, "invalid request body")
+
+			log.Warnln("share: invalid request body")
+			log.Warnln(err)
+
+			return
+		}
+	}
+
+	duration := DefaultShareDuration
+
+	if request.Expires != "" {
+		parsed, err := parseDuration(request.Expires)
+		if err != nil || parsed <= 0 || parsed > MaxShareDuration {
+			abort(w, http.StatusBadRequest, "invalid expiry duration")
+
+			log.Warnln("share: invalid expiry duration")
+
+			return
+		}
+
+		duration = parsed
+	}
+
+	echo, err := database.Find(r.Context(), hash)
+	if err != nil {
+		abort(w, http.StatusInternalServerError, "database error")
+
+		log.Warnln("share: failed to find echo")
+		log.Warnln(err)
+
+		return
+	}
+
+	if !getCaller(r).CanAccess(echo) {
+		abort(w, http.StatusNotFound, "echo not found")
+
+		log.Warnf("share: echo %q not found\n", hash)
+
+		return
+	}
+
+	expires := time.Now().Add(duration)
+
+	audit(r, getCaller(r), AuditShare, echo.Hash, "expires "+expires.UTC().Format(time.RFC3339))
+
+	response := map[string]any{
+		"url":     echo.SignedURL(expires),
+		"expires": expires.Unix(),
+	}
+
+	if echo.IsText() {
+		response["view_url"] = echo.ViewURL() + "?" + echo.signedQuery(expires)
+	}
+
+	okay(w, "application/json")
+
+	json.NewEncoder(w).Encode(response)
+}
+
+func setVisibilityHandler(w http.ResponseWriter, r *http.Request) {
+	hash := chi.URLParam(r, "hash")
+	if !validateHash(hash) {
+		abort(w, http.StatusBadRequest, "invalid hash format")
+
+		log.Warnln("visibility: invalid hash")
+
+		return
+	}
+
+	var request VisibilityRequest
+
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		abort(w, http.StatusBadRequest, "invalid request body")
+
+		log.Warnln("visibility: invalid request body")
+		log.Warnln(err)
+
+		return
+	}
+
+	visibility, err := ParseVisibility(request.Visibility)
+	if err != nil {
+		abort(w, http.StatusBadRequest, err.Error())
+
+		log.Warnln("visibility: invalid visibility")
+
+		return
+	}
+
+	echo, err := database.Find(r.Context(), hash)
+	if err != nil {
+		abort(w, http.StatusInternalServerError, "database error")
+
+		log.Warnln("visibility: failed to find echo")
+		log.Warnln(err)
+
+		return
+	}
+
+	if !getCaller(r).CanAccess(echo) {
+		abort(w, http.StatusNotFound, "echo not found")
+
+		log.Warnf("visibility: echo %q not found\n", hash)
+
+		return
+	}
+
+	err = database.SetVisibility(hash, visibility)
+	if err != nil {
+		abort(w, http.StatusInternalServerError, "database error")
+
+		log.Warnln("visibility: failed to update echo")
+		log.Warnln(err)
+
+		return
+	}
+
+	echo.Visibility = visibility
+
+	hub.BroadcastUpdate(echo)
+
+	audit(r, getCaller(r), AuditVisibility, echo.Hash, visibility.String())
+
+	okay(w, "application/json")
+
+	json.NewEncoder(w).Encode(map[string]any{
+		"visibility": visibility,
+	})
+}
+
+// parseDuration extends time.ParseDuration with a "d" (day) unit.
+func parseDuration(raw string) (time.Duration, error) {
+	if n := len(raw); n > 1 && raw[n-1] == 'd' {
+		days, err := strconv.ParseFloat(raw[:n-1], 64)
+		if err != nil {
+			return 0, err
+		}
+
+		return time.Duration(days * float64(24*time.Hour)), nil
+	}
+
+	return time.ParseDuration(raw)
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	// LinkExtension marks redirect echos, they have no file in storage.
+	LinkExtension = "url"
+
+	LinkMaxLength = 2048
+)
+
+type ShortenRequest struct {
+	URL        string `json:"url"`
+	Name       string `json:"name"`
+	Visibility string `json:"visibility"`
+	Password   string `json:"password"`
+}
+
+// IsLink reports whether the echo is a short link redirecting to its target.
+func (e *Echo) IsLink() bool {
+	return e.Extension == LinkExtension
+}
+
+func shortenHandler(w http.ResponseWriter, r *http.Request) {
+	if !config.Shortener.Enabled {
+		abort(w, http.StatusServiceUnavailable, "url shortener is disabled")
+
+		return
+	}
+
+	var request ShortenRequest
+
+	err := json.NewDecoder(io.LimitReader(r.Body, 16*1024)).Decode(&request)
+	if err != nil {
+		abort(w, http.StatusBadRequest, "invalid request body")
+
+		log.Warnln("shorten: invalid request body")
+		log.Warnln(err)
+
+		return
+	}
+
+	if len(request.URL) > LinkMaxLength {
+		abort(w, http.StatusBadRequest, "url too long")
+
+		log.Warnln("shorten: url too long")
+
+		return
+	}
+
+	target, err := parseRemoteURL(request.URL)
+	if err != nil {
+		abort(w, http.StatusBadRequest, "invalid url")
+
+		log.Warnln("shorten: invalid url")
+		log.Warnln(err)
+
+		return
+	}
+
+	options, err := parseUploadOptions(r)
+	if err != nil {
+		abort(w, http.StatusBadRequest, err.Error())
+
+		log.Warnln("shorten: invalid options")
+		log.Warnln(err)
+
+		return
+	}
+
+	if request.Visibility != "" {
+		options.Visibility, err = ParseVisibility(request.Visibility)
+		if err != nil {
+			abort(w, http.StatusBadRequest, err.Error())
+
+			log.Warnln("shorten: invalid visibility")
+
+			return
+		}
+	}
+
+	if len(request.Password) > PasswordMaxLength {
+		abort(w, http.StatusBadRequest, "password too long")
+
+		log.Warnln("shorten: password too long")
+
+		return
+	}
+
+	name := strings.TrimSpace(request.Name)
+	if name == "" {
+		name = target.Hostname()
+	}
+
+	echo := &Echo{
+		Name:      name,
+		Extension: LinkExtension,
+		Owner:     getCaller(r).Owner(),
+		Target:    target.String(),
+	}
+
+	options.Apply(echo)
+
+	echo.Language = ""
+
+	if request.Password != "" {
+		echo.Password, err = hashPassword(request.Password)
+		if err != nil {
+			abort(w, http.StatusInternalServerError, "failed to hash password")
+
+			log.Warnln("shorten: failed to hash password")
+			log.Warnln(err)
+
+			return
+		}
+	}
+
+	err = reserveEcho(echo)
+	if err != nil {
+		uploadFailed(w, "shorten", err)
+
+		return
+	}
+
+	count.Add(1)
+
+	hub.BroadcastCreate(getUploadId(r), echo)
+
+	audit(r, getCaller(r), AuditShorten, echo.Hash, target.Redacted())
+
+	if wantsText(r) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+
+		fmt.Fprintln(w, echo.URL())
+
+		return
+	}
+
+	writeUpload(w, http.StatusOK, map[string]any{
+		"echo":         echo,
+		"deletion_url": echo.DeletionURL(),
+	})
+}
+
+// redirectHandler sends visitors of a short link on to its target.
+func redirectHandler(w http.ResponseWriter, r *http.Request) {
+	hash := chi.URLParam(r, "hash")
+	if !validateHash(hash) {
+		abort(w, http.StatusBadRequest, "invalid hash format")
+
+		log.Warnln("redirect: invalid hash")
+
+		return
+	}
+
+	echo, err := database.Find(r.Context(), hash)
+	if err != nil {
+		abort(w, http.StatusInternalServerError, "database error")
+
+		log.Warnln("redirect: failed to find echo")
+		log.Warnln(err)
+
+		return
+	}
+
+	if echo == nil || !echo.IsLink() || echo.IsExpired() {
+		abort(w, http.StatusNotFound, "echo not found")
+
+		return
+	}
+
+	serveRedirect(w, r, echo)
+}
+
+// rootRedirectHandler resolves short links directly below the root. Anything
+// that isn't one is left to next, so static files keep working.
+func rootRedirectHandler(next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hash := chi.URLParam(r, "hash")
+		if !validateHash(hash) {
+			next.ServeHTTP(w, r)
+
+			return
+		}
+
+		echo, err := database.Find(r.Context(), hash)
+		if err != nil {
+			abort(w, http.StatusInternalServerError, "database error")
+
+			log.Warnln("redirect: failed to find echo")
+			log.Warnln(err)
+
+			return
+		}
+
+		if echo == nil || !echo.IsLink() || echo.IsExpired() {
+			next.ServeHTTP(w, r)
+
+			return
+		}
+
+		serveRedirect(w, r, echo)
+	}
+}
+
+func serveRedirect(w http.ResponseWriter, r *http.Request, echo *Echo) {
+	owner, _, ok := authorizeView(w, r, echo)
+	if !ok {
+		return
+	}
+
+	burn, ok := claimBurn(w, r, echo, owner)
+	if !ok {
+		return
+	}
+
+	err := database.CountClick(r.Context(), echo.Hash)
+	if err != nil {
+		log.Warnf("redirect: failed to count click on %s\n", echo.Hash)
+		log.Warnln(err)
+	}
+
+	// every click has to reach us to be counted
+	w.Header().Set("Cache-Control", "private, no-store")
+
+	http.Redirect(w, r, echo.Target, config.RedirectStatus())
+
+	if burn {
+		finishBurn(r, echo)
+	}
+}
+
+func (d *EchoDatabase) CountClick(ctx context.Context, hash string) error {
+	_, err := d.ExecContext(ctx, "UPDATE echos SET clicks = clicks + 1 WHERE hash = ?", hash)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -3,10 +3,30 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"io"
+	"unicode/utf8"
 )
 
 const MaxSniffBytes = 16 * 1024
 
+func sniffFile(path, name string) (string, error) {
+	file, err := OpenFileForReading(path)
+	if err != nil {
+		return "", err
+	}
+
+	defer file.Close()
+
+	buf := make([]byte, MaxSniffBytes)
+
+	n, err := io.ReadFull(file, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+
+	return sniffUpload(buf[:n], name), nil
+}
+
 func sniffType(buf []byte) string {
 	if isWEBP(buf) {
 		return "webp"
@@ -50,6 +70,10 @@ func sniffType(buf []byte) string {
 		return "mkv"
 	}
 
+	if isText(buf) {
+		return "txt"
+	}
+
 	return ""
 }
 
@@ -157,3 +181,27 @@ func ebmlDocType(b []byte) string {
 
 	return ""
 }
+
+// isText reports whether b looks like utf-8 text. A rune cut off at the end
+// of the sniffing window is tolerated.
+func isText(b []byte) bool {
+	if len(b) == 0 {
+		return false
+	}
+
+	for i := 0; i < len(b); {
+		r, size := utf8.DecodeRune(b[i:])
+
+		if r == utf8.RuneError && size == 1 {
+			return len(b)-i < utf8.UTFMax && !utf8.FullRune(b[i:])
+		}
+
+		if r < 0x20 && r != '\t' && r != '\n' && r != '\r' && r != '\f' || r == 0x7f {
+			return false
+		}
+
+		i += size
+	}
+
+	return true
+}
@@ -2,11 +2,16 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"text/tabwriter"
+	"time"
 )
 
 func handleTasks() bool {
@@ -23,17 +28,319 @@ func handleTasks() bool {
 		log.MustFail(taskScanStorage())
 	case "clear-tags":
 		log.MustFail(taskClearTags())
+	case "token":
+		log.MustFail(taskToken(os.Args[2:]))
+	case "user":
+		log.MustFail(taskUser(os.Args[2:]))
 	default:
 		fmt.Printf("Unknown task: %s\n", task)
 		fmt.Println()
-		fmt.Println("Available tasks:")
-		fmt.Println("  scan        Scan storage directory for new files and add them to the database")
-		fmt.Println("  clear-tags  Remove all generated tags, descriptions, and vector embeddings")
+		printTaskUsage()
 	}
 
 	return true
 }
 
+func printTaskUsage() {
+	fmt.Println("Available tasks:")
+	fmt.Println("  scan                                        Scan storage directory for new files, add them to the database and fill in missing checksums")
+	fmt.Println("  clear-tags                                  Remove all generated tags, descriptions, and vector embeddings")
+	fmt.Println("  token create <name> [-user U] [-scopes S]   Create a new API token (scopes: upload,read,favorite,delete,admin)")
+	fmt.Println("  token list                                  List all API tokens")
+	fmt.Println("  token revoke <id|name>                      Revoke an API token")
+	fmt.Println("  user add <name> [-admin]                    Create a new user")
+	fmt.Println("  user remove <id|name>                       Remove a user and revoke their tokens")
+	fmt.Println("  user list                                   List all users")
+}
+
+// parseTaskArgs parses flags that may appear before or after positional arguments.
+func parseTaskArgs(set *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+
+	for {
+		err := set.Parse(args)
+		if err != nil {
+			return nil, err
+		}
+
+		args = set.Args()
+
+		if len(args) == 0 {
+			return positional, nil
+		}
+
+		positional = append(positional, args[0])
+
+		args = args[1:]
+	}
+}
+
+func taskToken(args []string) error {
+	if len(args) == 0 {
+		printTaskUsage()
+
+		return nil
+	}
+
+	ctx := context.Background()
+
+	switch args[0] {
+	case "create":
+		set := flag.NewFlagSet("token create", flag.ContinueOnError)
+
+		userName := set.String("user", "", "user the token belongs to")
+		scopeList := set.String("scopes", "upload,read,favorite,delete", "comma separated list of scopes")
+
+		positional, err := parseTaskArgs(set, args[1:])
+		if err != nil {
+			return err
+		}
+
+		if len(positional) != 1 {
+			return errors.New("usage: token create <name> [-user U] [-scopes S]")
+		}
+
+		scopes, err := ParseScopes(strings.Split(*scopeList, ","))
+		if err != nil {
+			return err
+		}
+
+		var userID int64
+
+		if *userName != "" {
+			user, err := database.FindUserByName(ctx, *userName)
+			if err != nil {
+				return err
+			}
+
+			if user == nil {
+				return fmt.Errorf("user %q not found", *userName)
+			}
+
+			userID = user.ID
+		}
+
+		token, secret, err := database.CreateToken(ctx, positional[0], userID, scopes)
+		if err != nil {
+			return err
+		}
+
+		auditTask(AuditTokenCreate, fmt.Sprintf("#%d %q (%s)", token.ID, token.Name, token.Scopes))
+
+		log.Printf("Created token #%d %q (%s)\n", token.ID, token.Name, token.Scopes)
+		log.Println()
+		log.Printf("  %s\n", secret)
+		log.Println()
+		log.Println("This secret will not be shown again.")
+	case "list":
+		tokens, err := database.FindTokens(ctx)
+		if err != nil {
+			return err
+		}
+
+		users, err := findUserNames(ctx)
+		if err != nil {
+			return err
+		}
+
+		wr := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+		fmt.Fprintln(wr, "ID\tNAME\tUSER\tSCOPES\tCREATED\tLAST USED\tSTATUS")
+
+		for _, token := range tokens {
+			status := "active"
+
+			if token.IsRevoked() {
+				status = "revoked " + formatTaskTime(token.Revoked)
+			}
+
+			owner, ok := users[token.UserID]
+			if !ok {
+				owner = fmt.Sprintf("#%d (removed)", token.UserID)
+			}
+
+			fmt.Fprintf(wr, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", token.ID, token.Name, owner, token.Scopes, formatTaskTime(token.Created), formatTaskTime(token.LastUsed), status)
+		}
+
+		return wr.Flush()
+	case "revoke":
+		if len(args) != 2 {
+			return errors.New("usage: token revoke <id|name>")
+		}
+
+		var ids []int64
+
+		if id, err := strconv.ParseInt(args[1], 10, 64); err == nil {
+			ids = append(ids, id)
+		} else {
+			tokens, err := database.FindTokens(ctx)
+			if err != nil {
+				return err
+			}
+
+			for _, token := range tokens {
+				if token.Name == args[1] && !token.IsRevoked() {
+					ids = append(ids, token.ID)
+				}
+			}
+		}
+
+		var revoked int
+
+		for _, id := range ids {
+			ok, err := database.RevokeToken(ctx, id)
+			if err != nil {
+				return err
+			}
+
+			if ok {
+				auditTask(AuditTokenRevoke, fmt.Sprintf("#%d", id))
+
+				revoked++
+			}
+		}
+
+		if revoked == 0 {
+			return fmt.Errorf("no active token matching %q", args[1])
+		}
+
+		log.Printf("Revoked %d token(s).\n", revoked)
+	default:
+		printTaskUsage()
+	}
+
+	return nil
+}
+
+func taskUser(args []string) error {
+	if len(args) == 0 {
+		printTaskUsage()
+
+		return nil
+	}
+
+	ctx := context.Background()
+
+	switch args[0] {
+	case "add":
+		set := flag.NewFlagSet("user add", flag.ContinueOnError)
+
+		admin := set.Bool("admin", false, "grant the user access to all echos")
+
+		positional, err := parseTaskArgs(set, args[1:])
+		if err != nil {
+			return err
+		}
+
+		if len(positional) != 1 {
+			return errors.New("usage: user add <name> [-admin]")
+		}
+
+		existing, err := database.FindUserByName(ctx, positional[0])
+		if err != nil {
+			return err
+		}
+
+		if existing != nil {
+			return fmt.Errorf("user %q already exists", positional[0])
+		}
+
+		user, err := database.CreateUser(ctx, positional[0], *admin)
+		if err != nil {
+			return err
+		}
+
+		auditTask(AuditUserCreate, fmt.Sprintf("#%d %q (admin: %v)", user.ID, user.Name, user.Admin))
+
+		log.Printf("Created user #%d %q\n", user.ID, user.Name)
+	case "remove":
+		if len(args) != 2 {
+			return errors.New("usage: user remove <id|name>")
+		}
+
+		user, err := findTaskUser(ctx, args[1])
+		if err != nil {
+			return err
+		}
+
+		_, err = database.DeleteUser(ctx, user.ID)
+		if err != nil {
+			return err
+		}
+
+		auditTask(AuditUserDelete, fmt.Sprintf("#%d", user.ID))
+
+		log.Printf("Removed user #%d %q and revoked their tokens.\n", user.ID, user.Name)
+	case "list":
+		users, err := database.FindUsers(ctx)
+		if err != nil {
+			return err
+		}
+
+		wr := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+		fmt.Fprintln(wr, "ID\tNAME\tADMIN\tCREATED")
+
+		for _, user := range users {
+			fmt.Fprintf(wr, "%d\t%s\t%v\t%s\n", user.ID, user.Name, user.Admin, formatTaskTime(user.Created))
+		}
+
+		return wr.Flush()
+	default:
+		printTaskUsage()
+	}
+
+	return nil
+}
+
+func findTaskUser(ctx context.Context, ref string) (*User, error) {
+	var (
+		user *User
+		err  error
+	)
+
+	if id, perr := strconv.ParseInt(ref, 10, 64); perr == nil {
+		user, err = database.FindUser(ctx, id)
+	} else {
+		user, err = database.FindUserByName(ctx, ref)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if user == nil {
+		return nil, fmt.Errorf("user %q not found", ref)
+	}
+
+	return user, nil
+}
+
+func findUserNames(ctx context.Context) (map[int64]string, error) {
+	users, err := database.FindUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	names := map[int64]string{
+		0: "-",
+	}
+
+	for _, user := range users {
+		names[user.ID] = user.Name
+	}
+
+	return names, nil
+}
+
+func formatTaskTime(ts int64) string {
+	if ts == 0 {
+		return "never"
+	}
+
+	return time.Unix(ts, 0).Format("2006-01-02 15:04")
+}
+
 func taskScanStorage() error {
 	path, err := storageAbs()
 	if err != nil {
@@ -59,7 +366,7 @@ func taskScanStorage() error {
 			ext = "jpeg"
 		}
 
-		if config.IsValidImageFormat(ext) || config.IsValidVideoFormat(ext, false) {
+		if config.IsValidImageFormat(ext) || config.IsValidVideoFormat(ext, false) || ext == "txt" || config.IsAllowedFile(ext) {
 			hash := strings.TrimSuffix(filepath.Base(path), "."+ext)
 
 			info, err := entry.Info()
@@ -99,23 +406,116 @@ func taskScanStorage() error {
 	}
 
 	if len(create) == 0 {
-		log.Println("All files already in database, nothing to do.")
+		log.Println("All files already in database, nothing to add.")
+	} else {
+		log.Printf("Adding %d new entries to database...\n", len(create))
+
+		for i, echo := range create {
+			log.Printf("  [%d/%d] %s\n", i+1, len(create), echo.Hash)
+
+			err = database.Create(context.Background(), &echo)
+			if err != nil {
+				return err
+			}
+		}
+
+		log.Printf("Added %d entries.\n", len(create))
+	}
+
+	err = scanChecksums()
+	if err != nil {
+		return err
+	}
+
+	return scanTexts()
+}
+
+// scanChecksums fills in missing checksums (new entries and echos from before
+// deduplication) from the stored files.
+func scanChecksums() error {
+	missing, err := database.FindMissingChecksums(context.Background())
+	if err != nil {
+		return err
+	}
+
+	if len(missing) == 0 {
+		log.Println("All checksums present, nothing to do.")
+
+		return nil
+	}
+
+	log.Printf("Computing %d missing checksums...\n", len(missing))
+
+	var updated int
+
+	for i, echo := range missing {
+		log.Printf("  [%d/%d] %s\n", i+1, len(missing), echo.Hash)
+
+		checksum, err := hashFile(echo.Storage())
+		if err != nil {
+			if os.IsNotExist(err) {
+				log.Warnf("  missing file for %s, skipping\n", echo.Hash)
+
+				continue
+			}
+
+			return err
+		}
+
+		err = database.SetChecksum(context.Background(), echo.Hash, checksum)
+		if err != nil {
+			return err
+		}
+
+		updated++
+	}
+
+	log.Printf("Done! Computed %d checksums.\n", updated)
+
+	return nil
+}
+
+// scanTexts adds pastes missing from the full-text index (new entries and
+// indexes lost with the database).
+func scanTexts() error {
+	missing, err := database.FindUnindexedTexts(context.Background())
+	if err != nil {
+		return err
+	}
+
+	if len(missing) == 0 {
+		log.Println("All texts indexed, nothing to do.")
 
 		return nil
 	}
 
-	log.Printf("Adding %d new entries to database...\n", len(create))
+	log.Printf("Indexing %d texts...\n", len(missing))
 
-	for i, echo := range create {
-		log.Printf("  [%d/%d] %s\n", i+1, len(create), echo.Hash)
+	var indexed int
 
-		err = database.Create(context.Background(), &echo)
+	for i, echo := range missing {
+		log.Printf("  [%d/%d] %s\n", i+1, len(missing), echo.Hash)
+
+		content, err := os.ReadFile(echo.Storage())
+		if err != nil {
+			if os.IsNotExist(err) {
+				log.Warnf("  missing file for %s, skipping\n", echo.Hash)
+
+				continue
+			}
+
+			return err
+		}
+
+		err = database.IndexText(context.Background(), echo.Hash, string(content))
 		if err != nil {
 			return err
 		}
+
+		indexed++
 	}
 
-	log.Printf("Done! Added %d entries.\n", len(create))
+	log.Printf("Done! Indexed %d texts.\n", indexed)
 
 	return nil
 }
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	LanguageMaxLength = 32
+	PlainText         = "plaintext"
+
+	// trigram tokenizer, shorter terms can't match anything
+	MinSearchTermLength = 3
+)
+
+var rgLanguage = regexp.MustCompile(`^[a-z0-9+#._-]+$`)
+
+var languageAliases = map[string]string{
+	"text":       PlainText,
+	"txt":        PlainText,
+	"plain":      PlainText,
+	"js":         "javascript",
+	"jsx":        "javascript",
+	"node":       "javascript",
+	"ts":         "typescript",
+	"tsx":        "typescript",
+	"py":         "python",
+	"python3":    "python",
+	"rb":         "ruby",
+	"sh":         "bash",
+	"shell":      "bash",
+	"zsh":        "bash",
+	"rs":         "rust",
+	"golang":     "go",
+	"c++":        "cpp",
+	"cs":         "csharp",
+	"c#":         "csharp",
+	"kt":         "kotlin",
+	"yml":        "yaml",
+	"md":         "markdown",
+	"htm":        "html",
+	"svg":        "xml",
+	"patch":      "diff",
+	"docker":     "dockerfile",
+	"make":       "makefile",
+	"conf":       "ini",
+	"sqlite":     "sql",
+	"postgresql": "sql",
+}
+
+var extensionLanguages = map[string]string{
+	".go":    "go",
+	".py":    "python",
+	".js":    "javascript",
+	".mjs":   "javascript",
+	".cjs":   "javascript",
+	".jsx":   "javascript",
+	".ts":    "typescript",
+	".tsx":   "typescript",
+	".json":  "json",
+	".yaml":  "yaml",
+	".yml":   "yaml",
+	".toml":  "toml",
+	".ini":   "ini",
+	".cfg":   "ini",
+	".conf":  "ini",
+	".sh":    "bash",
+	".bash":  "bash",
+	".zsh":   "bash",
+	".rs":    "rust",
+	".c":     "c",
+	".h":     "c",
+	".cpp":   "cpp",
+	".cc":    "cpp",
+	".cxx":   "cpp",
+	".hpp":   "cpp",
+	".cs":    "csharp",
+	".java":  "java",
+	".kt":    "kotlin",
+	".swift": "swift",
+	".rb":    "ruby",
+	".php":   "php",
+	".lua":   "lua",
+	".sql":   "sql",
+	".html":  "html",
+	".htm":   "html",
+	".xml":   "xml",
+	".svg":   "xml",
+	".css":   "css",
+	".md":    "markdown",
+	".diff":  "diff",
+	".patch": "diff",
+}
+
+var pasteTemplate = template.Must(template.New("paste").Parse(`<!DOCTYPE html>
+<html lang="en">
+	<head>
+		<meta charset="UTF-8" />
+		<meta name="viewport" content="width=device-width, initial-scale=1.0" />
+		{{if .NoIndex}}<meta name="robots" content="noindex, nofollow" />{{end}}
+		<title>{{.Name}}</title>
+		<style>
+			body { margin: 0; background: #111; color: #ddd; font-family: monospace; }
+			header { position: sticky; top: 0; display: flex; align-items: center; gap: 16px; padding: 10px 16px; border-bottom: 1px solid #333; background: #181818; }
+			header .name { flex: 1; overflow: hidden; text-overflow: ellipsis; white-space: nowrap; }
+			header .language { color: #999; }
+			header a, header button { padding: 4px 8px; border: 1px solid #333; background: #111; color: #ddd; font-family: inherit; text-decoration: none; cursor: pointer; }
+			pre { margin: 0; padding: 12px 16px 12px 0; counter-reset: line; tab-size: 4; overflow-x: auto; }
+			.line::before { counter-increment: line; content: counter(line); display: inline-block; width: 5ch; margin-right: 16px; padding-right: 8px; border-right: 1px solid #333; color: #555; text-align: right; user-select: none; }
+			.k { color: #c792ea; }
+			.s { color: #c3e88d; }
+			.n { color: #f78c6c; }
+			.c { color: #676e95; font-style: italic; }
+			.a { color: #8bd49c; }
+			.d { color: #e55; }
+		</style>
+	</head>
+	<body>
+		<header>
+			<span class="name">{{.Name}}</span>
+			<span class="language">{{.Language}}</span>
+			{{if .RawURL}}<a href="{{.RawURL}}">RAW</a>{{end}}
+			<button type="button" onclick="navigator.clipboard.writeText(document.getElementById('code').innerText)">COPY</button>
+		</header>
+		<pre><code id="code">{{range .Lines}}<span class="line">{{.}}</span>
+{{end}}</code></pre>
+	</body>
+</html>`))
+
+type pastePage struct {
+	Name     string
+	Language string
+	RawURL   string
+	NoIndex  bool
+	Lines    []template.HTML
+}
+
+// parseLanguage normalizes a language name given with an upload.
+func parseLanguage(raw string) (string, error) {
+	language := strings.ToLower(strings.TrimSpace(raw))
+	if language == "" {
+		return "", nil
+	}
+
+	if alias, ok := languageAliases[language]; ok {
+		return alias, nil
+	}
+
+	if len(language) > LanguageMaxLength || !rgLanguage.MatchString(language) {
+		return "", errors.New("invalid language")
+	}
+
+	return language, nil
+}
+
+// detectLanguage guesses the language of a paste from its file name and its
+// first bytes.
+func detectLanguage(name string, head []byte) string {
+	base := strings.ToLower(filepath.Base(name))
+
+	switch base {
+	case "dockerfile", "containerfile":
+		return "dockerfile"
+	case "makefile", "gnumakefile":
+		return "makefile"
+	}
+
+	if language, ok := extensionLanguages[filepath.Ext(base)]; ok {
+		return language
+	}
+
+	head = bytes.TrimLeft(head, " \t\r\n")
+
+	if shebang, ok := bytes.CutPrefix(head, []byte("#!")); ok {
+		line, _, _ := bytes.Cut(shebang, []byte("\n"))
+
+		switch {
+		case bytes.Contains(line, []byte("python")):
+			return "python"
+		case bytes.Contains(line, []byte("node")):
+			return "javascript"
+		case bytes.Contains(line, []byte("ruby")):
+			return "ruby"
+		case bytes.Contains(line, []byte("php")):
+			return "php"
+		case bytes.Contains(line, []byte("lua")):
+			return "lua"
+		case bytes.Contains(line, []byte("sh")):
+			return "bash"
+		}
+	}
+
+	switch {
+	case bytes.HasPrefix(head, []byte("<?php")):
+		return "php"
+	case bytes.HasPrefix(head, []byte("<?xml")):
+		return "xml"
+	case hasPrefixFold(head, "<!doctype html"), hasPrefixFold(head, "<html"):
+		return "html"
+	case bytes.HasPrefix(head, []byte("diff --git")), bytes.HasPrefix(head, []byte("--- ")):
+		return "diff"
+	case bytes.HasPrefix(head, []byte("{")), bytes.HasPrefix(head, []byte("[")):
+		// a cut off head can't be valid json
+		if json.Valid(head) {
+			return "json"
+		}
+	}
+
+	return PlainText
+}
+
+func hasPrefixFold(b []byte, prefix string) bool {
+	return len(b) >= len(prefix) && strings.EqualFold(string(b[:len(prefix)]), prefix)
+}
+
+// prepareText checks a received text echo as a whole, the sniffer only saw
+// its beginning, and picks its language if none was given.
+func prepareText(echo *Echo, path string) error {
+	if echo.Extension != "txt" {
+		echo.Language = ""
+
+		return nil
+	}
+
+	if echo.UploadSize > config.MaxTextSizeBytes() {
+		return &UploadError{http.StatusRequestEntityTooLarge, "text too large", nil}
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return &UploadError{http.StatusInternalServerError, "internal storage error", err}
+	}
+
+	if int64(len(content)) > config.MaxTextSizeBytes() {
+		return &UploadError{http.StatusRequestEntityTooLarge, "text too large", nil}
+	}
+
+	if !utf8.Valid(content) || !isText(content) {
+		return &UploadError{http.StatusBadRequest, "unsupported file type", nil}
+	}
+
+	if echo.Language == "" {
+		echo.Language = detectLanguage(echo.Name, content[:min(len(content), MaxSniffBytes)])
+	}
+
+	return nil
+}
+
+func (e *Echo) IsText() bool {
+	return e.Extension == "txt"
+}
+
+// ViewURL returns the highlighted view of a text echo.
+func (e *Echo) ViewURL() string {
+	if !e.IsText() {
+		return ""
+	}
+
+	return config.Server.URL + "p/" + e.Hash
+}
+
+func indexText(echo *Echo) {
+	content, err := os.ReadFile(echo.Storage())
+	if err != nil {
+		log.Warnf("Failed to read text %s: %v\n", echo.Hash, err)
+
+		return
+	}
+
+	err = database.IndexText(context.Background(), echo.Hash, string(content))
+	if err != nil {
+		log.Warnf("Failed to index text %s: %v\n", echo.Hash, err)
+	}
+}
+
+func (d *EchoDatabase) IndexText(ctx context.Context, hash, content string) error {
+	_, err := d.ExecContext(ctx, "INSERT INTO texts (hash, content) VALUES (?, ?)", hash, content)
+
+	return err
+}
+
+func (d *EchoDatabase) DeleteText(hash string) error {
+	_, err := d.Exec("DELETE FROM texts WHERE hash = ?", hash)
+
+	return err
+}
+
+// SearchTexts returns the hashes of texts matching filter and containing all
+// terms of query, best matches first. The filter applies before the limit,
+// so texts of other owners don't use up the page.
+func (d *EchoDatabase) SearchTexts(ctx context.Context, query string, limit int, filter EchoFilter) ([]string, error) {
+	match := textMatchQuery(query)
+	if match == "" {
+		return nil, nil
+	}
+
+	var b strings.Builder
+
+	b.WriteString("SELECT texts.hash FROM texts JOIN echos ON echos.hash = texts.hash WHERE texts MATCH ?")
+
+	args := append([]any{match}, filter.Apply(&b)...)
+
+	b.WriteString(" ORDER BY texts.rank LIMIT ?")
+
+	args = append(args, limit)
+
+	rows, err := d.QueryContext(ctx, b.String(), args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var hashes []string
+
+	for rows.Next() {
+		var hash string
+
+		err = rows.Scan(&hash)
+		if err != nil {
+			return nil, err
+		}
+
+		hashes = append(hashes, hash)
+	}
+
+	return hashes, rows.Err()
+}
+
+// textMatchQuery quotes every term of query so fts5 syntax can't be
+// injected, dropping terms too short for the trigram index.
+func textMatchQuery(query string) string {
+	var terms []string
+
+	for term := range strings.FieldsSeq(query) {
+		if utf8.RuneCountInString(term) < MinSearchTermLength {
+			continue
+		}
+
+		terms = append(terms, `"`+strings.ReplaceAll(term, `"`, `""`)+`"`)
+	}
+
+	return strings.Join(terms, " ")
+}
+
+// FindUnindexedTexts returns text echos missing from the full-text index.
+func (d *EchoDatabase) FindUnindexedTexts(ctx context.Context) ([]Echo, error) {
+	rows, err := d.QueryContext(ctx, "SELECT "+echoColumns+" FROM echos WHERE extension = 'txt' AND hash NOT IN (SELECT hash FROM texts)")
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	return scanEchos(rows)
+}
+
+func pasteViewHandler(w http.ResponseWriter, r *http.Request) {
+	hash := chi.URLParam(r, "hash")
+	if !validateHash(hash) {
+		abort(w, http.StatusBadRequest, "invalid hash format")
+
+		log.Warnln("paste: invalid hash")
+
+		return
+	}
+
+	echo, err := database.Find(r.Context(), hash)
+	if err != nil {
+		abort(w, http.StatusInternalServerError, "database error")
+
+		log.Warnln("paste: failed to find echo")
+		log.Warnln(err)
+
+		return
+	}
+
+	if echo == nil || !echo.IsText() || echo.IsExpired() {
+		abort(w, http.StatusNotFound, "echo not found")
+
+		return
+	}
+
+	owner, cache, ok := authorizeView(w, r, echo)
+	if !ok {
+		return
+	}
+
+	storage, err := storageAbs()
+	if err != nil {
+		abort(w, http.StatusInternalServerError, "storage configuration error")
+
+		log.Warnln("paste: failed to resolve storage")
+		log.Warnln(err)
+
+		return
+	}
+
+	content, err := os.ReadFile(filepath.Join(storage, hash+".txt"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			abort(w, http.StatusNotFound, "echo not found")
+
+			return
+		}
+
+		abort(w, http.StatusInternalServerError, "failed to read echo file")
+
+		log.Warnln("paste: failed to read file")
+		log.Warnln(err)
+
+		return
+	}
+
+	burn, ok := claimBurn(w, r, echo, owner)
+	if !ok {
+		return
+	}
+
+	page := pastePage{
+		Name:     echo.Name,
+		Language: echo.Language,
+		NoIndex:  echo.Visibility != VisibilityPublic,
+		Lines:    highlight(string(content), echo.Language),
+	}
+
+	if echo.Burn {
+		cache = "private, no-store"
+	} else {
+		// share links and unlock cookies carry over to the raw file
+		page.RawURL = echo.URL()
+
+		if r.URL.RawQuery != "" {
+			page.RawURL += "?" + r.URL.RawQuery
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", cache)
+
+	okay(w)
+
+	pasteTemplate.Execute(w, page)
+
+	if burn {
+		finishBurn(r, echo)
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	TokenPrefix        = "ev_"
+	TokenTouchInterval = 60
+)
+
+type Scope uint8
+
+const (
+	ScopeUpload Scope = 1 << iota
+	ScopeRead
+	ScopeFavorite
+	ScopeDelete
+	ScopeAdmin
+)
+
+var scopeNames = []struct {
+	Scope Scope
+	Name  string
+}{
+	{ScopeUpload, "upload"},
+	{ScopeRead, "read"},
+	{ScopeFavorite, "favorite"},
+	{ScopeDelete, "delete"},
+	{ScopeAdmin, "admin"},
+}
+
+type Token struct {
+	ID       int64  `json:"id"`
+	Name     string `json:"name"`
+	UserID   int64  `json:"user_id"`
+	Scopes   Scope  `json:"scopes"`
+	Created  int64  `json:"created"`
+	LastUsed int64  `json:"last_used"`
+	Revoked  int64  `json:"revoked"`
+}
+
+type TokenCreateRequest struct {
+	Name   string   `json:"name"`
+	User   string   `json:"user"`
+	Scopes []string `json:"scopes"`
+}
+
+func ParseScopes(list []string) (Scope, error) {
+	var scopes Scope
+
+	for _, raw := range list {
+		name := strings.ToLower(strings.TrimSpace(raw))
+		if name == "" {
+			continue
+		}
+
+		var found bool
+
+		for _, entry := range scopeNames {
+			if entry.Name == name {
+				scopes |= entry.Scope
+				found = true
+
+				break
+			}
+		}
+
+		if !found {
+			return 0, fmt.Errorf("unknown scope %q", name)
+		}
+	}
+
+	if scopes == 0 {
+		return 0, fmt.Errorf("at least one scope is required")
+	}
+
+	return scopes, nil
+}
+
+func (s Scope) Has(scope Scope) bool {
+	if s&ScopeAdmin != 0 {
+		return true
+	}
+
+	return s&scope == scope
+}
+
+func (s Scope) Names() []string {
+	names := make([]string, 0, len(scopeNames))
+
+	for _, entry := range scopeNames {
+		if s&entry.Scope != 0 {
+			names = append(names, entry.Name)
+		}
+	}
+
+	return names
+}
+
+func (s Scope) String() string {
+	return strings.Join(s.Names(), ",")
+}
+
+func (s Scope) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.Names())
+}
+
+func (t *Token) IsRevoked() bool {
+	return t.Revoked != 0
+}
+
+func generateTokenSecret() (string, error) {
+	buf := make([]byte, 32)
+
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+
+	return TokenPrefix + base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func hashTokenSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+
+	return hex.EncodeToString(sum[:])
+}
+
+func (d *EchoDatabase) CreateToken(ctx context.Context, name string, userID int64, scopes Scope) (*Token, string, error) {
+	secret, err := generateTokenSecret()
+	if err != nil {
+		return nil, "", err
+	}
+
+	token := &Token{
+		Name:    name,
+		UserID:  userID,
+		Scopes:  scopes,
+		Created: time.Now().Unix(),
+	}
+
+	res, err := d.ExecContext(ctx, "INSERT INTO tokens (name, user_id, secret, scopes, created) VALUES (?, ?, ?, ?, ?)", token.Name, token.UserID, hashTokenSecret(secret), token.Scopes, token.Created)
+	if err != nil {
+		return nil, "", err
+	}
+
+	token.ID, err = res.LastInsertId()
+	if err != nil {
+		return nil, "", err
+	}
+
+	return token, secret, nil
+}
+
+func (d *EchoDatabase) FindTokenBySecret(ctx context.Context, secret string) (*Token, error) {
+	var t Token
+
+	err := d.QueryRowContext(ctx, "SELECT id, name, user_id, scopes, created, last_used, revoked FROM tokens WHERE secret = ? LIMIT 1", hashTokenSecret(secret)).Scan(&t.ID, &t.Name, &t.UserID, &t.Scopes, &t.Created, &t.LastUsed, &t.Revoked)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+func (d *EchoDatabase) FindTokens(ctx context.Context) ([]Token, error) {
+	rows, err := d.QueryContext(ctx, "SELECT id, name, user_id, scopes, created, last_used, revoked FROM tokens ORDER BY id ASC")
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var tokens []Token
+
+	for rows.Next() {
+		var t Token
+
+		err := rows.Scan(&t.ID, &t.Name, &t.UserID, &t.Scopes, &t.Created, &t.LastUsed, &t.Revoked)
+		if err != nil {
+			return nil, err
+		}
+
+		tokens = append(tokens, t)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+func (d *EchoDatabase) RevokeToken(ctx context.Context, id int64) (bool, error) {
+	res, err := d.ExecContext(ctx, "UPDATE tokens SET revoked = ? WHERE id = ? AND revoked = 0", time.Now().Unix(), id)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected > 0, nil
+}
+
+func (d *EchoDatabase) TouchToken(id int64) error {
+	_, err := d.Exec("UPDATE tokens SET last_used = ? WHERE id = ?", time.Now().Unix(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func listTokensHandler(w http.ResponseWriter, r *http.Request) {
+	tokens, err := database.FindTokens(r.Context())
+	if err != nil {
+		abort(w, http.StatusInternalServerError, "database error")
+
+		log.Warnln("tokens: failed to read tokens")
+		log.Warnln(err)
+
+		return
+	}
+
+	okay(w, "application/json")
+
+	json.NewEncoder(w).Encode(map[string]any{
+		"tokens": tokens,
+	})
+}
+
+func createTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var request TokenCreateRequest
+
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		abort(w, http.StatusBadRequest, "invalid request body")
+
+		log.Warnln("tokens: invalid request body")
+		log.Warnln(err)
+
+		return
+	}
+
+	request.Name = strings.TrimSpace(request.Name)
+
+	if request.Name == "" {
+		abort(w, http.StatusBadRequest, "missing token name")
+
+		log.Warnln("tokens: missing name")
+
+		return
+	}
+
+	scopes, err := ParseScopes(request.Scopes)
+	if err != nil {
+		abort(w, http.StatusBadRequest, err.Error())
+
+		log.Warnln("tokens: invalid scopes")
+
+		return
+	}
+
+	var userID int64
+
+	if request.User != "" {
+		user, err := database.FindUserByName(r.Context(), request.User)
+		if err != nil {
+			abort(w, http.StatusInternalServerError, "database error")
+
+			log.Warnln("tokens: failed to find user")
+			log.Warnln(err)
+
+			return
+		}
+
+		if user == nil {
+			abort(w, http.StatusNotFound, "user not found")
+
+			log.Warnf("tokens: user %q not found\n", request.User)
+
+			return
+		}
+
+		userID = user.ID
+	}
+
+	token, secret, err := database.CreateToken(r.Context(), request.Name, userID, scopes)
+	if err != nil {
+		abort(w, http.StatusInternalServerError, "database error")
+
+		log.Warnln("tokens: failed to create token")
+		log.Warnln(err)
+
+		return
+	}
+
+	audit(r, getCaller(r), AuditTokenCreate, "", fmt.Sprintf("#%d %q (%s)", token.ID, token.Name, token.Scopes))
+
+	okay(w, "application/json")
+
+	json.NewEncoder(w).Encode(map[string]any{
+		"token":  token,
+		"secret": secret,
+	})
+}
+
+func revokeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil || id < 1 {
+		abort(w, http.StatusBadRequest, "invalid token id")
+
+		log.Warnln("tokens: invalid id")
+
+		return
+	}
+
+	revoked, err := database.RevokeToken(r.Context(), id)
+	if err != nil {
+		abort(w, http.StatusInternalServerError, "database error")
+
+		log.Warnln("tokens: failed to revoke token")
+		log.Warnln(err)
+
+		return
+	}
+
+	if !revoked {
+		abort(w, http.StatusNotFound, "token not found")
+
+		log.Warnf("tokens: token %d not found\n", id)
+
+		return
+	}
+
+	audit(r, getCaller(r), AuditTokenRevoke, "", fmt.Sprintf("#%d", id))
+
+	okay(w)
+}
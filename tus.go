@@ -0,0 +1,670 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	TusVersion         = "1.0.0"
+	TusExtensions      = "creation,termination,expiration"
+	TusContentType     = "application/offset+octet-stream"
+	TusDirectory       = "uploads"
+	TusReaperInterval  = 15 * time.Minute
+	TusMaxMetadataSize = 4096
+)
+
+type ResumableUpload struct {
+	ID         string
+	Owner      int64
+	UploadID   string
+	Name       string
+	Extension  string
+	Visibility Visibility
+	Password   string
+	Metadata   string
+	Length     int64
+	Offset     int64
+	Hash       string
+	Created    int64
+	Expires    int64
+}
+
+// tusLocks holds the ids of uploads that currently receive data, a second
+// PATCH for the same upload is rejected instead of interleaving writes.
+var tusLocks sync.Map
+
+func EnsureResumableStorage() error {
+	return os.MkdirAll(TusDirectory, 0755)
+}
+
+func (u *ResumableUpload) Path() string {
+	return filepath.Join(TusDirectory, u.ID+".part")
+}
+
+func (u *ResumableUpload) IsComplete() bool {
+	return u.Hash != ""
+}
+
+func (u *ResumableUpload) IsExpired() bool {
+	return time.Now().Unix() > u.Expires
+}
+
+func (u *ResumableUpload) Location() string {
+	return config.Server.URL + "tus/" + u.ID
+}
+
+func generateResumableID() (string, error) {
+	buf := make([]byte, 16)
+
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buf), nil
+}
+
+func validateResumableID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+
+	_, err := hex.DecodeString(id)
+
+	return err == nil
+}
+
+// parseTusMetadata decodes the Upload-Metadata header, a comma separated
+// list of keys with optional base64 encoded values.
+func parseTusMetadata(raw string) (map[string]string, error) {
+	metadata := make(map[string]string)
+
+	if strings.TrimSpace(raw) == "" {
+		return metadata, nil
+	}
+
+	for pair := range strings.SplitSeq(raw, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+
+		if key == "" {
+			return nil, errors.New("empty metadata key")
+		}
+
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil {
+			return nil, err
+		}
+
+		metadata[key] = string(decoded)
+	}
+
+	return metadata, nil
+}
+
+func (d *EchoDatabase) CreateResumable(ctx context.Context, upload *ResumableUpload) error {
+	_, err := d.ExecContext(ctx, "INSERT INTO uploads (id, owner, upload_id, name, extension, visibility, password, metadata, length, received, hash, created, expires) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", upload.ID, upload.Owner, upload.UploadID, upload.Name, upload.Extension, upload.Visibility, upload.Password, upload.Metadata, upload.Length, upload.Offset, upload.Hash, upload.Created, upload.Expires)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (d *EchoDatabase) FindResumable(ctx context.Context, id string) (*ResumableUpload, error) {
+	var u ResumableUpload
+
+	err := d.QueryRowContext(ctx, "SELECT id, owner, upload_id, name, extension, visibility, password, metadata, length, received, hash, created, expires FROM uploads WHERE id = ? LIMIT 1", id).Scan(&u.ID, &u.Owner, &u.UploadID, &u.Name, &u.Extension, &u.Visibility, &u.Password, &u.Metadata, &u.Length, &u.Offset, &u.Hash, &u.Created, &u.Expires)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return &u, nil
+}
+
+func (d *EchoDatabase) UpdateResumable(ctx context.Context, upload *ResumableUpload) error {
+	_, err := d.ExecContext(ctx, "UPDATE uploads SET extension = ?, received = ?, hash = ?, expires = ? WHERE id = ?", upload.Extension, upload.Offset, upload.Hash, upload.Expires, upload.ID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (d *EchoDatabase) DeleteResumable(ctx context.Context, id string) error {
+	_, err := d.ExecContext(ctx, "DELETE FROM uploads WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (d *EchoDatabase) FindExpiredResumables(ctx context.Context) ([]string, error) {
+	rows, err := d.QueryContext(ctx, "SELECT id FROM uploads WHERE expires <= ?", time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var ids []string
+
+	for rows.Next() {
+		var id string
+
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, id)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+func removeResumable(ctx context.Context, id string) error {
+	err := os.Remove(filepath.Join(TusDirectory, id+".part"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return database.DeleteResumable(ctx, id)
+}
+
+// StartResumableReaper periodically removes stale partial uploads and
+// forgets completed ones once they expire.
+func StartResumableReaper() error {
+	err := EnsureResumableStorage()
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(TusReaperInterval)
+		defer ticker.Stop()
+
+		for {
+			ids, err := database.FindExpiredResumables(context.Background())
+			if err != nil {
+				log.Warnf("Failed to find expired uploads: %v\n", err)
+			}
+
+			var removed int
+
+			for _, id := range ids {
+				// still receiving data, a later run picks it up
+				if _, busy := tusLocks.LoadOrStore(id, struct{}{}); busy {
+					continue
+				}
+
+				err := removeResumable(context.Background(), id)
+
+				tusLocks.Delete(id)
+
+				if err != nil {
+					log.Warnf("Failed to remove expired upload %s: %v\n", id, err)
+
+					continue
+				}
+
+				removed++
+			}
+
+			if removed > 0 {
+				log.Printf("Removed %d expired resumable upload(s)\n", removed)
+			}
+
+			<-ticker.C
+		}
+	}()
+
+	return nil
+}
+
+func tusResumable(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", TusVersion)
+
+		if r.Method != http.MethodOptions && r.Header.Get("Tus-Resumable") != TusVersion {
+			w.Header().Set("Tus-Version", TusVersion)
+
+			abort(w, http.StatusPreconditionFailed, "unsupported tus version")
+
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func tusOptionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Version", TusVersion)
+	w.Header().Set("Tus-Extension", TusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(config.MaxResumableSizeBytes(), 10))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func setTusExpires(w http.ResponseWriter, upload *ResumableUpload) {
+	w.Header().Set("Upload-Expires", time.Unix(upload.Expires, 0).UTC().Format(http.TimeFormat))
+}
+
+func setTusResult(w http.ResponseWriter, upload *ResumableUpload) {
+	if !upload.IsComplete() {
+		return
+	}
+
+	echo, err := database.Find(context.Background(), upload.Hash)
+	if err != nil || echo == nil {
+		return
+	}
+
+	w.Header().Set("X-Echo-Hash", echo.Hash)
+	w.Header().Set("X-Echo-URL", echo.URL())
+}
+
+// findResumable loads the upload referenced by the request and checks that
+// the caller may access it. It writes the error response itself.
+func findResumable(w http.ResponseWriter, r *http.Request, prefix string) *ResumableUpload {
+	id := chi.URLParam(r, "id")
+	if !validateResumableID(id) {
+		abort(w, http.StatusNotFound, "upload not found")
+
+		return nil
+	}
+
+	upload, err := database.FindResumable(r.Context(), id)
+	if err != nil {
+		abort(w, http.StatusInternalServerError, "database error")
+
+		log.Warnf("%s: failed to find upload\n", prefix)
+		log.Warnln(err)
+
+		return nil
+	}
+
+	caller := getCaller(r)
+
+	if upload == nil || (!caller.IsAdmin() && upload.Owner != caller.Owner()) {
+		abort(w, http.StatusNotFound, "upload not found")
+
+		return nil
+	}
+
+	if upload.IsExpired() {
+		abort(w, http.StatusGone, "upload expired")
+
+		return nil
+	}
+
+	return upload
+}
+
+func tusCreateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		abort(w, http.StatusBadRequest, "deferred length is not supported")
+
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 1 {
+		abort(w, http.StatusBadRequest, "invalid Upload-Length")
+
+		log.Warnln("tus: invalid upload length")
+
+		return
+	}
+
+	if length > config.MaxResumableSizeBytes() {
+		abort(w, http.StatusRequestEntityTooLarge, "upload too large")
+
+		log.Warnln("tus: upload too large")
+
+		return
+	}
+
+	raw := r.Header.Get("Upload-Metadata")
+
+	if len(raw) > TusMaxMetadataSize {
+		abort(w, http.StatusBadRequest, "metadata too large")
+
+		log.Warnln("tus: metadata too large")
+
+		return
+	}
+
+	metadata, err := parseTusMetadata(raw)
+	if err != nil {
+		abort(w, http.StatusBadRequest, "invalid Upload-Metadata")
+
+		log.Warnln("tus: invalid metadata")
+		log.Warnln(err)
+
+		return
+	}
+
+	now := time.Now()
+
+	upload := &ResumableUpload{
+		Owner:    getCaller(r).Owner(),
+		Name:     metadata["filename"],
+		Metadata: raw,
+		Length:   length,
+		Created:  now.Unix(),
+		Expires:  now.Add(config.ResumableDuration()).Unix(),
+	}
+
+	if upload.Name == "" {
+		upload.Name = metadata["name"]
+	}
+
+	if id := metadata["id"]; len(id) == 6 {
+		if _, err := hex.DecodeString(id); err == nil {
+			upload.UploadID = strings.ToLower(id)
+		}
+	}
+
+	if name := metadata["visibility"]; name != "" {
+		upload.Visibility, err = ParseVisibility(name)
+		if err != nil {
+			abort(w, http.StatusBadRequest, err.Error())
+
+			log.Warnln("tus: invalid visibility")
+
+			return
+		}
+	}
+
+	if password := metadata["password"]; password != "" {
+		if len(password) > PasswordMaxLength {
+			abort(w, http.StatusBadRequest, "password too long")
+
+			log.Warnln("tus: password too long")
+
+			return
+		}
+
+		upload.Password, err = hashPassword(password)
+		if err != nil {
+			abort(w, http.StatusInternalServerError, "failed to hash password")
+
+			log.Warnln("tus: failed to hash password")
+			log.Warnln(err)
+
+			return
+		}
+	}
+
+	upload.ID, err = generateResumableID()
+	if err != nil {
+		abort(w, http.StatusInternalServerError, "failed to create upload")
+
+		log.Warnln("tus: failed to generate id")
+		log.Warnln(err)
+
+		return
+	}
+
+	file, err := os.OpenFile(upload.Path(), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		abort(w, http.StatusInternalServerError, "internal storage error")
+
+		log.Warnln("tus: failed to create upload file")
+		log.Warnln(err)
+
+		return
+	}
+
+	file.Close()
+
+	err = database.CreateResumable(r.Context(), upload)
+	if err != nil {
+		os.Remove(upload.Path())
+
+		abort(w, http.StatusInternalServerError, "database error")
+
+		log.Warnln("tus: failed to create upload")
+		log.Warnln(err)
+
+		return
+	}
+
+	w.Header().Set("Location", upload.Location())
+
+	setTusExpires(w, upload)
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+func tusHeadHandler(w http.ResponseWriter, r *http.Request) {
+	upload := findResumable(w, r, "tus")
+	if upload == nil {
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+
+	if upload.Metadata != "" {
+		w.Header().Set("Upload-Metadata", upload.Metadata)
+	}
+
+	setTusExpires(w, upload)
+	setTusResult(w, upload)
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func tusPatchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Type") != TusContentType {
+		abort(w, http.StatusUnsupportedMediaType, "content type must be "+TusContentType)
+
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		abort(w, http.StatusBadRequest, "invalid Upload-Offset")
+
+		return
+	}
+
+	id := chi.URLParam(r, "id")
+
+	if _, busy := tusLocks.LoadOrStore(id, struct{}{}); busy {
+		abort(w, http.StatusLocked, "upload is busy")
+
+		return
+	}
+
+	defer tusLocks.Delete(id)
+
+	upload := findResumable(w, r, "tus")
+	if upload == nil {
+		return
+	}
+
+	if offset != upload.Offset {
+		abort(w, http.StatusConflict, "offset mismatch")
+
+		return
+	}
+
+	if !upload.IsComplete() && upload.Offset < upload.Length {
+		status, message, err := receiveResumable(w, r, upload)
+		if err != nil {
+			abort(w, status, message)
+
+			log.Warnf("tus: %s\n", message)
+			log.Warnln(err)
+
+			return
+		}
+	}
+
+	if !upload.IsComplete() && upload.Offset == upload.Length {
+		err = finishResumable(r, upload)
+		if err != nil {
+			uploadFailed(w, "tus", err)
+
+			return
+		}
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+
+	setTusExpires(w, upload)
+	setTusResult(w, upload)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// receiveResumable appends the request body to the upload. The new offset
+// is stored even if the transfer breaks off, so the client can resume from
+// whatever arrived.
+func receiveResumable(w http.ResponseWriter, r *http.Request, upload *ResumableUpload) (int, string, error) {
+	file, err := os.OpenFile(upload.Path(), os.O_WRONLY, 0)
+	if err != nil {
+		return http.StatusInternalServerError, "internal storage error", err
+	}
+
+	defer file.Close()
+
+	_, err = file.Seek(upload.Offset, io.SeekStart)
+	if err != nil {
+		return http.StatusInternalServerError, "internal storage error", err
+	}
+
+	body := http.MaxBytesReader(w, r.Body, upload.Length-upload.Offset)
+
+	n, copyErr := io.Copy(file, body)
+
+	upload.Offset += n
+	upload.Expires = time.Now().Add(config.ResumableDuration()).Unix()
+
+	if upload.Extension == "" && (upload.Offset >= MaxSniffBytes || upload.Offset == upload.Length) {
+		sniffed, err := sniffFile(upload.Path(), upload.Name)
+		if err != nil {
+			return http.StatusInternalServerError, "internal storage error", err
+		}
+
+		if !isSupportedUpload(sniffed) {
+			err = removeResumable(context.Background(), upload.ID)
+			if err != nil {
+				log.Warnf("tus: failed to remove rejected upload: %v\n", err)
+			}
+
+			return http.StatusUnsupportedMediaType, "unsupported file type", errors.New(sniffed)
+		}
+
+		upload.Extension = sniffed
+	}
+
+	err = database.UpdateResumable(context.Background(), upload)
+	if err != nil {
+		return http.StatusInternalServerError, "database error", err
+	}
+
+	if copyErr != nil {
+		var maxErr *http.MaxBytesError
+
+		if errors.As(copyErr, &maxErr) {
+			return http.StatusRequestEntityTooLarge, "chunk exceeds upload length", copyErr
+		}
+
+		return http.StatusBadRequest, "failed to read chunk", copyErr
+	}
+
+	return 0, "", nil
+}
+
+func finishResumable(r *http.Request, upload *ResumableUpload) error {
+	echo := &Echo{
+		Name:       upload.Name,
+		Extension:  upload.Extension,
+		Owner:      upload.Owner,
+		Visibility: upload.Visibility,
+		Password:   upload.Password,
+		UploadSize: upload.Length,
+	}
+
+	var err error
+
+	if isAsync(r) {
+		_, err = storeUploadAsync(r, echo, upload.Path(), upload.UploadID, NewTimer())
+	} else {
+		_, err = storeUpload(r, echo, upload.Path(), upload.UploadID, NewTimer())
+	}
+
+	if err != nil {
+		return err
+	}
+
+	os.Remove(upload.Path())
+
+	upload.Hash = echo.Hash
+	upload.Expires = time.Now().Add(config.ResumableDuration()).Unix()
+
+	err = database.UpdateResumable(context.Background(), upload)
+	if err != nil {
+		log.Warnf("tus: failed to mark upload %s as complete: %v\n", upload.ID, err)
+	}
+
+	return nil
+}
+
+func tusDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	if _, busy := tusLocks.LoadOrStore(id, struct{}{}); busy {
+		abort(w, http.StatusLocked, "upload is busy")
+
+		return
+	}
+
+	defer tusLocks.Delete(id)
+
+	upload := findResumable(w, r, "tus")
+	if upload == nil {
+		return
+	}
+
+	err := removeResumable(r.Context(), upload.ID)
+	if err != nil {
+		abort(w, http.StatusInternalServerError, "failed to remove upload")
+
+		log.Warnln("tus: failed to remove upload")
+		log.Warnln(err)
+
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
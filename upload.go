@@ -3,222 +3,908 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"math"
-	"mime/multipart"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync/atomic"
+
+	"github.com/go-chi/chi/v5"
 )
 
-var limiter atomic.Int32
+// UploadQueue lets uploads wait for one of the max_concurrency processing
+// slots instead of failing right away. Only queue_depth uploads may wait at
+// once, each for at most queue_wait seconds.
+type UploadQueue struct {
+	queue   *Queue
+	pending atomic.Int32
+}
+
+var uploadQueue *UploadQueue
+
+func NewUploadQueue() *UploadQueue {
+	return &UploadQueue{
+		queue: NewQueue(config.Server.MaxConcurrency),
+	}
+}
+
+// Run waits up to queue_wait for a free slot and runs fn in it, returning
+// once fn is done.
+func (u *UploadQueue) Run(ctx context.Context, fn func()) error {
+	ctx, cancel := context.WithTimeout(ctx, config.QueueWait())
+	defer cancel()
+
+	return u.run(ctx, fn)
+}
+
+// capacity counts running uploads as well, so a free slot never needs room
+// in the queue.
+func (u *UploadQueue) capacity() int {
+	return config.Server.MaxConcurrency + config.Server.QueueDepth
+}
+
+// reserve takes a place in the queue, or fails if it is full. A reserved
+// place has to be used by work or given back with release.
+func (u *UploadQueue) reserve() error {
+	if u.pending.Add(1) > int32(u.capacity()) {
+		u.pending.Add(-1)
+
+		return &UploadError{http.StatusServiceUnavailable, "server busy: upload queue is full", nil}
+	}
+
+	return nil
+}
+
+func (u *UploadQueue) release() {
+	u.pending.Add(-1)
+}
+
+func (u *UploadQueue) run(ctx context.Context, fn func()) error {
+	err := u.reserve()
+	if err != nil {
+		return err
+	}
+
+	return u.work(ctx, fn)
+}
+
+// work runs fn in a place taken by reserve and gives it back afterwards.
+func (u *UploadQueue) work(ctx context.Context, fn func()) error {
+	var (
+		done     = make(chan struct{})
+		panicked any
+	)
+
+	err := u.queue.WorkContext(ctx, func() error {
+		defer u.release()
+		defer close(done)
+
+		// hand panics back to the request so the recoverer catches them
+		defer func() {
+			panicked = recover()
+		}()
+
+		fn()
+
+		return nil
+	})
+
+	if err != nil {
+		u.release()
+
+		if errors.Is(err, context.DeadlineExceeded) {
+			return &UploadError{http.StatusServiceUnavailable, "server busy: timed out waiting in upload queue", err}
+		}
+
+		return &UploadError{http.StatusServiceUnavailable, "upload cancelled", err}
+	}
+
+	<-done
+
+	if panicked != nil {
+		panic(panicked)
+	}
+
+	return nil
+}
+
+// UploadError carries the response for a failed upload along with the
+// underlying error that gets logged.
+type UploadError struct {
+	Status  int
+	Message string
+	Err     error
+}
+
+func (e *UploadError) Error() string {
+	if e.Err == nil {
+		return e.Message
+	}
+
+	return e.Message + ": " + e.Err.Error()
+}
+
+// UploadResult is the outcome of a single file of a (batch) upload.
+type UploadResult struct {
+	File     string
+	Status   int
+	Response map[string]any
+	Err      error
+}
+
+func (u *UploadResult) MarshalJSON() ([]byte, error) {
+	if u.Err == nil {
+		result := maps.Clone(u.Response)
+
+		result["file"] = u.File
+		result["status"] = u.Status
+
+		return json.Marshal(result)
+	}
+
+	uerr := asUploadError(u.Err)
+
+	return json.Marshal(map[string]any{
+		"file":   u.File,
+		"status": uerr.Status,
+		"error":  uerr.Message,
+	})
+}
 
 func uploadHandler(w http.ResponseWriter, r *http.Request) {
-	concurrent := limiter.Add(1)
-	defer limiter.Add(-1)
+	if !isMultipart(r) {
+		rawUploadHandler(w, r)
+
+		return
+	}
 
-	if concurrent > int32(config.Server.MaxConcurrency) {
-		abort(w, http.StatusTooManyRequests, "server busy: too many concurrent uploads")
+	options, err := parseUploadOptions(r)
+	if err != nil {
+		abort(w, http.StatusBadRequest, err.Error())
 
-		log.Warnln("upload: too many concurrent uploads")
+		log.Warnln("upload: invalid options")
+		log.Warnln(err)
 
 		return
 	}
 
-	r.Body = http.MaxBytesReader(w, r.Body, config.MaxFileSizeBytes())
+	err = precheckStorage(r)
+	if err != nil {
+		uploadFailed(w, "upload", err)
+
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, config.MaxBatchSizeBytes())
+
+	queue := NewQueue(config.Server.MaxConcurrency)
+
+	results, err := receiveUploads(r, queue, options)
+
+	queue.Wait()
 
-	mr, err := r.MultipartReader()
 	if err != nil {
-		abort(w, http.StatusBadRequest, "invalid multipart request")
+		uploadFailed(w, "upload", err)
 
-		log.Warnln("upload: not multipart")
-		log.Warnln(err)
+		return
+	}
+
+	// single uploads keep their plain response for existing clients
+	if len(results) == 1 {
+		result := results[0]
+
+		if result.Err != nil {
+			uploadFailed(w, "upload", result.Err)
+
+			return
+		}
+
+		writeUpload(w, result.Status, result.Response)
 
 		return
 	}
 
-	var part *multipart.Part
+	var failed int
+
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
+
+			log.Warnf("upload: %s failed: %v\n", result.File, result.Err)
+		}
+	}
+
+	okay(w, "application/json")
+
+	json.NewEncoder(w).Encode(map[string]any{
+		"results":  results,
+		"uploaded": len(results) - failed,
+		"failed":   failed,
+	})
+}
+
+// pendingUpload is a received upload waiting for the rest of its request.
+type pendingUpload struct {
+	path string
+	run  func() error
+}
+
+// receiveUploads reads every "upload" part of a multipart request into a
+// temporary file and hands them to queue for processing once the whole
+// request was read. Parts are read in order, so a "password" or "id" part
+// applies to the uploads following it. A password after the first upload is
+// rejected rather than leaving the files before it unprotected. A vanity slug
+// can only name a single upload. Errors returned affect the whole request,
+// errors of single files end up in their result.
+func receiveUploads(r *http.Request, queue *Queue, options *UploadOptions) ([]*UploadResult, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, &UploadError{http.StatusBadRequest, "invalid multipart request", err}
+	}
+
+	var (
+		results  []*UploadResult
+		password = r.Header.Get("X-Echo-Password")
+		hashed   string
+		language string
+		uploadID = getUploadId(r)
+		pending  []pendingUpload
+	)
+
+	fail := func(err error) ([]*UploadResult, error) {
+		for _, upload := range pending {
+			os.Remove(upload.path)
+		}
+
+		return nil, err
+	}
 
 	for {
-		p, err := mr.NextPart()
+		part, err := mr.NextPart()
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
 
-			abort(w, http.StatusBadRequest, "failed to read form data")
+			return fail(&UploadError{http.StatusBadRequest, "failed to read form data", err})
+		}
+
+		switch part.FormName() {
+		case "password":
+			if len(results) > 0 {
+				return fail(&UploadError{http.StatusBadRequest, "password has to be sent before the upload", nil})
+			}
+
+			password, err = readPasswordPart(part)
+			if err != nil {
+				return fail(&UploadError{http.StatusBadRequest, "invalid password field", err})
+			}
+
+			hashed = ""
+		case "id":
+			raw, err := io.ReadAll(io.LimitReader(part, 16))
+			if err != nil {
+				return fail(&UploadError{http.StatusBadRequest, "failed to read form data", err})
+			}
+
+			uploadID = parseUploadId(string(raw))
+		case "language":
+			raw, err := io.ReadAll(io.LimitReader(part, LanguageMaxLength+1))
+			if err != nil {
+				return fail(&UploadError{http.StatusBadRequest, "failed to read form data", err})
+			}
+
+			language, err = parseLanguage(string(raw))
+			if err != nil {
+				return fail(&UploadError{http.StatusBadRequest, err.Error(), nil})
+			}
+		case "upload":
+			if len(password) > PasswordMaxLength {
+				return fail(&UploadError{http.StatusBadRequest, "password too long", nil})
+			}
+
+			if password != "" && hashed == "" {
+				hashed, err = hashPassword(password)
+				if err != nil {
+					return fail(&UploadError{http.StatusInternalServerError, "failed to hash password", err})
+				}
+			}
+
+			result := &UploadResult{
+				File: part.FileName(),
+			}
+
+			results = append(results, result)
+
+			if len(results) > config.Server.MaxBatchFiles {
+				result.Err = &UploadError{http.StatusRequestEntityTooLarge, fmt.Sprintf("too many files (max %d)", config.Server.MaxBatchFiles), nil}
+
+				break
+			}
+
+			if options.Slug != "" && len(results) > 1 {
+				result.Err = &UploadError{http.StatusBadRequest, "a slug can only name a single upload", nil}
+
+				break
+			}
+
+			echo, sniffed, path, timer, err := receiveUpload(r, part, part.FileName(), options)
+			if err != nil {
+				result.Err = err
+
+				break
+			}
+
+			echo.Password = hashed
+
+			if language != "" {
+				echo.Language = language
+			}
+
+			id := uploadID
+
+			pending = append(pending, pendingUpload{path, func() error {
+				defer os.Remove(path)
+
+				defer func() {
+					if rec := recover(); rec != nil {
+						result.Err = &UploadError{http.StatusInternalServerError, "internal error", fmt.Errorf("panic: %v", rec)}
+					}
+				}()
+
+				result.Status, result.Response, result.Err = finishUpload(r, echo, path, id, sniffed, timer)
 
-			log.Warnln("upload: failed to read part")
+				return nil
+			}})
+		}
+
+		part.Close()
+	}
+
+	if len(results) == 0 {
+		return nil, &UploadError{http.StatusBadRequest, "missing 'upload' file field", nil}
+	}
+
+	for _, upload := range pending {
+		queue.Work(upload.run)
+	}
+
+	return results, nil
+}
+
+// rawUploadHandler takes the request body as the file, for PUT
+// /upload/{filename} and non-multipart POST /upload.
+func rawUploadHandler(w http.ResponseWriter, r *http.Request) {
+	options, err := parseUploadOptions(r)
+	if err != nil {
+		abort(w, http.StatusBadRequest, err.Error())
+
+		log.Warnln("upload: invalid options")
+		log.Warnln(err)
+
+		return
+	}
+
+	password := r.Header.Get("X-Echo-Password")
+
+	if len(password) > PasswordMaxLength {
+		abort(w, http.StatusBadRequest, "password too long")
+
+		log.Warnln("upload: password too long")
+
+		return
+	}
+
+	name := rawUploadName(r)
+
+	err = precheckStorage(r)
+	if err != nil {
+		uploadFailed(w, "upload", err)
+
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, config.MaxFileSizeBytes()+1)
+
+	echo, sniffed, path, timer, err := receiveUpload(r, r.Body, name, options)
+	if err != nil {
+		uploadFailed(w, "upload", err)
+
+		return
+	}
+
+	defer os.Remove(path)
+
+	if password != "" {
+		echo.Password, err = hashPassword(password)
+		if err != nil {
+			abort(w, http.StatusInternalServerError, "failed to hash password")
+
+			log.Warnln("upload: failed to hash password")
 			log.Warnln(err)
 
 			return
 		}
+	}
+
+	status, response, err := finishUpload(r, echo, path, getUploadId(r), sniffed, timer)
+	if err != nil {
+		uploadFailed(w, "upload", err)
+
+		return
+	}
+
+	if wantsText(r) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(status)
+
+		fmt.Fprintln(w, echo.URL())
 
-		if p.FormName() == "upload" {
-			part = p
+		return
+	}
+
+	writeUpload(w, status, response)
+}
+
+func isMultipart(r *http.Request) bool {
+	media, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	return err == nil && strings.HasPrefix(media, "multipart/")
+}
+
+// UploadOptions are the query parameters every upload route understands.
+type UploadOptions struct {
+	Visibility Visibility
+	Slug       string
+	Expires    int64
+	Burn       bool
+	Language   string
+}
 
-			break
+func parseUploadOptions(r *http.Request) (*UploadOptions, error) {
+	var (
+		options UploadOptions
+		err     error
+	)
+
+	if raw := r.URL.Query().Get("visibility"); raw != "" {
+		options.Visibility, err = ParseVisibility(raw)
+		if err != nil {
+			return nil, err
 		}
+	}
 
-		p.Close()
+	options.Slug, err = uploadSlug(r)
+	if err != nil {
+		return nil, err
 	}
 
-	if part == nil {
-		abort(w, http.StatusBadRequest, "missing 'upload' file field")
+	options.Expires, options.Burn, err = uploadExpiry(r)
+	if err != nil {
+		return nil, err
+	}
 
-		log.Warnln("upload: missing 'upload' part")
+	options.Language, err = parseLanguage(r.URL.Query().Get("language"))
+	if err != nil {
+		return nil, err
+	}
 
-		return
+	return &options, nil
+}
+
+// Apply sets the options on a freshly received echo.
+func (o *UploadOptions) Apply(echo *Echo) {
+	echo.Hash = o.Slug
+	echo.Visibility = o.Visibility
+	echo.Expires = o.Expires
+	echo.Burn = o.Burn
+	echo.Language = o.Language
+}
+
+// uploadSlug returns the vanity id requested with the "slug" query parameter,
+// if any.
+func uploadSlug(r *http.Request) (string, error) {
+	slug := r.URL.Query().Get("slug")
+	if slug == "" {
+		return "", nil
 	}
 
-	defer part.Close()
+	if !config.IDs.Vanity {
+		return "", errors.New("vanity slugs are disabled")
+	}
 
+	if !validateVanity(slug) {
+		return "", errors.New("invalid slug")
+	}
+
+	if isReservedSlug(slug) {
+		return "", errors.New("slug is reserved")
+	}
+
+	return slug, nil
+}
+
+// rawUploadName picks the file name of a raw upload from the url, the
+// Content-Disposition header or the name query parameter.
+func rawUploadName(r *http.Request) string {
+	if name := chi.URLParam(r, "filename"); name != "" {
+		unescaped, err := url.PathUnescape(name)
+		if err == nil {
+			return unescaped
+		}
+
+		return name
+	}
+
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Disposition"))
+	if err == nil && params["filename"] != "" {
+		return filepath.Base(params["filename"])
+	}
+
+	if name := r.URL.Query().Get("name"); name != "" {
+		return name
+	}
+
+	return "upload"
+}
+
+// wantsText reports whether the client asked for a plain text response
+// (just the url) instead of json.
+func wantsText(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+
+	return strings.Contains(accept, "text/plain") && !strings.Contains(accept, "application/json")
+}
+
+// receiveUpload sniffs and stores a single uploaded file in a temporary file
+// that the caller has to remove.
+func receiveUpload(r *http.Request, body io.Reader, name string, options *UploadOptions) (*Echo, string, string, *Timer, error) {
 	timer := NewTimer().Start("read")
 
 	var sniff bytes.Buffer
 
 	limited := io.LimitedReader{
-		R: part,
+		R: body,
 		N: MaxSniffBytes,
 	}
 
-	_, err = io.Copy(&sniff, &limited)
+	_, err := io.Copy(&sniff, &limited)
 	if err != nil && err != io.EOF {
-		abort(w, http.StatusBadRequest, "failed to read file stream")
+		return nil, "", "", nil, &UploadError{http.StatusBadRequest, "failed to read file stream", err}
+	}
 
-		log.Warnln("upload: failed to read file header")
-		log.Warnln(err)
+	sniffed := sniffUpload(sniff.Bytes(), name)
 
-		return
+	if !isSupportedUpload(sniffed) {
+		return nil, "", "", nil, &UploadError{http.StatusBadRequest, "unsupported file type", nil}
+	}
+
+	echo := &Echo{
+		Name:      name,
+		Extension: sniffed,
+		Owner:     getCaller(r).Owner(),
+	}
+
+	options.Apply(echo)
+
+	file, path, err := OpenTempFileForWriting()
+	if err != nil {
+		return nil, "", "", nil, &UploadError{http.StatusInternalServerError, "internal storage error", err}
 	}
 
-	sniffed := sniffType(sniff.Bytes())
+	defer file.Close()
 
-	if sniffed == "" || (!config.IsValidImageFormat(sniffed) && !config.IsValidVideoFormat(sniffed, true)) {
-		abort(w, http.StatusBadRequest, "unsupported file type")
+	hasher := sha256.New()
+	writer := io.MultiWriter(file, hasher)
 
-		log.Warnln("upload: invalid/unrecognized filetype")
+	n1, err := writer.Write(sniff.Bytes())
+	if err != nil {
+		os.Remove(path)
 
-		return
+		return nil, "", "", nil, &UploadError{http.StatusInternalServerError, "internal write error", err}
 	}
 
-	echo := &Echo{
-		Name:      part.FileName(),
-		Extension: sniffed,
+	limit := config.MaxFileSizeBytes()
+
+	if sniffed == "txt" {
+		limit = min(limit, config.MaxTextSizeBytes())
 	}
 
-	file, path, err := OpenTempFileForWriting()
+	// one byte more than allowed to detect oversized files
+	n2, err := io.Copy(writer, io.LimitReader(body, max(limit-int64(n1), 0)+1))
 	if err != nil {
-		abort(w, http.StatusInternalServerError, "internal storage error")
+		os.Remove(path)
 
-		log.Warnln("upload: failed to open temporary file")
-		log.Warnln(err)
+		return nil, "", "", nil, &UploadError{http.StatusInternalServerError, "internal write error", err}
+	}
 
-		return
+	echo.UploadSize = int64(n1) + n2
+
+	if echo.UploadSize > limit {
+		os.Remove(path)
+
+		if sniffed == "txt" {
+			return nil, "", "", nil, &UploadError{http.StatusRequestEntityTooLarge, "text too large", nil}
+		}
+
+		return nil, "", "", nil, &UploadError{http.StatusRequestEntityTooLarge, "file too large", nil}
 	}
 
-	defer file.Close()
-	defer os.Remove(path)
+	echo.Checksum = hex.EncodeToString(hasher.Sum(nil))
 
-	n1, err := file.Write(sniff.Bytes())
+	timer.Stop("read")
+
+	return echo, sniffed, path, timer, nil
+}
+
+func isSupportedUpload(sniffed string) bool {
+	if sniffed == "txt" {
+		return config.Texts.Enabled
+	}
+
+	return sniffed != "" && (config.IsValidImageFormat(sniffed) || config.IsValidVideoFormat(sniffed, true) || config.IsAllowedFile(sniffed))
+}
+
+// storeUpload waits for a free slot in the upload queue, then runs a fully
+// received upload through the processing pipeline, stores the echo and
+// announces it. The temporary file at path is left for the caller to remove.
+func storeUpload(r *http.Request, echo *Echo, path, uploadID string, timer *Timer) (int64, error) {
+	err := prepareText(echo, path)
 	if err != nil {
-		abort(w, http.StatusInternalServerError, "internal write error")
+		return 0, err
+	}
 
-		log.Warnln("upload: failed to write file header")
-		log.Warnln(err)
+	var size int64
 
-		return
+	timer.Start("queue")
+
+	qerr := uploadQueue.Run(r.Context(), func() {
+		timer.Stop("queue")
+
+		size, err = processUpload(r, echo, path, uploadID, timer)
+	})
+
+	if qerr != nil {
+		return 0, qerr
 	}
 
-	n2, err := io.Copy(file, part)
+	return size, err
+}
+
+func processUpload(r *http.Request, echo *Echo, path, uploadID string, timer *Timer) (int64, error) {
+	timer.Start("dedupe")
+
+	duplicate, release, err := checkDuplicate(r.Context(), echo, path)
 	if err != nil {
-		abort(w, http.StatusInternalServerError, "internal write error")
+		return 0, err
+	}
 
-		log.Warnln("upload: failed to write file body")
-		log.Warnln(err)
+	timer.Stop("dedupe")
 
-		return
+	if duplicate {
+		return echo.Size, nil
 	}
 
-	file.Close()
+	defer release()
 
-	echo.UploadSize = int64(n1) + n2
+	timer.Start("store")
+
+	err = reserveEcho(echo)
+	if err != nil {
+		return 0, err
+	}
+
+	timer.Stop("store").Start("write")
 
-	timer.Stop("read").Start("write")
+	size, err := encodeUpload(r.Context(), echo, path)
+	if err == nil {
+		err = completeEcho(echo)
+	}
 
-	size, err := echo.SaveUploadedFile(r.Context(), path)
 	if err != nil {
-		abort(w, http.StatusInternalServerError, "failed to save to permanent storage")
+		database.Delete(echo.Hash)
 
-		log.Warnln("upload: failed to save uploaded file")
-		log.Warnln(err)
+		return 0, err
+	}
+
+	usage.Add(uint64(echo.Size))
+	count.Add(1)
+
+	timer.Stop("write")
+
+	hub.BroadcastCreate(uploadID, echo)
+
+	auditUpload(r, echo)
+
+	indexUpload(echo)
+
+	return size, nil
+}
+
+// finishUpload stores a received upload, in the background if the request
+// asks for it, and returns the status and body to respond with.
+func finishUpload(r *http.Request, echo *Echo, path, uploadID, sniffed string, timer *Timer) (int, map[string]any, error) {
+	if isAsync(r) {
+		accepted, err := storeUploadAsync(r, echo, path, uploadID, timer)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if accepted {
+			return http.StatusAccepted, asyncResponse(echo, sniffed, timer), nil
+		}
+
+		return http.StatusOK, uploadResponse(echo, sniffed, echo.Size, timer), nil
+	}
+
+	size, err := storeUpload(r, echo, path, uploadID, timer)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return http.StatusOK, uploadResponse(echo, sniffed, size, timer), nil
+}
+
+func writeUpload(w http.ResponseWriter, status int, response map[string]any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	json.NewEncoder(w).Encode(response)
+}
+
+// reserveEcho inserts echo before its file is written, which claims the id
+// atomically and counts towards the quotas right away. The row already
+// carries the final extension while echo keeps the sniffed one for encoding.
+func reserveEcho(echo *Echo) error {
+	storageMx.Lock()
+	defer storageMx.Unlock()
+
+	err := checkStorage(context.Background(), echo)
+	if err != nil {
+		return err
+	}
+
+	sniffed := echo.Extension
+
+	echo.Extension = targetExtension(sniffed)
+
+	// short links are complete right away, everything else gets its file
+	// from completeEcho
+	if !echo.IsLink() {
+		echo.Pending = sniffed
+	}
+
+	err = database.Create(context.Background(), echo)
+
+	echo.Extension = sniffed
+
+	if err != nil {
+		if errors.Is(err, errHashTaken) {
+			return &UploadError{http.StatusConflict, "slug is already taken", nil}
+		}
+
+		return &UploadError{http.StatusInternalServerError, "database error", err}
+	}
+
+	return nil
+}
 
+// completeEcho stores the outcome of encoding a reserved echo.
+func completeEcho(echo *Echo) error {
+	found, err := database.FinishEcho(context.Background(), echo)
+	if err != nil {
 		os.Remove(echo.Storage())
 
-		return
+		return &UploadError{http.StatusInternalServerError, "database error", err}
 	}
 
-	stored := echo.Storage()
+	// deleted while it was being processed
+	if !found {
+		os.Remove(echo.Storage())
 
-	stat, err := os.Stat(stored)
+		return &UploadError{http.StatusGone, "echo was deleted", nil}
+	}
+
+	return nil
+}
+
+// encodeUpload converts the received file at path into its permanent storage
+// and sets the final size of echo.
+func encodeUpload(ctx context.Context, echo *Echo, path string) (int64, error) {
+	size, err := echo.SaveUploadedFile(ctx, path)
 	if err != nil {
-		abort(w, http.StatusInternalServerError, "failed to save to permanent storage")
+		os.Remove(echo.Storage())
 
-		log.Warnln("upload: failed to stat uploaded file")
-		log.Warnln(err)
+		return 0, &UploadError{http.StatusInternalServerError, "failed to save to permanent storage", err}
+	}
 
+	stored := echo.Storage()
+
+	stat, err := os.Stat(stored)
+	if err != nil {
 		os.Remove(stored)
 
-		return
+		return 0, &UploadError{http.StatusInternalServerError, "failed to save to permanent storage", err}
 	}
 
 	echo.Size = stat.Size()
 
-	timer.Stop("write").Start("store")
+	return size, nil
+}
 
-	err = database.Create(context.Background(), echo)
-	if err != nil {
-		abort(w, http.StatusInternalServerError, "database error")
+func auditUpload(r *http.Request, echo *Echo) {
+	detail := echo.Name
 
-		log.Warnln("upload: failed to create echo in database")
-		log.Warnln(err)
+	if echo.Source != "" {
+		detail += " from " + echo.Source
+	}
 
-		os.Remove(echo.Storage())
+	audit(r, getCaller(r), AuditUpload, echo.Hash, detail)
+}
+
+func indexUpload(echo *Echo) {
+	if echo.IsText() {
+		indexText(echo)
 
 		return
 	}
 
-	usage.Add(uint64(echo.Size))
-	count.Add(1)
+	if vector == nil || !echo.IsImage() || echo.Animated {
+		return
+	}
 
-	timer.Stop("store")
+	go func() {
+		err := vector.IndexImage(context.Background(), echo.Hash, echo.Storage())
+		if err != nil {
+			log.Warnf("Failed to index image: %v\n", err)
+		} else {
+			log.Printf("Indexed image %s\n", echo.Hash)
+		}
+	}()
+}
 
-	hub.BroadcastCreate(getUploadId(r), echo)
+func uploadResponse(echo *Echo, sniffed string, size int64, timer *Timer) map[string]any {
+	return map[string]any{
+		"echo":         echo,
+		"sniffed":      sniffed,
+		"change":       formatSizeChange(echo.UploadSize, size),
+		"timing":       timer,
+		"deletion_url": echo.DeletionURL(),
+	}
+}
 
-	if vector != nil && echo.IsImage() && !echo.Animated {
-		go func() {
-			err := vector.IndexImage(context.Background(), echo.Hash, echo.Storage())
-			if err != nil {
-				log.Warnf("Failed to index image: %v\n", err)
-			} else {
-				log.Printf("Indexed image %s\n", echo.Hash)
-			}
-		}()
+func asUploadError(err error) *UploadError {
+	var uerr *UploadError
+
+	if !errors.As(err, &uerr) {
+		uerr = &UploadError{http.StatusInternalServerError, "internal error", err}
 	}
 
-	okay(w, "application/json")
+	return uerr
+}
 
-	json.NewEncoder(w).Encode(map[string]any{
-		"echo":    echo,
-		"sniffed": sniffed,
-		"change":  formatSizeChange(echo.UploadSize, size),
-		"timing":  timer,
-	})
+// uploadFailed writes the response for an error returned by storeUpload.
+func uploadFailed(w http.ResponseWriter, prefix string, err error) {
+	uerr := asUploadError(err)
+
+	abort(w, uerr.Status, uerr.Message)
+
+	log.Warnf("%s: %s\n", prefix, uerr.Message)
+
+	if uerr.Err != nil {
+		log.Warnln(uerr.Err)
+	}
 }
 
 func byteCountSI(b int64) string {
@@ -280,9 +966,10 @@ func formatFactor(ratio float64) string {
 }
 
 func getUploadId(r *http.Request) string {
-	query := r.URL.Query()
-	id := query.Get("id")
+	return parseUploadId(r.URL.Query().Get("id"))
+}
 
+func parseUploadId(id string) string {
 	if id == "" || len(id) != 6 {
 		return ""
 	}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const userColumns = "id, name, admin, subject, created, quota_storage, quota_files"
+
+type User struct {
+	ID      int64  `json:"id"`
+	Name    string `json:"name"`
+	Admin   bool   `json:"admin"`
+	Subject string `json:"subject,omitempty"`
+	Created int64  `json:"created"`
+
+	QuotaStorage int `json:"quota_storage"`
+	QuotaFiles   int `json:"quota_files"`
+}
+
+type UserCreateRequest struct {
+	Name  string `json:"name"`
+	Admin bool   `json:"admin"`
+}
+
+func scanUser(row rowScanner) (*User, error) {
+	var u User
+
+	err := row.Scan(&u.ID, &u.Name, &u.Admin, &u.Subject, &u.Created, &u.QuotaStorage, &u.QuotaFiles)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return &u, nil
+}
+
+func (d *EchoDatabase) CreateUser(ctx context.Context, name string, admin bool) (*User, error) {
+	user := &User{
+		Name:    name,
+		Admin:   admin,
+		Created: time.Now().Unix(),
+	}
+
+	res, err := d.ExecContext(ctx, "INSERT INTO users (name, admin, created) VALUES (?, ?, ?)", user.Name, user.Admin, user.Created)
+	if err != nil {
+		return nil, err
+	}
+
+	user.ID, err = res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func (d *EchoDatabase) FindUser(ctx context.Context, id int64) (*User, error) {
+	return scanUser(d.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE id = ? LIMIT 1", id))
+}
+
+func (d *EchoDatabase) FindUserByName(ctx context.Context, name string) (*User, error) {
+	return scanUser(d.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE name = ? LIMIT 1", name))
+}
+
+func (d *EchoDatabase) FindUsers(ctx context.Context) ([]User, error) {
+	rows, err := d.QueryContext(ctx, "SELECT "+userColumns+" FROM users ORDER BY id ASC")
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var users []User
+
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		users = append(users, *u)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// DeleteUser removes the user and revokes all of their tokens. Their echos
+// are kept and stay visible to admins.
+func (d *EchoDatabase) DeleteUser(ctx context.Context, id int64) (bool, error) {
+	res, err := d.ExecContext(ctx, "DELETE FROM users WHERE id = ?", id)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	if affected == 0 {
+		return false, nil
+	}
+
+	_, err = d.ExecContext(ctx, "UPDATE tokens SET revoked = ? WHERE user_id = ? AND revoked = 0", time.Now().Unix(), id)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func listUsersHandler(w http.ResponseWriter, r *http.Request) {
+	users, err := database.FindUsers(r.Context())
+	if err != nil {
+		abort(w, http.StatusInternalServerError, "database error")
+
+		log.Warnln("users: failed to read users")
+		log.Warnln(err)
+
+		return
+	}
+
+	okay(w, "application/json")
+
+	json.NewEncoder(w).Encode(map[string]any{
+		"users": users,
+	})
+}
+
+func createUserHandler(w http.ResponseWriter, r *http.Request) {
+	var request UserCreateRequest
+
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		abort(w, http.StatusBadRequest, "invalid request body")
+
+		log.Warnln("users: invalid request body")
+		log.Warnln(err)
+
+		return
+	}
+
+	request.Name = strings.TrimSpace(request.Name)
+
+	if request.Name == "" {
+		abort(w, http.StatusBadRequest, "missing user name")
+
+		log.Warnln("users: missing name")
+
+		return
+	}
+
+	existing, err := database.FindUserByName(r.Context(), request.Name)
+	if err != nil {
+		abort(w, http.StatusInternalServerError, "database error")
+
+		log.Warnln("users: failed to find user")
+		log.Warnln(err)
+
+		return
+	}
+
+	if existing != nil {
+		abort(w, http.StatusConflict, "user already exists")
+
+		log.Warnf("users: user %q already exists\n", request.Name)
+
+		return
+	}
+
+	user, err := database.CreateUser(r.Context(), request.Name, request.Admin)
+	if err != nil {
+		abort(w, http.StatusInternalServerError, "database error")
+
+		log.Warnln("users: failed to create user")
+		log.Warnln(err)
+
+		return
+	}
+
+	audit(r, getCaller(r), AuditUserCreate, "", fmt.Sprintf("#%d %q (admin: %v)", user.ID, user.Name, user.Admin))
+
+	okay(w, "application/json")
+
+	json.NewEncoder(w).Encode(map[string]any{
+		"user": user,
+	})
+}
+
+func deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil || id < 1 {
+		abort(w, http.StatusBadRequest, "invalid user id")
+
+		log.Warnln("users: invalid id")
+
+		return
+	}
+
+	deleted, err := database.DeleteUser(r.Context(), id)
+	if err != nil {
+		abort(w, http.StatusInternalServerError, "database error")
+
+		log.Warnln("users: failed to delete user")
+		log.Warnln(err)
+
+		return
+	}
+
+	if !deleted {
+		abort(w, http.StatusNotFound, "user not found")
+
+		log.Warnf("users: user %d not found\n", id)
+
+		return
+	}
+
+	audit(r, getCaller(r), AuditUserDelete, "", fmt.Sprintf("#%d", id))
+
+	okay(w)
+}
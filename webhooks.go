@@ -0,0 +1,619 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	WebhookCreate = "create"
+	WebhookUpdate = "update"
+	WebhookDelete = "delete"
+
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+
+	WebhookBatchSize     = 20
+	WebhookPollInterval  = 10 * time.Second
+	WebhookPruneInterval = time.Hour
+	WebhookBaseDelay     = 10 * time.Second
+	WebhookMaxDelay      = 6 * time.Hour
+	WebhookErrorLength   = 512
+	WebhookBufferSize    = 256
+)
+
+var webhookEvents = []string{WebhookCreate, WebhookUpdate, WebhookDelete}
+
+type WebhookDelivery struct {
+	ID          int64           `json:"id"`
+	Endpoint    string          `json:"endpoint"`
+	Event       string          `json:"event"`
+	Payload     json.RawMessage `json:"payload"`
+	State       string          `json:"state"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt int64           `json:"next_attempt,omitempty"`
+	Status      int             `json:"status,omitempty"`
+	Error       string          `json:"error,omitempty"`
+	Created     int64           `json:"created"`
+	Updated     int64           `json:"updated"`
+}
+
+type webhookEvent struct {
+	name    string
+	payload []byte
+}
+
+type DeliveryFilter struct {
+	State    string
+	Event    string
+	Endpoint string
+}
+
+// Webhooks delivers hub events to the configured endpoints. Deliveries are
+// queued in the database, so they survive restarts and are retried with
+// exponential backoff until they succeed or run out of attempts.
+type Webhooks struct {
+	client    *http.Client
+	endpoints map[string]EchoConfigWebhook
+	events    chan webhookEvent
+	wake      chan struct{}
+
+	ctx context.Context
+}
+
+var webhooks *Webhooks
+
+func NewWebhooks(ctx context.Context) *Webhooks {
+	endpoints := make(map[string]EchoConfigWebhook)
+
+	for _, endpoint := range config.Webhooks.Endpoints {
+		endpoints[endpoint.URL] = endpoint
+	}
+
+	return &Webhooks{
+		client: &http.Client{
+			Timeout: config.WebhookTimeout(),
+			// a redirect is answered like any other non-2xx response
+			CheckRedirect: func(_ *http.Request, _ []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		endpoints: endpoints,
+		events:    make(chan webhookEvent, WebhookBufferSize),
+		wake:      make(chan struct{}, 1),
+		ctx:       ctx,
+	}
+}
+
+func webhookEventName(typ int) string {
+	switch typ {
+	case EventCreateEcho:
+		return WebhookCreate
+	case EventUpdateEcho:
+		return WebhookUpdate
+	case EventDeleteEcho:
+		return WebhookDelete
+	}
+
+	return ""
+}
+
+// Wants reports whether the endpoint subscribed to event, no events means all.
+func (e *EchoConfigWebhook) Wants(event string) bool {
+	return len(e.Events) == 0 || slices.Contains(e.Events, event)
+}
+
+// Enqueue hands the encoded event to the recorder, which queues it for every
+// endpoint subscribed to it. Processing events only matter to the dashboard
+// and are never sent. It never blocks the broadcasting request, if the
+// database falls so far behind that the buffer is full the event is dropped.
+func (wh *Webhooks) Enqueue(event Event, payload []byte) {
+	name := webhookEventName(event.Type)
+	if name == "" {
+		return
+	}
+
+	select {
+	case wh.events <- webhookEvent{name, payload}:
+	default:
+		log.Warnf("Webhook buffer is full, dropping %s event\n", name)
+	}
+}
+
+// record stores enqueued events as deliveries, keeping database writes out
+// of the broadcasting request. Events still buffered on shutdown are lost,
+// like those of the hub.
+func (wh *Webhooks) record() {
+	for {
+		select {
+		case <-wh.ctx.Done():
+			return
+		case event := <-wh.events:
+			if wh.queue(event) {
+				wh.notify()
+			}
+		}
+	}
+}
+
+func (wh *Webhooks) queue(event webhookEvent) bool {
+	now := time.Now().Unix()
+
+	var queued bool
+
+	for url, endpoint := range wh.endpoints {
+		if !endpoint.Wants(event.name) {
+			continue
+		}
+
+		err := database.CreateDelivery(context.Background(), &WebhookDelivery{
+			Endpoint:    url,
+			Event:       event.name,
+			Payload:     event.payload,
+			State:       DeliveryPending,
+			NextAttempt: now,
+			Created:     now,
+			Updated:     now,
+		})
+		if err != nil {
+			log.Warnf("Failed to queue webhook for %s: %v\n", url, err)
+
+			continue
+		}
+
+		queued = true
+	}
+
+	return queued
+}
+
+func (wh *Webhooks) notify() {
+	select {
+	case wh.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run records and delivers webhooks until the context is done. Deliveries
+// left pending by a restart are picked up again right away.
+func (wh *Webhooks) Run() {
+	ctx := wh.ctx
+
+	go wh.record()
+
+	ticker := time.NewTicker(WebhookPollInterval)
+	defer ticker.Stop()
+
+	var pruned time.Time
+
+	for {
+		wh.deliverDue(ctx)
+
+		if time.Since(pruned) >= WebhookPruneInterval {
+			wh.prune(ctx)
+
+			pruned = time.Now()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-wh.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (wh *Webhooks) deliverDue(ctx context.Context) {
+	for {
+		due, err := database.FindDueDeliveries(ctx, time.Now().Unix(), WebhookBatchSize)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Warnf("Failed to find due webhooks: %v\n", err)
+			}
+
+			return
+		}
+
+		for i := range due {
+			err = wh.deliver(ctx, &due[i])
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Warnf("Failed to update webhook delivery %d: %v\n", due[i].ID, err)
+				}
+
+				return
+			}
+		}
+
+		if len(due) < WebhookBatchSize {
+			return
+		}
+	}
+}
+
+// deliver makes a single attempt at d and records its outcome.
+func (wh *Webhooks) deliver(ctx context.Context, d *WebhookDelivery) error {
+	d.Attempts++
+
+	endpoint, ok := wh.endpoints[d.Endpoint]
+	if !ok {
+		d.State = DeliveryFailed
+		d.NextAttempt = 0
+		d.Error = "endpoint is no longer configured"
+		d.Updated = time.Now().Unix()
+
+		return database.UpdateDelivery(ctx, d)
+	}
+
+	status, err := wh.send(ctx, &endpoint, d)
+
+	// shutting down, the attempt is repeated on the next start
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	d.Status = status
+	d.Error = ""
+	d.Updated = time.Now().Unix()
+
+	switch {
+	case err == nil:
+		d.State = DeliveryDelivered
+		d.NextAttempt = 0
+	case d.Attempts >= config.Webhooks.MaxAttempts:
+		d.State = DeliveryFailed
+		d.NextAttempt = 0
+		d.Error = truncateError(err)
+
+		log.Warnf("Giving up on webhook %d to %s after %d attempts: %v\n", d.ID, d.Endpoint, d.Attempts, err)
+	default:
+		d.NextAttempt = time.Now().Add(webhookBackoff(d.Attempts)).Unix()
+		d.Error = truncateError(err)
+	}
+
+	return database.UpdateDelivery(ctx, d)
+}
+
+func (wh *Webhooks) send(ctx context.Context, endpoint *EchoConfigWebhook, d *WebhookDelivery) (int, error) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Echo-Vault/"+Version)
+	req.Header.Set("X-Echo-Event", d.Event)
+	req.Header.Set("X-Echo-Delivery", strconv.FormatInt(d.ID, 10))
+	req.Header.Set("X-Echo-Timestamp", timestamp)
+	req.Header.Set("X-Echo-Signature", "sha256="+signWebhook(endpoint.Secret, timestamp, d.Payload))
+
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+
+	defer resp.Body.Close()
+
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("endpoint responded with status %d", resp.StatusCode)
+	}
+
+	return resp.StatusCode, nil
+}
+
+func (wh *Webhooks) prune(ctx context.Context) {
+	before := time.Now().AddDate(0, 0, -config.Webhooks.LogDays).Unix()
+
+	removed, err := database.PruneDeliveries(ctx, before)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Warnf("Failed to prune webhook deliveries: %v\n", err)
+		}
+
+		return
+	}
+
+	if removed > 0 {
+		log.Printf("Pruned %d webhook deliveries\n", removed)
+	}
+}
+
+// signWebhook signs the timestamp along with the body, so receivers can
+// reject replayed deliveries.
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func webhookBackoff(attempts int) time.Duration {
+	delay := WebhookBaseDelay
+
+	for i := 1; i < attempts && delay < WebhookMaxDelay; i++ {
+		delay *= 2
+	}
+
+	return min(delay, WebhookMaxDelay)
+}
+
+func truncateError(err error) string {
+	message := err.Error()
+
+	if len(message) > WebhookErrorLength {
+		message = message[:WebhookErrorLength]
+	}
+
+	return message
+}
+
+func scanDelivery(row rowScanner) (*WebhookDelivery, error) {
+	var (
+		d       WebhookDelivery
+		payload string
+	)
+
+	err := row.Scan(&d.ID, &d.Endpoint, &d.Event, &payload, &d.State, &d.Attempts, &d.NextAttempt, &d.Status, &d.Error, &d.Created, &d.Updated)
+	if err != nil {
+		return nil, err
+	}
+
+	d.Payload = json.RawMessage(payload)
+
+	return &d, nil
+}
+
+func scanDeliveries(rows *sql.Rows) ([]WebhookDelivery, error) {
+	deliveries := make([]WebhookDelivery, 0)
+
+	for rows.Next() {
+		d, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		deliveries = append(deliveries, *d)
+	}
+
+	err := rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return deliveries, nil
+}
+
+const deliveryColumns = "id, endpoint, event, payload, state, attempts, next_attempt, status, error, created, updated"
+
+func (d *EchoDatabase) CreateDelivery(ctx context.Context, delivery *WebhookDelivery) error {
+	res, err := d.ExecContext(ctx, "INSERT INTO deliveries (endpoint, event, payload, state, attempts, next_attempt, status, error, created, updated) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", delivery.Endpoint, delivery.Event, string(delivery.Payload), delivery.State, delivery.Attempts, delivery.NextAttempt, delivery.Status, delivery.Error, delivery.Created, delivery.Updated)
+	if err != nil {
+		return err
+	}
+
+	delivery.ID, err = res.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (d *EchoDatabase) FindDueDeliveries(ctx context.Context, now int64, limit int) ([]WebhookDelivery, error) {
+	rows, err := d.QueryContext(ctx, "SELECT "+deliveryColumns+" FROM deliveries WHERE state = ? AND next_attempt <= ? ORDER BY id ASC LIMIT ?", DeliveryPending, now, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	return scanDeliveries(rows)
+}
+
+func (d *EchoDatabase) UpdateDelivery(ctx context.Context, delivery *WebhookDelivery) error {
+	_, err := d.ExecContext(ctx, "UPDATE deliveries SET state = ?, attempts = ?, next_attempt = ?, status = ?, error = ?, updated = ? WHERE id = ?", delivery.State, delivery.Attempts, delivery.NextAttempt, delivery.Status, delivery.Error, delivery.Updated, delivery.ID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RetryDelivery queues a finished delivery again with a fresh set of attempts.
+func (d *EchoDatabase) RetryDelivery(ctx context.Context, id int64) (*WebhookDelivery, error) {
+	now := time.Now().Unix()
+
+	_, err := d.ExecContext(ctx, "UPDATE deliveries SET state = ?, attempts = 0, next_attempt = ?, updated = ? WHERE id = ? AND state != ?", DeliveryPending, now, now, id, DeliveryPending)
+	if err != nil {
+		return nil, err
+	}
+
+	delivery, err := scanDelivery(d.QueryRowContext(ctx, "SELECT "+deliveryColumns+" FROM deliveries WHERE id = ? LIMIT 1", id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return delivery, nil
+}
+
+func (d *EchoDatabase) PruneDeliveries(ctx context.Context, before int64) (int64, error) {
+	res, err := d.ExecContext(ctx, "DELETE FROM deliveries WHERE state != ? AND updated < ?", DeliveryPending, before)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+func (f DeliveryFilter) Apply(b *strings.Builder) []any {
+	var args []any
+
+	add := func(clause string, value any) {
+		b.WriteString(clause)
+
+		args = append(args, value)
+	}
+
+	if f.State != "" {
+		add(" AND state = ?", f.State)
+	}
+
+	if f.Event != "" {
+		add(" AND event = ?", f.Event)
+	}
+
+	if f.Endpoint != "" {
+		add(" AND endpoint = ?", f.Endpoint)
+	}
+
+	return args
+}
+
+func (d *EchoDatabase) FindDeliveries(ctx context.Context, offset, limit int, filter DeliveryFilter) ([]WebhookDelivery, int64, error) {
+	var b strings.Builder
+
+	b.WriteString("FROM deliveries WHERE 1 = 1")
+
+	args := filter.Apply(&b)
+
+	var total int64
+
+	err := d.QueryRowContext(ctx, "SELECT COUNT(id) "+b.String(), args...).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := d.QueryContext(ctx, "SELECT "+deliveryColumns+" "+b.String()+" ORDER BY id DESC LIMIT ? OFFSET ?", append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	defer rows.Close()
+
+	deliveries, err := scanDeliveries(rows)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return deliveries, total, nil
+}
+
+func listDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	page := 1
+
+	if raw := query.Get("page"); raw != "" {
+		num, err := strconv.Atoi(raw)
+		if err != nil || num < 1 {
+			abort(w, http.StatusBadRequest, "invalid page number")
+
+			log.Warnln("webhooks: invalid page number")
+
+			return
+		}
+
+		page = num
+	}
+
+	filter := DeliveryFilter{
+		State:    query.Get("state"),
+		Event:    query.Get("event"),
+		Endpoint: query.Get("endpoint"),
+	}
+
+	if filter.State != "" && filter.State != DeliveryPending && filter.State != DeliveryDelivered && filter.State != DeliveryFailed {
+		abort(w, http.StatusBadRequest, "invalid state parameter")
+
+		log.Warnln("webhooks: invalid state")
+
+		return
+	}
+
+	deliveries, total, err := database.FindDeliveries(r.Context(), (page-1)*PageSize, PageSize, filter)
+	if err != nil {
+		abort(w, http.StatusInternalServerError, "database error")
+
+		log.Warnln("webhooks: failed to read deliveries")
+		log.Warnln(err)
+
+		return
+	}
+
+	okay(w, "application/json")
+
+	json.NewEncoder(w).Encode(map[string]any{
+		"deliveries": deliveries,
+		"page":       page,
+		"total":      total,
+	})
+}
+
+func retryDeliveryHandler(w http.ResponseWriter, r *http.Request) {
+	if webhooks == nil {
+		abort(w, http.StatusServiceUnavailable, "webhooks are disabled")
+
+		return
+	}
+
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil || id < 1 {
+		abort(w, http.StatusBadRequest, "invalid delivery id")
+
+		log.Warnln("webhooks: invalid delivery id")
+
+		return
+	}
+
+	delivery, err := database.RetryDelivery(r.Context(), id)
+	if err != nil {
+		abort(w, http.StatusInternalServerError, "database error")
+
+		log.Warnln("webhooks: failed to retry delivery")
+		log.Warnln(err)
+
+		return
+	}
+
+	if delivery == nil {
+		abort(w, http.StatusNotFound, "delivery not found")
+
+		log.Warnf("webhooks: delivery %d not found\n", id)
+
+		return
+	}
+
+	webhooks.notify()
+
+	audit(r, getCaller(r), AuditWebhookRetry, "", fmt.Sprintf("delivery %d to %s", delivery.ID, delivery.Endpoint))
+
+	okay(w, "application/json")
+
+	json.NewEncoder(w).Encode(delivery)
+}
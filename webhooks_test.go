@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testWebhookSecret = "0123456789abcdef"
+
+type receivedWebhook struct {
+	header http.Header
+	body   []byte
+}
+
+// webhookReceiver records every delivery and answers the first failures of
+// them with 500.
+type webhookReceiver struct {
+	server   *httptest.Server
+	received chan receivedWebhook
+	failures atomic.Int32
+}
+
+func newWebhookReceiver(t *testing.T) *webhookReceiver {
+	t.Helper()
+
+	recv := &webhookReceiver{
+		received: make(chan receivedWebhook, 16),
+	}
+
+	recv.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		recv.received <- receivedWebhook{r.Header.Clone(), body}
+
+		if recv.failures.Add(-1) >= 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	t.Cleanup(recv.server.Close)
+
+	return recv
+}
+
+func (r *webhookReceiver) next(t *testing.T) receivedWebhook {
+	t.Helper()
+
+	select {
+	case hook := <-r.received:
+		return hook
+	case <-time.After(5 * time.Second):
+		t.Fatal("no webhook received")
+	}
+
+	return receivedWebhook{}
+}
+
+func (r *webhookReceiver) none(t *testing.T) {
+	t.Helper()
+
+	select {
+	case <-r.received:
+		t.Fatal("unexpected webhook received")
+	default:
+	}
+}
+
+func setupWebhooks(t *testing.T, recv *webhookReceiver) {
+	t.Helper()
+
+	setupTest(t, func(cfg *EchoConfig) {
+		cfg.Webhooks.Endpoints = []EchoConfigWebhook{
+			{
+				URL:    recv.server.URL,
+				Secret: testWebhookSecret,
+			},
+		}
+	})
+}
+
+func findDelivery(t *testing.T) WebhookDelivery {
+	t.Helper()
+
+	deliveries, _, err := database.FindDeliveries(context.Background(), 0, 10, DeliveryFilter{})
+	if err != nil {
+		t.Fatalf("failed to find deliveries: %v", err)
+	}
+
+	if len(deliveries) != 1 {
+		t.Fatalf("expected a single delivery, got %d", len(deliveries))
+	}
+
+	return deliveries[0]
+}
+
+func TestWebhookSignature(t *testing.T) {
+	recv := newWebhookReceiver(t)
+
+	setupWebhooks(t, recv)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	wh := NewWebhooks(ctx)
+
+	go wh.Run()
+
+	payload := []byte(`{"type":1,"hash":"ABCDEFGHIJ"}`)
+
+	wh.Enqueue(Event{Type: EventCreateEcho}, payload)
+
+	hook := recv.next(t)
+
+	if string(hook.body) != string(payload) {
+		t.Fatalf("unexpected body %q", hook.body)
+	}
+
+	if event := hook.header.Get("X-Echo-Event"); event != WebhookCreate {
+		t.Fatalf("unexpected event %q", event)
+	}
+
+	timestamp := hook.header.Get("X-Echo-Timestamp")
+
+	sent, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || time.Since(time.Unix(sent, 0)) > time.Minute {
+		t.Fatalf("invalid timestamp %q", timestamp)
+	}
+
+	mac := hmac.New(sha256.New, []byte(testWebhookSecret))
+
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	if signature := hook.header.Get("X-Echo-Signature"); !hmac.Equal([]byte(signature), []byte(expected)) {
+		t.Fatalf("invalid signature %q, expected %q", signature, expected)
+	}
+
+	// processing events are dashboard only
+	wh.Enqueue(Event{Type: EventProcessingEcho}, payload)
+
+	time.Sleep(100 * time.Millisecond)
+
+	recv.none(t)
+}
+
+func TestWebhookRetry(t *testing.T) {
+	recv := newWebhookReceiver(t)
+
+	recv.failures.Store(1)
+
+	setupWebhooks(t, recv)
+
+	ctx := context.Background()
+
+	wh := NewWebhooks(ctx)
+
+	if !wh.queue(webhookEvent{WebhookUpdate, []byte(`{}`)}) {
+		t.Fatal("expected the event to be queued")
+	}
+
+	before := time.Now()
+
+	wh.deliverDue(ctx)
+
+	recv.next(t)
+
+	delivery := findDelivery(t)
+
+	if delivery.State != DeliveryPending || delivery.Attempts != 1 || delivery.Status != http.StatusInternalServerError {
+		t.Fatalf("expected a pending retry after a 500, got %+v", delivery)
+	}
+
+	retry := time.Unix(delivery.NextAttempt, 0)
+
+	if retry.Before(before.Add(WebhookBaseDelay-time.Second)) || retry.After(time.Now().Add(WebhookBaseDelay)) {
+		t.Fatalf("expected a retry after %s, got %s", WebhookBaseDelay, retry.Sub(before))
+	}
+
+	// not due yet
+	wh.deliverDue(ctx)
+
+	recv.none(t)
+
+	_, err := database.Exec("UPDATE deliveries SET next_attempt = ?", time.Now().Unix())
+	if err != nil {
+		t.Fatalf("failed to move retry: %v", err)
+	}
+
+	wh.deliverDue(ctx)
+
+	recv.next(t)
+
+	delivery = findDelivery(t)
+
+	if delivery.State != DeliveryDelivered || delivery.Attempts != 2 || delivery.Status != http.StatusNoContent {
+		t.Fatalf("expected the retry to be delivered, got %+v", delivery)
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		delay    time.Duration
+	}{
+		{1, WebhookBaseDelay},
+		{2, 2 * WebhookBaseDelay},
+		{3, 4 * WebhookBaseDelay},
+		{100, WebhookMaxDelay},
+	}
+
+	for _, test := range tests {
+		if delay := webhookBackoff(test.attempts); delay != test.delay {
+			t.Errorf("attempt %d: expected %s, got %s", test.attempts, test.delay, delay)
+		}
+	}
+}
+
+func TestWebhookQueueSurvivesRestart(t *testing.T) {
+	recv := newWebhookReceiver(t)
+
+	setupWebhooks(t, recv)
+
+	// queued, but shut down before the worker got to it
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if !NewWebhooks(ctx).queue(webhookEvent{WebhookDelete, []byte(`{"type":3}`)}) {
+		t.Fatal("expected the event to be queued")
+	}
+
+	cancel()
+
+	database.Close()
+
+	var err error
+
+	database, err = ConnectToDatabase()
+	if err != nil {
+		t.Fatalf("failed to reconnect: %v", err)
+	}
+
+	queued := findDelivery(t)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+
+	go NewWebhooks(ctx).Run()
+
+	hook := recv.next(t)
+
+	if id := hook.header.Get("X-Echo-Delivery"); id != strconv.FormatInt(queued.ID, 10) {
+		t.Fatalf("expected delivery %d, got %q", queued.ID, id)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for findDelivery(t).State != DeliveryDelivered {
+		if time.Now().After(deadline) {
+			t.Fatal("delivery was not marked as delivered")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	recv.none(t)
+}
@@ -0,0 +1,44 @@
+package main
+
+// Word lists for word based ids. Short, common and unambiguous words only.
+
+var slugAdjectives = []string{
+	"able", "acid", "agile", "airy", "alert", "amber", "ample", "azure",
+	"balmy", "bare", "basic", "bold", "brave", "brief", "brisk", "broad",
+	"busy", "calm", "candid", "chief", "civil", "clean", "clear", "clever",
+	"cool", "cosy", "crisp", "curly", "cyan", "daily", "dandy", "dapper",
+	"dear", "deep", "dense", "eager", "early", "easy", "epic", "equal",
+	"exact", "fair", "fancy", "fast", "fine", "firm", "fleet", "fluffy",
+	"fond", "fresh", "frosty", "fuzzy", "gentle", "giant", "glad", "golden",
+	"good", "grand", "great", "green", "happy", "hardy", "hasty", "hearty",
+	"honest", "humble", "icy", "ideal", "jolly", "jumpy", "keen", "kind",
+	"large", "lavish", "lazy", "light", "lively", "lone", "loud", "lucky",
+	"lunar", "magic", "major", "mellow", "merry", "mild", "minty", "misty",
+	"modest", "neat", "nimble", "noble", "odd", "olive", "open", "pale",
+	"plain", "plucky", "polite", "prime", "proud", "quick", "quiet", "rapid",
+	"rare", "ready", "regal", "rosy", "royal", "rustic", "safe", "sandy",
+	"sharp", "shiny", "silent", "silky", "simple", "sleek", "smart", "snowy",
+	"solar", "solid", "spicy", "steady", "sunny", "super", "sweet", "swift",
+	"tame", "tidy", "tiny", "topaz", "tough", "true", "vast", "vivid",
+	"warm", "wavy", "wild", "wise", "witty", "young", "zany", "zesty",
+}
+
+var slugNouns = []string{
+	"acorn", "anchor", "apple", "arrow", "aspen", "badge", "banjo", "basil",
+	"beach", "bear", "beetle", "berry", "bison", "blossom", "boat", "bread",
+	"breeze", "brook", "cabin", "cactus", "camel", "candle", "canyon", "carrot",
+	"castle", "cedar", "cherry", "cloud", "clover", "comet", "coral", "crane",
+	"cricket", "crystal", "daisy", "delta", "desert", "dingo", "dolphin", "dove",
+	"dragon", "eagle", "ember", "falcon", "feather", "fern", "finch", "fjord",
+	"flame", "forest", "fox", "frog", "garden", "gecko", "glacier", "goose",
+	"grape", "harbor", "hawk", "hazel", "heron", "hill", "island", "ivy",
+	"jaguar", "jasmine", "kettle", "kite", "koala", "lagoon", "lake", "lamp",
+	"lemon", "lily", "lion", "lotus", "lynx", "maple", "marble", "meadow",
+	"melon", "meteor", "mint", "moon", "moose", "moss", "mountain", "nebula",
+	"needle", "nutmeg", "oak", "ocean", "olive", "orbit", "orchid", "otter",
+	"owl", "panda", "parrot", "peach", "pebble", "pepper", "pine", "planet",
+	"plum", "pond", "poppy", "prairie", "quartz", "rabbit", "raven", "reef",
+	"river", "robin", "rocket", "rose", "saffron", "salmon", "sparrow", "spruce",
+	"squid", "star", "stone", "summit", "swan", "thistle", "tiger", "tulip",
+	"turtle", "valley", "violet", "walnut", "whale", "willow", "wolf", "wren",
+}